@@ -11,5 +11,16 @@ func AddCommands(cmd *cobra.Command, dockerCli docker.Cli) {
 	cmd.AddCommand(
 		image.NewStatsCommand(dockerCli),
 		image.NewDiffCommand(dockerCli),
+		image.NewPushCommand(dockerCli),
+		image.NewVerifyCommand(dockerCli),
+		image.NewCacheCommand(dockerCli),
+		image.NewBundleCommand(dockerCli),
+		image.NewSquashCommand(dockerCli),
+		image.NewRebaseCommand(dockerCli),
+		image.NewExtractCommand(dockerCli),
+		image.NewFlattenCommand(dockerCli),
+		image.NewSBOMCommand(dockerCli),
+		image.NewScanCommand(dockerCli),
+		image.NewCheckCommand(dockerCli),
 	)
 }
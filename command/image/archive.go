@@ -0,0 +1,224 @@
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"docker-save/docker/utils"
+	"encoding/json"
+	"github.com/docker/docker/pkg/archive"
+	"golang.org/x/exp/slices"
+	"io"
+	"io/fs"
+	"path/filepath"
+	"time"
+)
+
+// tarImages streams untar dir as a tar archive with manifest.json generated from
+// manifests, and index.json pruned accordingly for OCI layouts, files matching
+// excludePatterns are left out, extra generated files replace those of untar dir,
+// the estimated size of the archive is returned for progress
+func tarImages(ctx context.Context, untarDir string, manifests []manifestItem, excludePatterns []string, extra []generatedFile) (io.ReadCloser, int64, error) {
+	generated, unusedBlobs, err := generateIndexFiles(untarDir, manifests, excludePatterns)
+	if err != nil {
+		return nil, 0, err
+	}
+	generated = append(generated, extra...)
+
+	patterns := append([]string{}, excludePatterns...)
+	patterns = append(patterns, unusedBlobs...)
+	for _, file := range generated {
+		patterns = append(patterns, file.name)
+	}
+	tarOptions := &archive.TarOptions{
+		Compression:     archive.Uncompressed,
+		ExcludePatterns: patterns,
+	}
+	size, err := estimateTarSize(untarDir, patterns, generated)
+	if err != nil {
+		return nil, 0, err
+	}
+	files, err := archive.TarWithOptions(untarDir, tarOptions)
+	if err != nil {
+		return nil, 0, err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		defer files.Close()
+		tw := tar.NewWriter(writer)
+		var err error
+		for _, file := range generated {
+			if file.linkname != "" {
+				continue
+			}
+			if err = writeTarFile(tw, file.name, file.content); err != nil {
+				break
+			}
+		}
+		if err == nil {
+			err = copyTarEntries(tw, tar.NewReader(utils.ContextReader(ctx, files)))
+		}
+		// hard links must follow their targets
+		for _, file := range generated {
+			if err != nil {
+				break
+			}
+			if file.linkname != "" {
+				err = writeTarLink(tw, file.name, file.linkname)
+			}
+		}
+		if err == nil {
+			err = tw.Close()
+		}
+		writer.CloseWithError(err)
+	}()
+	return reader, size, nil
+}
+
+// estimateTarSize sums up headers and padded contents of files in untar dir
+// not excluded and generated files, ignoring extended headers
+func estimateTarSize(untarDir string, excluded []string, generated []generatedFile) (int64, error) {
+	const blockSize = 512
+	padded := func(size int64) int64 {
+		return blockSize + (size+blockSize-1)/blockSize*blockSize
+	}
+	size := int64(2 * blockSize)
+	for _, file := range generated {
+		size += padded(int64(len(file.content)))
+	}
+	err := filepath.WalkDir(untarDir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(untarDir, file)
+		if err != nil || rel == "." {
+			return err
+		}
+		if slices.Contains(excluded, filepath.ToSlash(rel)) {
+			return nil
+		}
+		if entry.IsDir() {
+			size += padded(0)
+			return nil
+		}
+		info, err := entry.Info()
+		if err != nil {
+			return err
+		}
+		size += padded(info.Size())
+		return nil
+	})
+	return size, err
+}
+
+// generatedFile is written to archive in place of the file of untar dir,
+// as a hard link to linkname if set
+type generatedFile struct {
+	name     string
+	content  []byte
+	linkname string
+}
+
+// generateIndexFiles generates manifest.json, and index.json for OCI layouts,
+// returns blobs no longer referenced by index.json as well, OCI layouts with
+// layers of manifests excluded are left out for manifest.json only
+func generateIndexFiles(untarDir string, manifests []manifestItem, excluded []string) ([]generatedFile, []string, error) {
+	content, err := json.Marshal(manifests)
+	if err != nil {
+		return nil, nil, err
+	}
+	generated := []generatedFile{{name: manifestFileName, content: content}}
+	if !isOCILayout(untarDir) {
+		return generated, []string{}, nil
+	}
+	if excludesLayers(manifests, excluded) {
+		unused, err := ociLayoutFiles(untarDir, manifests)
+		return generated, unused, err
+	}
+
+	index, unusedBlobs, err := pruneOCIIndex(untarDir, manifests)
+	if err != nil {
+		return nil, nil, err
+	}
+	generated = append(generated, generatedFile{name: ociIndexFileName, content: index})
+	return generated, unusedBlobs, nil
+}
+
+func writeTarFile(tw *tar.Writer, name string, content []byte) error {
+	hdr := &tar.Header{
+		Typeflag: tar.TypeReg,
+		Name:     name,
+		Mode:     0644,
+		Size:     int64(len(content)),
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	}
+	if err := tw.WriteHeader(hdr); err != nil {
+		return err
+	}
+	_, err := tw.Write(content)
+	return err
+}
+
+func writeTarLink(tw *tar.Writer, name string, linkname string) error {
+	return tw.WriteHeader(&tar.Header{
+		Typeflag: tar.TypeLink,
+		Name:     name,
+		Linkname: linkname,
+		Mode:     0644,
+		ModTime:  time.Unix(0, 0),
+		Format:   tar.FormatPAX,
+	})
+}
+
+func copyTarEntries(tw *tar.Writer, tr *tar.Reader) error {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+}
+
+// excludeUnshared drops kept files from excluded, a layer excluded for one
+// image may be shared by another image which keeps it
+func excludeUnshared(excluded []string, kept []string) []string {
+	result := []string{}
+	for _, file := range excluded {
+		if !slices.Contains(kept, file) {
+			result = append(result, file)
+		}
+	}
+	return result
+}
+
+// unusedFiles returns config and layer files of dropped manifests which are
+// not referenced by kept manifests
+func unusedFiles(dropped []manifestItem, kept []manifestItem) []string {
+	used := map[string]bool{}
+	for _, m := range kept {
+		used[m.Config] = true
+		for _, layer := range m.Layers {
+			used[layer] = true
+		}
+	}
+	unused := []string{}
+	for _, m := range dropped {
+		for _, file := range append([]string{m.Config}, m.Layers...) {
+			if !used[file] {
+				used[file] = true
+				unused = append(unused, file)
+			}
+		}
+	}
+	return unused
+}
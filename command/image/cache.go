@@ -0,0 +1,212 @@
+package image
+
+import (
+	"context"
+	"docker-save/docker"
+	"docker-save/docker/cache"
+	"docker-save/docker/image"
+	"docker-save/docker/utils"
+	"github.com/distribution/reference"
+	"github.com/docker/docker/api/types"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slices"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// cachedExport returns an export func filling untar dir with images from the
+// managed cache, only images whose config is not cached yet are exported from
+// docker, at most n images are inspected and exported at a time
+func cachedExport(n int) func(context.Context, docker.Cli, []string, []ocispec.Platform, string) error {
+	return func(ctx context.Context, dockerCli docker.Cli, images []string, platforms []ocispec.Platform, unTarDir string) error {
+		c, err := cache.Open()
+		if err != nil {
+			return err
+		}
+
+		inspectPlatforms := []*ocispec.Platform{nil}
+		if len(platforms) > 0 {
+			inspectPlatforms = []*ocispec.Platform{}
+			for i := range platforms {
+				inspectPlatforms = append(inspectPlatforms, &platforms[i])
+			}
+		}
+
+		manifests := []manifestItem{}
+		for _, platform := range inspectPlatforms {
+			inspects, err := imageInspectParallel(ctx, dockerCli, images, platform, n)
+			if err != nil {
+				return err
+			}
+			cached := make([]*cache.Image, len(images))
+			err = utils.Parallel(ctx, n, len(images), func(ctx context.Context, i int) error {
+				var err error
+				cached[i], err = cachedImage(ctx, dockerCli, c, images[i], platform, inspects[i])
+				return err
+			})
+			if err != nil {
+				return err
+			}
+			for i, inspect := range inspects {
+				if manifests, err = addCachedImage(c, cached[i], cachedRepoTag(images[i], inspect), unTarDir, manifests); err != nil {
+					return err
+				}
+			}
+		}
+		return writeManifests(unTarDir, manifests)
+	}
+}
+
+// cachedImage returns image from cache, exporting it into cache if missing
+func cachedImage(ctx context.Context, dockerCli docker.Cli, c *cache.Cache, name string, platform *ocispec.Platform, inspect types.ImageInspect) (*cache.Image, error) {
+	id, err := digest.Parse(inspect.ID)
+	if err != nil {
+		return nil, errors.Wrapf(err, "invalid ID of image %s", name)
+	}
+	platformKey := ""
+	if platform != nil {
+		platformKey = image.FormatPlatform(*platform)
+	}
+	if cached, ok, err := c.GetImage(id, platformKey); err != nil || ok {
+		return cached, err
+	}
+
+	exportDir, err := c.TempDir(simplifyImageStr(name) + "-")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(exportDir)
+	exportPlatforms := []ocispec.Platform{}
+	if platform != nil {
+		exportPlatforms = append(exportPlatforms, *platform)
+	}
+	if err := doExportAndUntar(ctx, dockerCli, []string{name}, exportPlatforms, exportDir); err != nil {
+		return nil, err
+	}
+
+	manifests, err := ResolveManifests(exportDir)
+	if err != nil {
+		return nil, err
+	}
+	inspected := ocispec.Platform{OS: inspect.Os, Architecture: inspect.Architecture, Variant: inspect.Variant}
+	for _, m := range manifests {
+		img, err := loadImageConfig(exportDir, m)
+		if err != nil {
+			return nil, err
+		}
+		configDigest := digest.FromBytes(img.RawJSON())
+		if err := storeImage(c, exportDir, m, img); err != nil {
+			return nil, err
+		}
+		// docker with containerd image store identifies images by manifest digest
+		if configDigest != id && (len(manifests) == 1 || image.MatchPlatform(inspected, img.Platform())) {
+			if err := c.PutAlias(id, platformKey, configDigest); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	cached, ok, err := c.GetImage(id, platformKey)
+	if err == nil && !ok {
+		err = errors.Errorf("image %s not found in exported archive", name)
+	}
+	return cached, err
+}
+
+func storeImage(c *cache.Cache, exportDir string, m manifestItem, img *image.Image) error {
+	if len(img.RootFS.DiffIDs) != len(m.Layers) {
+		return errors.New("DiffIDs in image config not equal to layers exists.")
+	}
+	layerFiles := []string{}
+	for _, layerPath := range m.Layers {
+		layerFile, err := safePath(exportDir, layerPath)
+		if err != nil {
+			return err
+		}
+		layerFiles = append(layerFiles, layerFile)
+	}
+	cached := cache.Image{
+		ID:       digest.FromBytes(img.RawJSON()),
+		RepoTags: m.RepoTags,
+		DiffIDs:  img.RootFS.DiffIDs,
+	}
+	return c.PutImage(cached, img.RawJSON(), layerFiles)
+}
+
+// addCachedImage links config and layers of cached image into untar dir in
+// legacy layout, and adds it to manifests unless the same config is there
+func addCachedImage(c *cache.Cache, cached *cache.Image, repoTag string, unTarDir string, manifests []manifestItem) ([]manifestItem, error) {
+	configFile := cached.ID.Encoded() + ".json"
+	for i, m := range manifests {
+		if m.Config == configFile {
+			if repoTag != "" && !slices.Contains(m.RepoTags, repoTag) {
+				manifests[i].RepoTags = append(manifests[i].RepoTags, repoTag)
+			}
+			return manifests, nil
+		}
+	}
+
+	if err := linkOrCopy(c.ConfigPath(cached.ID), filepath.Join(unTarDir, configFile)); err != nil {
+		return nil, err
+	}
+	item := manifestItem{Config: configFile, RepoTags: []string{}}
+	if repoTag != "" {
+		item.RepoTags = append(item.RepoTags, repoTag)
+	}
+	for _, diffID := range cached.DiffIDs {
+		layerPath := path.Join(diffID.Encoded(), legacyLayerFileName)
+		target := filepath.Join(unTarDir, filepath.FromSlash(layerPath))
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			if err := linkOrCopy(c.LayerPath(diffID), target); err != nil {
+				return nil, err
+			}
+		}
+		item.Layers = append(item.Layers, layerPath)
+	}
+	return append(manifests, item), nil
+}
+
+// cachedRepoTag returns the repo tag docker save records for image name, none
+// for images referred by ID
+func cachedRepoTag(name string, inspect types.ImageInspect) string {
+	if strings.HasPrefix(inspect.ID, "sha256:"+strings.TrimPrefix(name, "sha256:")) {
+		return ""
+	}
+	named, err := reference.ParseNormalizedNamed(name)
+	if err != nil {
+		return ""
+	}
+	if _, ok := named.(reference.Digested); ok {
+		return ""
+	}
+	return reference.FamiliarString(reference.TagNameOnly(named))
+}
+
+// linkOrCopy hard links src to dst, or copies it when they are on different filesystems
+func linkOrCopy(src string, dst string) error {
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Link(src, dst); err == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	return err
+}
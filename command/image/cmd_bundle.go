@@ -0,0 +1,325 @@
+package image
+
+import (
+	"archive/tar"
+	"context"
+	"docker-save/docker"
+	"docker-save/docker/image"
+	"docker-save/docker/utils"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"path"
+	"strings"
+)
+
+// bundleIndexFileName is written into bundles before configs and layers, so
+// that an image can be extracted in a single pass
+const bundleIndexFileName = "bundle.json"
+
+type bundleIndex struct {
+	Images []bundleImage `json:"images"`
+}
+
+type bundleImage struct {
+	archiveManifestImage
+	Config string `json:"config"`
+	Size   int64  `json:"size"`
+}
+
+type bundleExtractOptions struct {
+	bundle   string
+	image    string
+	output   string
+	platform string
+	atomic   bool
+}
+
+// NewBundleCommand creates a new `docker-save bundle` command
+func NewBundleCommand(dockerCli docker.Cli) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "bundle",
+		Short: "Manage bundles storing layers shared by images once, from which single images are extracted",
+		Args:  docker.NoArgs,
+	}
+	cmd.AddCommand(
+		newBundleCreateCommand(dockerCli),
+		newBundleLsCommand(dockerCli),
+		newBundleExtractCommand(dockerCli),
+	)
+	return cmd
+}
+
+func newBundleCreateCommand(dockerCli docker.Cli) *cobra.Command {
+	opts := saveOptions{bundle: true}
+
+	cmd := &cobra.Command{
+		Use:   "create IMAGE [IMAGE...]",
+		Short: "Save images into a bundle with an index of their layers, loadable as a whole as well",
+		Args:  docker.RequiresMinArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.images = args
+			return RunSave(cmd.Context(), dockerCli, opts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.output, "output", "o", "", "Write to a file, instead of STDOUT")
+	flags.StringVarP(&opts.workdir, "workdir", "w", ".", "Directory for store tar files, default to current dir")
+	flags.BoolVarP(&opts.keep, "keep", "k", false, "Keep workdir afterwards, default to auto clean")
+	flags.BoolVar(&opts.cache, "cache", false, "Reuse configs and layers exported before from the managed cache, export only images not cached")
+	flags.IntVar(&opts.parallel, "parallel", 1, "Export and inspect up to n images from docker concurrently, merging shared layers")
+	flags.StringSliceVar(&opts.platforms, "platform", nil, "Save only the given platforms of multi-platform images, e.g. linux/amd64,linux/arm64")
+	flags.BoolVar(&opts.atomic, "atomic", false, "Write to a hidden temp file next to the output, sync and rename it when complete, requires -o")
+	flags.BoolVar(&opts.checksum, "checksum", false, "Write a sha256sum compatible OUTPUT.sha256 after the output is complete, requires -o")
+	flags.StringVar(&opts.splitSize, "split-size", "", "Split the output into volumes OUTPUT.000, OUTPUT.001... of at most the size with an OUTPUT.index, e.g. 4G, requires -o")
+
+	return cmd
+}
+
+func newBundleLsCommand(dockerCli docker.Cli) *cobra.Command {
+	return &cobra.Command{
+		Use:   "ls BUNDLE",
+		Short: "List images in a bundle with their sizes",
+		Args:  docker.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return RunBundleLs(cmd.Context(), dockerCli, args[0])
+		},
+	}
+}
+
+func newBundleExtractCommand(dockerCli docker.Cli) *cobra.Command {
+	var opts bundleExtractOptions
+
+	cmd := &cobra.Command{
+		Use:   "extract BUNDLE IMAGE",
+		Short: "Extract an image from a bundle as a tar archive for docker load",
+		Args:  docker.ExactArgs(2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.bundle = args[0]
+			opts.image = args[1]
+			return RunBundleExtract(cmd.Context(), dockerCli, opts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.output, "output", "o", "", "Write to a file, instead of STDOUT")
+	flags.StringVar(&opts.platform, "platform", "", "Extract the given platform if the bundle has several of the image, e.g. linux/arm64")
+	flags.BoolVar(&opts.atomic, "atomic", false, "Write to a hidden temp file next to the output, sync and rename it when complete, requires -o")
+
+	return cmd
+}
+
+// RunBundleLs lists images of a bundle by its index
+func RunBundleLs(ctx context.Context, dockerCli docker.Cli, bundle string) error {
+	index, err := readBundleIndexFile(ctx, bundle)
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(dockerCli.Out(), "%-40s  %-12s  %-14s  %6s  %10s\n", "REPO TAGS", "IMAGE ID", "PLATFORM", "LAYERS", "SIZE")
+	total := int64(0)
+	unique := map[string]int64{}
+	for _, img := range index.Images {
+		repoTags := strings.Join(img.RepoTags, ",")
+		if repoTags == "" {
+			repoTags = "<none>"
+		}
+		fmt.Fprintf(dockerCli.Out(), "%-40s  %-12.12s  %-14s  %6d  %10s\n",
+			OmitString(repoTags, 40), img.ID.Encoded(), img.Platform, len(img.Layers),
+			units.HumanSizeWithPrecision(float64(img.Size), 5))
+		total += img.Size
+		for _, layer := range img.Layers {
+			unique[layer.Path] = layer.Size
+		}
+	}
+	bundled := int64(0)
+	for _, size := range unique {
+		bundled += size
+	}
+	fmt.Fprintf(dockerCli.Out(), "\nTotal: %d images, %d unique layers, %s bundled for %s of images\n",
+		len(index.Images), len(unique), units.HumanSizeWithPrecision(float64(bundled), 5), units.HumanSizeWithPrecision(float64(total), 5))
+	return nil
+}
+
+// RunBundleExtract writes an image of a bundle as a standalone archive, reading
+// the bundle once and skipping layers of other images
+func RunBundleExtract(ctx context.Context, dockerCli docker.Cli, opts bundleExtractOptions) error {
+	if opts.output == "" && dockerCli.Out().IsTerminal() {
+		return errors.New("cowardly refusing to save to a terminal. Use the -o flag or redirect")
+	}
+	if err := command.ValidateOutputPath(opts.output); err != nil {
+		return errors.Wrap(err, "failed to extract image")
+	}
+	if opts.atomic && opts.output == "" {
+		return errors.New("--atomic requires the -o flag")
+	}
+
+	bundle, _, err := openArchive(opts.bundle)
+	if err != nil {
+		return err
+	}
+	defer bundle.Close()
+	tr := tar.NewReader(utils.ContextReader(ctx, bundle))
+	index, err := readBundleIndex(tr, opts.bundle)
+	if err != nil {
+		return err
+	}
+	img, err := index.find(opts.image, opts.platform)
+	if err != nil {
+		return err
+	}
+
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(extractBundleImage(tr, img, writer))
+	}()
+	_, _, err = outputSave(ctx, dockerCli, saveOptions{output: opts.output, atomic: opts.atomic}, reader, img.Size)
+	return err
+}
+
+// generateBundleIndex describes images of manifests for the bundle index
+func generateBundleIndex(untarDir string, manifests []manifestItem) (generatedFile, error) {
+	index := bundleIndex{Images: []bundleImage{}}
+	for _, m := range manifests {
+		img, err := loadImageConfig(untarDir, m)
+		if err != nil {
+			return generatedFile{}, err
+		}
+		bundled := bundleImage{archiveManifestImage: describeImage(untarDir, m, img, nil), Config: m.Config, Size: int64(len(img.RawJSON()))}
+		for _, layer := range bundled.Layers {
+			bundled.Size += layer.Size
+		}
+		index.Images = append(index.Images, bundled)
+	}
+	content, err := json.Marshal(index)
+	if err != nil {
+		return generatedFile{}, err
+	}
+	return generatedFile{name: bundleIndexFileName, content: content}, nil
+}
+
+func readBundleIndexFile(ctx context.Context, bundle string) (*bundleIndex, error) {
+	file, _, err := openArchive(bundle)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return readBundleIndex(tar.NewReader(utils.ContextReader(ctx, file)), bundle)
+}
+
+// readBundleIndex reads the index from the leading entries of bundle
+func readBundleIndex(tr *tar.Reader, bundle string) (*bundleIndex, error) {
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		switch path.Clean(hdr.Name) {
+		case manifestFileName, ociIndexFileName:
+			continue
+		case bundleIndexFileName:
+			index := &bundleIndex{}
+			if err := json.NewDecoder(tr).Decode(index); err != nil {
+				return nil, errors.Wrapf(err, "invalid %s", bundleIndexFileName)
+			}
+			return index, nil
+		}
+		break
+	}
+	return nil, errors.Errorf("%s is not a bundle, create one with `docker-save bundle create`", bundle)
+}
+
+// find returns the image referred by name, of the given platform if any
+func (index *bundleIndex) find(name string, platform string) (*bundleImage, error) {
+	found := []*bundleImage{}
+	for i, img := range index.Images {
+		if !manifestMatchesName(manifestItem{Config: img.Config, RepoTags: img.RepoTags}, name) {
+			continue
+		}
+		if platform != "" {
+			wanted, err := image.ParsePlatform(platform)
+			if err != nil {
+				return nil, err
+			}
+			got, err := image.ParsePlatform(img.Platform)
+			if err != nil || !image.MatchPlatform(wanted, got) {
+				continue
+			}
+		}
+		found = append(found, &index.Images[i])
+	}
+	switch len(found) {
+	case 0:
+		return nil, errors.Errorf("image %s not found in bundle", name)
+	case 1:
+		return found[0], nil
+	}
+	platforms := []string{}
+	for _, img := range found {
+		platforms = append(platforms, img.Platform)
+	}
+	return nil, errors.Errorf("bundle has image %s of platforms %s, choose one with --platform", name, strings.Join(platforms, ","))
+}
+
+// extractBundleImage writes manifest.json of img and copies its config and
+// layers from the rest of bundle, with legacy files in their layer directories
+func extractBundleImage(tr *tar.Reader, img *bundleImage, w io.Writer) error {
+	m := manifestItem{Config: img.Config, RepoTags: img.RepoTags}
+	required := map[string]bool{img.Config: true}
+	optional := map[string]bool{}
+	for _, layer := range img.Layers {
+		m.Layers = append(m.Layers, layer.Path)
+		required[layer.Path] = true
+		if id, legacy := legacyLayerID(layer.Path); legacy {
+			optional[id] = true
+			optional[path.Join(id, legacyConfigFileName)] = true
+			optional[path.Join(id, legacyVersionFileName)] = true
+		}
+	}
+	content, err := json.Marshal([]manifestItem{m})
+	if err != nil {
+		return err
+	}
+	tw := tar.NewWriter(w)
+	if err := writeTarFile(tw, manifestFileName, content); err != nil {
+		return err
+	}
+
+	found := 0
+	for found < len(required) {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return errors.Errorf("bundle is missing %d files of image %s", len(required)-found, img.ID)
+		}
+		if err != nil {
+			return err
+		}
+		name := path.Clean(hdr.Name)
+		if !required[name] && !optional[name] {
+			continue
+		}
+		if required[name] {
+			if hdr.Typeflag != tar.TypeReg {
+				return errors.Errorf("%s in bundle is not a regular file", name)
+			}
+			found++
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if _, err := io.Copy(tw, tr); err != nil {
+			return err
+		}
+	}
+	return tw.Close()
+}
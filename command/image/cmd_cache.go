@@ -0,0 +1,117 @@
+package image
+
+import (
+	"docker-save/docker"
+	"docker-save/docker/cache"
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"strings"
+	"time"
+)
+
+type cachePruneOptions struct {
+	olderThan time.Duration
+	maxSize   string
+}
+
+// NewCacheCommand creates a new `docker-save cache` command
+func NewCacheCommand(dockerCli docker.Cli) *cobra.Command {
+	cmd := &cobra.Command{
+		Use:   "cache",
+		Short: "Manage the cache of exported image configs and layers used by --cache",
+		Args:  docker.NoArgs,
+	}
+	cmd.AddCommand(
+		newCacheLsCommand(dockerCli),
+		newCachePruneCommand(dockerCli),
+	)
+	return cmd
+}
+
+func newCacheLsCommand(dockerCli docker.Cli) *cobra.Command {
+	return &cobra.Command{
+		Use:   "ls",
+		Short: "List cached images, most recently used first",
+		Args:  docker.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return RunCacheLs(dockerCli)
+		},
+	}
+}
+
+func newCachePruneCommand(dockerCli docker.Cli) *cobra.Command {
+	var opts cachePruneOptions
+
+	cmd := &cobra.Command{
+		Use:   "prune",
+		Short: "Remove cached images not used recently, and layers no cached image uses",
+		Args:  docker.NoArgs,
+		RunE: func(cmd *cobra.Command, args []string) error {
+			return RunCachePrune(dockerCli, opts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.DurationVar(&opts.olderThan, "older-than", 0, "Remove images not used within the duration, e.g. 168h")
+	flags.StringVar(&opts.maxSize, "max-size", "", "Remove least recently used images until cache fits in the size, e.g. 20GB")
+
+	return cmd
+}
+
+// RunCacheLs lists cached images
+func RunCacheLs(dockerCli docker.Cli) error {
+	c, err := cache.Open()
+	if err != nil {
+		return err
+	}
+	images, err := c.Images()
+	if err != nil {
+		return err
+	}
+
+	fmt.Fprintf(dockerCli.Out(), "%-12s  %-40s  %6s  %10s  %s\n", "IMAGE ID", "REPO TAGS", "LAYERS", "SIZE", "LAST USED")
+	for _, img := range images {
+		repoTags := strings.Join(img.RepoTags, ",")
+		if repoTags == "" {
+			repoTags = "<none>"
+		}
+		fmt.Fprintf(dockerCli.Out(), "%-12.12s  %-40s  %6d  %10s  %s ago\n",
+			img.ID.Encoded(),
+			OmitString(repoTags, 40),
+			len(img.DiffIDs),
+			units.HumanSizeWithPrecision(float64(img.Size), 5),
+			units.HumanDuration(time.Since(img.LastUsed)))
+	}
+	fmt.Fprintf(dockerCli.Out(), "\nTotal: %d images, %s in %s\n",
+		len(images), units.HumanSizeWithPrecision(float64(c.TotalSize(images)), 5), c.Root())
+	return nil
+}
+
+// RunCachePrune prunes cache by last use and size
+func RunCachePrune(dockerCli docker.Cli, opts cachePruneOptions) error {
+	maxSize := int64(0)
+	if opts.maxSize != "" {
+		size, err := units.FromHumanSize(opts.maxSize)
+		if err != nil {
+			return errors.Wrap(err, "invalid --max-size")
+		}
+		maxSize = size
+	}
+	if opts.olderThan <= 0 && maxSize <= 0 {
+		return errors.New("one of --older-than and --max-size is required")
+	}
+
+	c, err := cache.Open()
+	if err != nil {
+		return err
+	}
+	removed, reclaimed, err := c.Prune(opts.olderThan, maxSize)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(dockerCli.Out(), "Removed %d images, reclaimed %s\n", removed, units.HumanSizeWithPrecision(float64(reclaimed), 5))
+	return nil
+}
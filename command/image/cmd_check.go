@@ -0,0 +1,207 @@
+package image
+
+import (
+	"context"
+	"docker-save/docker"
+	"docker-save/docker/image"
+	"docker-save/docker/policy"
+	"fmt"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+type checkOptions struct {
+	commonImageOptions
+	policy string
+}
+
+// NewCheckCommand creates a new `docker-save check` command
+func NewCheckCommand(dockerCli docker.Cli) *cobra.Command {
+	var opts checkOptions
+
+	cmd := &cobra.Command{
+		Use:   "check --policy FILE [IMAGE...]",
+		Short: "Check images against a policy of sizes, layer count, base images, labels and user",
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.images = args
+			return RunCheck(cmd.Context(), dockerCli, opts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVar(&opts.policy, "policy", "", "Policy YAML file of rules images must follow")
+	_ = cmd.MarkFlagRequired("policy")
+	flags.StringVarP(&opts.input, "input", "i", "", "Check images of a saved tar archive, instead of docker, all of them if no IMAGE given")
+	flags.StringVarP(&opts.workdir, "workdir", "w", ".", "Directory for store tar files, default to current dir")
+	flags.BoolVarP(&opts.keep, "keep", "k", false, "Keep workdir afterwards, default to auto clean")
+	flags.BoolVar(&opts.cache, "cache", false, "Reuse configs and layers exported before from the managed cache, export only images not cached")
+	flags.StringSliceVar(&opts.platforms, "platform", nil, "Check only the given platforms of multi-platform images, e.g. linux/amd64,linux/arm64")
+
+	return cmd
+}
+
+// RunCheck evaluates policy against each image, printing results of all rules,
+// and fails if any image violates a rule
+func RunCheck(ctx context.Context, dockerCli docker.Cli, opts checkOptions) error {
+	if opts.input == "" && len(opts.images) == 0 {
+		return errors.New("at least one IMAGE or --input must be given")
+	}
+	p, err := policy.Load(opts.policy)
+	if err != nil {
+		return err
+	}
+
+	tempDirPattern := func() string {
+		if opts.input != "" {
+			return filepath.Base(opts.input) + "-"
+		}
+		return ImagesConcatFmt(opts.images) + "-"
+	}
+	untarDir, err := ExportUntarImages(ctx, dockerCli, opts.commonImageOptions, tempDirPattern)
+	if shouldCleanUntarDir(opts.commonImageOptions) && untarDir != "" {
+		defer os.RemoveAll(untarDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	manifests, err := checkManifests(untarDir, opts.commonImageOptions)
+	if err != nil {
+		return err
+	}
+	sources, err := readRegistryLayerSources(untarDir)
+	if err != nil {
+		return err
+	}
+
+	bases := newBaseResolver(dockerCli, p.ForbiddenBases)
+	failed := 0
+	for _, m := range manifests {
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		img, err := loadImageConfig(untarDir, m)
+		if err != nil {
+			return err
+		}
+		sizes := []int64{}
+		for i, layerPath := range m.Layers {
+			size, err := uncompressedLayerSize(ctx, dockerCli, untarDir, layerPath, sources)
+			if os.IsNotExist(err) && opts.input != "" {
+				logrus.Warnf("layer %d of %s absent from archive, its size is not checked", i+1, manifestIdentity(m, img))
+				size, err = -1, nil
+			}
+			if err != nil {
+				return err
+			}
+			sizes = append(sizes, size)
+		}
+
+		results := p.Evaluate(policy.Subject{
+			Image:      img,
+			LayerSizes: sizes,
+			BaseLayers: bases.resolve(ctx, img),
+		})
+		if !policy.Passed(results) {
+			failed++
+		}
+		printCheckResults(dockerCli, manifestIdentity(m, img), results)
+	}
+
+	if failed > 0 {
+		return errors.Errorf("%d of %d images failed policy %s", failed, len(manifests), opts.policy)
+	}
+	fmt.Fprintf(dockerCli.Out(), "All %d images passed policy %s\n", len(manifests), opts.policy)
+	return nil
+}
+
+// checkManifests selects manifests of images to check, images of an archive
+// are selected by name if any given
+func checkManifests(untarDir string, opts commonImageOptions) ([]manifestItem, error) {
+	manifests, err := ResolveManifests(untarDir)
+	if err != nil {
+		return nil, err
+	}
+	platforms, err := image.ParsePlatforms(opts.platforms)
+	if err != nil {
+		return nil, err
+	}
+	if manifests, _, err = selectPlatformManifests(untarDir, manifests, platforms); err != nil {
+		return nil, err
+	}
+	if opts.input == "" || len(opts.images) == 0 {
+		return manifests, nil
+	}
+	selected := []manifestItem{}
+	for _, name := range opts.images {
+		found := false
+		for _, m := range manifests {
+			if manifestMatchesName(m, name) {
+				selected = append(selected, m)
+				found = true
+			}
+		}
+		if !found {
+			return nil, errors.Errorf("image %s not found in archive %s", name, opts.input)
+		}
+	}
+	return selected, nil
+}
+
+// baseResolver resolves layers of forbidden bases for the platform of each
+// image, bases given as globs or not found are matched by label only
+type baseResolver struct {
+	dockerCli docker.Cli
+	bases     []string
+	resolved  map[string]map[string][]digest.Digest
+}
+
+func newBaseResolver(dockerCli docker.Cli, bases []string) *baseResolver {
+	return &baseResolver{dockerCli: dockerCli, bases: bases, resolved: map[string]map[string][]digest.Digest{}}
+}
+
+func (r *baseResolver) resolve(ctx context.Context, img *image.Image) map[string][]digest.Digest {
+	platform := img.Platform()
+	key := image.FormatPlatform(platform)
+	if layers, ok := r.resolved[key]; ok {
+		return layers
+	}
+	layers := map[string][]digest.Digest{}
+	for _, base := range r.bases {
+		if strings.ContainsAny(base, "*?[") {
+			continue
+		}
+		inspectPlatform := &platform
+		if platform.OS == "" {
+			inspectPlatform = nil
+		}
+		inspects, err := ImageInspect(ctx, r.dockerCli, []string{base}, inspectPlatform)
+		if err != nil {
+			logrus.Warnf("forbidden base %s not inspected for %s, matched by label only: %v", base, key, err)
+			continue
+		}
+		for _, layer := range inspects[0].RootFS.Layers {
+			layers[base] = append(layers[base], digest.Digest(layer))
+		}
+	}
+	r.resolved[key] = layers
+	return layers
+}
+
+func printCheckResults(dockerCli docker.Cli, identity string, results []policy.Result) {
+	fmt.Fprintf(dockerCli.Out(), "Check of %s\n", identity)
+	for _, result := range results {
+		status := "PASS"
+		if !result.Passed {
+			status = "FAIL"
+		}
+		fmt.Fprintf(dockerCli.Out(), "  %s %-16s %s\n", status, result.Rule, result.Detail)
+	}
+	fmt.Fprintln(dockerCli.Out(), "")
+}
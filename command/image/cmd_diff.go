@@ -1,14 +1,19 @@
 package image
 
 import (
+	"context"
 	"docker-save/docker"
+	"docker-save/docker/image"
 	"fmt"
 	"github.com/docker/docker/api/types"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
 	"github.com/spf13/cobra"
 )
 
 type diffOptions struct {
-	images []string
+	images    []string
+	platforms []string
+	parallel  int
 }
 
 // NewDiffCommand compare two images and show diff between layers
@@ -21,14 +26,38 @@ func NewDiffCommand(dockerCli docker.Cli) *cobra.Command {
 		Args:  docker.ExactArgs(2),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			opts.images = args
-			return RunDiff(dockerCli, opts)
+			return RunDiff(cmd.Context(), dockerCli, opts)
 		},
 	}
+
+	flags := cmd.Flags()
+
+	flags.StringSliceVar(&opts.platforms, "platform", nil, "Diff the given platforms of multi-platform images one by one, e.g. linux/amd64,linux/arm64")
+	flags.IntVar(&opts.parallel, "parallel", 1, "Inspect up to n images concurrently")
+
 	return cmd
 }
 
-func RunDiff(dockerCli docker.Cli, opts diffOptions) error {
-	inspects, err := ImageInspect(dockerCli, opts.images)
+func RunDiff(ctx context.Context, dockerCli docker.Cli, opts diffOptions) error {
+	platforms, err := image.ParsePlatforms(opts.platforms)
+	if err != nil {
+		return err
+	}
+	if len(platforms) == 0 {
+		return runPlatformDiff(ctx, dockerCli, opts, nil)
+	}
+	for i := range platforms {
+		fmt.Fprintf(dockerCli.Out(), "Platform: %s\n\n", image.FormatPlatform(platforms[i]))
+		if err := runPlatformDiff(ctx, dockerCli, opts, &platforms[i]); err != nil {
+			return err
+		}
+		fmt.Fprintln(dockerCli.Out(), "")
+	}
+	return nil
+}
+
+func runPlatformDiff(ctx context.Context, dockerCli docker.Cli, opts diffOptions, platform *ocispec.Platform) error {
+	inspects, err := imageInspectParallel(ctx, dockerCli, opts.images, platform, opts.parallel)
 	if err != nil {
 		return err
 	}
@@ -0,0 +1,153 @@
+package image
+
+import (
+	"context"
+	"docker-save/docker"
+	"docker-save/docker/layer"
+	"docker-save/docker/progress"
+	"docker-save/docker/utils"
+	"fmt"
+	"github.com/docker/cli/cli/command"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+)
+
+type extractOptions struct {
+	commonImageOptions
+	output string
+	layer  int
+	all    bool
+	dest   string
+}
+
+// NewExtractCommand creates a new `docker-save extract` command
+func NewExtractCommand(dockerCli docker.Cli) *cobra.Command {
+	var opts extractOptions
+
+	cmd := &cobra.Command{
+		Use:   "extract IMAGE --layer N|--all [DEST]",
+		Short: "Extract a layer or the merged filesystem of an image into a directory or a tar archive",
+		Args:  docker.RequiresRangeArgs(1, 2),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.images = args[:1]
+			if len(args) > 1 {
+				opts.dest = args[1]
+			}
+			return RunExtract(cmd.Context(), dockerCli, opts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.output, "output", "o", "", "Write a tar archive to the file, instead of extracting into DEST")
+	flags.IntVar(&opts.layer, "layer", 0, "Extract the layer of the 1-based index as is, whiteouts included")
+	flags.BoolVar(&opts.all, "all", false, "Extract the merged filesystem of all layers with whiteouts applied")
+	flags.StringVarP(&opts.workdir, "workdir", "w", ".", "Directory for store tar files, default to current dir")
+	flags.BoolVarP(&opts.keep, "keep", "k", false, "Keep workdir afterwards, default to auto clean")
+	flags.BoolVar(&opts.cache, "cache", false, "Reuse configs and layers exported before from the managed cache, export only images not cached")
+	flags.StringSliceVar(&opts.platforms, "platform", nil, "Extract the given platform of a multi-platform image, e.g. linux/arm64")
+	cmd.MarkFlagsOneRequired("layer", "all")
+	cmd.MarkFlagsMutuallyExclusive("layer", "all")
+
+	return cmd
+}
+
+// RunExtract extracts a layer or the merged layers of an image
+func RunExtract(ctx context.Context, dockerCli docker.Cli, opts extractOptions) error {
+	if (opts.dest == "") == (opts.output == "") {
+		return errors.New("exactly one of DEST and -o must be given")
+	}
+	if err := command.ValidateOutputPath(opts.output); err != nil {
+		return errors.Wrap(err, "failed to extract image")
+	}
+	if !opts.all && opts.layer < 1 {
+		return errors.New("--layer must be at least 1")
+	}
+
+	tempDirPattern := func() string {
+		return ImagesConcatFmt(opts.images) + "-"
+	}
+	untarDir, err := ExportUntarImages(ctx, dockerCli, opts.commonImageOptions, tempDirPattern)
+	if shouldCleanUntarDir(opts.commonImageOptions) && untarDir != "" {
+		defer os.RemoveAll(untarDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	m, _, err := singleManifest(untarDir, opts.commonImageOptions)
+	if err != nil {
+		return err
+	}
+	layers := m.Layers
+	excluded := []string{}
+	if !opts.all {
+		if opts.layer > len(m.Layers) {
+			return errors.Errorf("--layer %d is beyond the %d layers of %s", opts.layer, len(m.Layers), opts.images[0])
+		}
+		layers = m.Layers[opts.layer-1 : opts.layer]
+		excluded = excludeUnshared(m.Layers, layers)
+	}
+	if err := downloadRegistryLayers(ctx, dockerCli, untarDir, excluded); err != nil {
+		return err
+	}
+	files, err := layerFiles(untarDir, layers)
+	if err != nil {
+		return err
+	}
+
+	content, err := extractedTar(ctx, files, opts.all)
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	if opts.output != "" {
+		_, _, err = outputSave(ctx, dockerCli, saveOptions{output: opts.output}, content, 0)
+		return err
+	}
+
+	if err := os.MkdirAll(opts.dest, 0755); err != nil {
+		return err
+	}
+	name := fmt.Sprintf("layer %d", opts.layer)
+	if opts.all {
+		name = "all layers"
+	}
+	tracker := progress.FromContext(ctx).Start("extract", name, 0)
+	defer tracker.Done()
+	return archive.Untar(tracker.Reader(content), opts.dest, &archive.TarOptions{NoLchown: true})
+}
+
+// extractedTar streams the uncompressed tar of the only layer file, or of layer
+// files merged
+func extractedTar(ctx context.Context, layerFiles []string, merge bool) (io.ReadCloser, error) {
+	if !merge {
+		reader, err := layer.Open(layerFiles[0])
+		if err != nil {
+			return nil, err
+		}
+		return utils.ContextReadCloser(ctx, reader), nil
+	}
+	// merging stops once the reader is closed
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(layer.Merge(layerFiles, writer))
+	}()
+	return utils.ContextReadCloser(ctx, reader), nil
+}
+
+// layerFiles resolves paths of layers in untar dir
+func layerFiles(untarDir string, layers []string) ([]string, error) {
+	files := []string{}
+	for _, layerPath := range layers {
+		file, err := safePath(untarDir, layerPath)
+		if err != nil {
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
@@ -0,0 +1,81 @@
+package image
+
+import (
+	"context"
+	"docker-save/docker"
+	"github.com/docker/cli/cli/command"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+type flattenOptions struct {
+	commonImageOptions
+	output string
+}
+
+// NewFlattenCommand creates a new `docker-save flatten` command
+func NewFlattenCommand(dockerCli docker.Cli) *cobra.Command {
+	var opts flattenOptions
+
+	cmd := &cobra.Command{
+		Use:   "flatten IMAGE",
+		Short: "Export the root filesystem of an image as a tar archive by replaying its layers, without running a container",
+		Args:  docker.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.images = args
+			return RunFlatten(cmd.Context(), dockerCli, opts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.output, "output", "o", "", "Write to a file, instead of STDOUT")
+	flags.StringVarP(&opts.workdir, "workdir", "w", ".", "Directory for store tar files, default to current dir")
+	flags.BoolVarP(&opts.keep, "keep", "k", false, "Keep workdir afterwards, default to auto clean")
+	flags.BoolVar(&opts.cache, "cache", false, "Reuse configs and layers exported before from the managed cache, export only images not cached")
+	flags.StringSliceVar(&opts.platforms, "platform", nil, "Flatten the given platform of a multi-platform image, e.g. linux/arm64")
+
+	return cmd
+}
+
+// RunFlatten writes the merged layers of an image as a root filesystem tar,
+// ownership, xattrs and hard links are kept as in layers
+func RunFlatten(ctx context.Context, dockerCli docker.Cli, opts flattenOptions) error {
+	if opts.output == "" && dockerCli.Out().IsTerminal() {
+		return errors.New("cowardly refusing to save to a terminal. Use the -o flag or redirect")
+	}
+	if err := command.ValidateOutputPath(opts.output); err != nil {
+		return errors.Wrap(err, "failed to flatten image")
+	}
+
+	tempDirPattern := func() string {
+		return ImagesConcatFmt(opts.images) + "-"
+	}
+	untarDir, err := ExportUntarImages(ctx, dockerCli, opts.commonImageOptions, tempDirPattern)
+	if shouldCleanUntarDir(opts.commonImageOptions) && untarDir != "" {
+		defer os.RemoveAll(untarDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	m, _, err := singleManifest(untarDir, opts.commonImageOptions)
+	if err != nil {
+		return err
+	}
+	if err := downloadRegistryLayers(ctx, dockerCli, untarDir, nil); err != nil {
+		return err
+	}
+	files, err := layerFiles(untarDir, m.Layers)
+	if err != nil {
+		return err
+	}
+	rootfs, err := extractedTar(ctx, files, true)
+	if err != nil {
+		return err
+	}
+	defer rootfs.Close()
+	_, _, err = outputSave(ctx, dockerCli, saveOptions{output: opts.output}, rootfs, 0)
+	return err
+}
@@ -0,0 +1,360 @@
+package image
+
+import (
+	"compress/gzip"
+	"context"
+	"docker-save/docker"
+	"docker-save/docker/image"
+	"docker-save/docker/layer"
+	"docker-save/docker/registry"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"strings"
+)
+
+type pushOptions struct {
+	commonImageOptions
+	to        string
+	mountFrom []string
+}
+
+// NewPushCommand creates a new `docker-save push` command
+func NewPushCommand(dockerCli docker.Cli) *cobra.Command {
+	var opts pushOptions
+
+	cmd := &cobra.Command{
+		Use:   "push IMAGE --to REGISTRY/REPOSITORY:TAG",
+		Short: "Push image to a registry, uploading only layers the registry lacks",
+		Args:  docker.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.images = args
+			return RunPush(cmd.Context(), dockerCli, opts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.to, "to", "t", "", "Target image reference in registry, e.g. localhost:5000/app:1.0")
+	flags.StringVarP(&opts.input, "input", "i", "", "Read layers from a saved tar archive, instead of docker")
+	flags.StringSliceVar(&opts.mountFrom, "mount-from", nil, "Repositories in target registry to cross mount missing layers from, as REPOSITORY[:TAG], layers filtered out of the archive are looked up in their manifests of TAG, default to the tag of --to")
+	flags.StringVarP(&opts.workdir, "workdir", "w", ".", "Directory for store tar files, default to current dir")
+	flags.BoolVarP(&opts.keep, "keep", "k", false, "Keep workdir afterwards, default to auto clean")
+	flags.StringVarP(&opts.cacheFrom, "cache-from", "c", "", "Use untar-images directory already exists other than export from docker")
+	_ = cmd.MarkFlagRequired("to")
+
+	return cmd
+}
+
+// RunPush pushes an image to registry, layers already in registry are not uploaded,
+// layers absent from a partial archive must be in the manifest of target or of a
+// repository to mount from
+func RunPush(ctx context.Context, dockerCli docker.Cli, opts pushOptions) error {
+	target, err := registry.ParseReference(opts.to)
+	if err != nil {
+		return err
+	}
+
+	tempDirPattern := func() string {
+		return ImagesConcatFmt(opts.images) + "-"
+	}
+	untarDir, err := ExportUntarImages(ctx, dockerCli, opts.commonImageOptions, tempDirPattern)
+	if shouldCleanUntarDir(opts.commonImageOptions) && untarDir != "" {
+		defer os.RemoveAll(untarDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	manifests, err := ResolveManifests(untarDir)
+	if err != nil {
+		return err
+	}
+	manifest, err := findManifest(manifests, opts.images[0])
+	if err != nil {
+		return err
+	}
+	img, err := loadImageConfig(untarDir, manifest)
+	if err != nil {
+		return err
+	}
+	config := img.RawJSON()
+	if len(img.RootFS.DiffIDs) != len(manifest.Layers) {
+		return errors.New("DiffIDs in image config not equal to layers exists.")
+	}
+	sources, err := readRegistryLayerSources(untarDir)
+	if err != nil {
+		return err
+	}
+
+	pusher := &blobPusher{
+		dockerCli: dockerCli,
+		client:    dockerCli.RegistryClient(target.Host),
+		repo:      target.Repository,
+		existing:  map[digest.Digest]existingLayer{},
+	}
+	platform := img.Platform()
+	if platform.OS == "" {
+		platform = registry.DefaultPlatform()
+	}
+	pusher.resolveExisting(ctx, target, target.Repository, target.Reference(), platform)
+	for _, from := range opts.mountFrom {
+		repo, reference := splitMountFrom(from, target)
+		pusher.mountFrom = append(pusher.mountFrom, repo)
+		pusher.resolveExisting(ctx, target, repo, reference, platform)
+	}
+
+	layers := []ocispec.Descriptor{}
+	for i, layerPath := range manifest.Layers {
+		desc, status, err := pusher.pushLayer(ctx, untarDir, layerPath, img.RootFS.DiffIDs[i], sources)
+		if err != nil {
+			return errors.Wrapf(err, "push layer %d", i+1)
+		}
+		fmt.Fprintf(dockerCli.Out(), "Layer %2d: %s %s\n", i+1, OmitString(desc.Digest.String(), 36), status)
+		layers = append(layers, desc)
+	}
+
+	configDesc := ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    digest.FromBytes(config),
+		Size:      int64(len(config)),
+	}
+	status, err := pusher.pushBlob(ctx, configDesc, registry.BytesOpener(config), nil)
+	if err != nil {
+		return errors.Wrap(err, "push config")
+	}
+	fmt.Fprintf(dockerCli.Out(), "Config:   %s %s\n", OmitString(configDesc.Digest.String(), 36), status)
+
+	content, err := json.Marshal(ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    configDesc,
+		Layers:    layers,
+	})
+	if err != nil {
+		return err
+	}
+	dgst, err := pusher.client.PutManifest(ctx, target.Repository, target.Reference(), ocispec.MediaTypeImageManifest, content)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintf(dockerCli.Out(), "%s: digest: %s size: %d\n", target, dgst, len(content))
+	return nil
+}
+
+// splitMountFrom splits a --mount-from value into repository and the manifest
+// reference to look up layers in, the tag or digest of target by default
+func splitMountFrom(from string, target registry.Reference) (string, string) {
+	if i := strings.LastIndex(from, ":"); i > strings.LastIndex(from, "/") {
+		return from[:i], from[i+1:]
+	}
+	return from, target.Reference()
+}
+
+// blobPusher pushes blobs to a repository, skipping blobs the registry already has
+type blobPusher struct {
+	dockerCli docker.Cli
+	client    *registry.Client
+	repo      string
+	mountFrom []string
+	// existing are layers of manifests in target registry by diff ID, for
+	// reusing their compressed blobs
+	existing map[digest.Digest]existingLayer
+}
+
+// existingLayer is a layer blob of repository in target registry
+type existingLayer struct {
+	desc ocispec.Descriptor
+	repo string
+}
+
+// resolveExisting records layers of the manifest of repo at reference, a
+// manifest which can not be resolved, e.g. of a new tag, is skipped
+func (p *blobPusher) resolveExisting(ctx context.Context, target registry.Reference, repo string, reference string, platform ocispec.Platform) {
+	separator := ":"
+	if _, err := digest.Parse(reference); err == nil {
+		separator = "@"
+	}
+	ref, err := registry.ParseReference(target.Host + "/" + repo + separator + reference)
+	if err != nil {
+		return
+	}
+	resolved, err := p.client.ResolveImage(ctx, ref, platform)
+	if err != nil {
+		return
+	}
+	img, err := image.NewFromJSON(resolved.Config)
+	if err != nil || len(img.RootFS.DiffIDs) != len(resolved.Manifest.Layers) {
+		return
+	}
+	for i, diffID := range img.RootFS.DiffIDs {
+		if _, ok := p.existing[diffID]; !ok {
+			desc := resolved.Manifest.Layers[i]
+			desc.MediaType = ociLayerMediaType(desc.MediaType)
+			p.existing[diffID] = existingLayer{desc: desc, repo: repo}
+		}
+	}
+}
+
+// pushLayer pushes layer of untar dir, reusing the blob of a manifest in target
+// registry with the same diff ID if any, a layer not in untar dir is downloaded
+// from its source registry, or must be in a manifest resolved if it has been
+// filtered out of a partial archive, uncompressed layers are gzipped for upload
+func (p *blobPusher) pushLayer(ctx context.Context, untarDir string, layerPath string, diffID digest.Digest, sources map[string]registryLayerSource) (ocispec.Descriptor, string, error) {
+	target, err := safePath(untarDir, layerPath)
+	if err != nil {
+		return ocispec.Descriptor{}, "", err
+	}
+	_, statErr := os.Stat(target)
+	source, hasSource := sources[layerPath]
+
+	if existing, ok := p.existing[diffID]; ok {
+		mountFrom := p.mountFrom
+		if existing.repo != p.repo {
+			mountFrom = append([]string{existing.repo}, mountFrom...)
+		}
+		status, err := p.pushBlob(ctx, existing.desc, nil, mountFrom)
+		// blobs of a manifest may be gone, e.g. garbage collected
+		if err == nil || (statErr != nil && !hasSource) {
+			return existing.desc, status, err
+		}
+	}
+
+	if statErr == nil {
+		compressed, err := gzipLayerFile(untarDir, target)
+		if err != nil {
+			return ocispec.Descriptor{}, "", err
+		}
+		if compressed != target {
+			defer os.Remove(compressed)
+		}
+		desc, err := describeLayerFile(compressed)
+		if err != nil {
+			return desc, "", err
+		}
+		status, err := p.pushBlob(ctx, desc, fileOpener(compressed), p.mountFrom)
+		return desc, status, err
+	}
+
+	if hasSource {
+		desc := source.Descriptor
+		desc.MediaType = ociLayerMediaType(desc.MediaType)
+		mountFrom := p.mountFrom
+		if ref, err := registry.ParseReference(source.Image); err == nil && ref.Host == p.client.Host() {
+			mountFrom = append([]string{ref.Repository}, mountFrom...)
+		}
+		status, err := p.pushBlob(ctx, desc, func() (io.ReadCloser, error) {
+			if err := downloadRegistryLayer(ctx, p.dockerCli, source, target); err != nil {
+				return nil, err
+			}
+			return os.Open(target)
+		}, mountFrom)
+		return desc, status, err
+	}
+	return ocispec.Descriptor{}, "", errors.Errorf("layer %s is neither in archive nor in a manifest of target registry, push the previous version or give --mount-from", diffID)
+}
+
+// pushBlob makes sure repository has blob desc, returns how it was done
+func (p *blobPusher) pushBlob(ctx context.Context, desc ocispec.Descriptor, open registry.BlobOpener, mountFrom []string) (string, error) {
+	if _, exists, err := p.client.HeadBlob(ctx, p.repo, desc.Digest); err != nil || exists {
+		return "exists", err
+	}
+	for _, from := range mountFrom {
+		mounted, err := p.client.MountBlob(ctx, p.repo, from, desc.Digest)
+		if err != nil {
+			return "", err
+		}
+		if mounted {
+			return "mounted from " + from, nil
+		}
+	}
+	if open == nil {
+		return "", errors.Errorf("blob %s is neither in archive nor in registry", desc.Digest)
+	}
+	if err := p.client.UploadBlob(ctx, p.repo, desc, open); err != nil {
+		return "", err
+	}
+	return "pushed", nil
+}
+
+// gzipLayerFile compresses an uncompressed layer file into a temporary file of
+// dir for upload, returns path of layer file as is if already compressed
+func gzipLayerFile(dir string, path string) (string, error) {
+	compression, err := layer.Compression(path)
+	if err != nil || compression != archive.Uncompressed {
+		return path, err
+	}
+	src, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer src.Close()
+	dst, err := os.CreateTemp(dir, ".push-*.tar.gz")
+	if err != nil {
+		return "", err
+	}
+	zw := gzip.NewWriter(dst)
+	_, err = io.Copy(zw, src)
+	if closeErr := zw.Close(); err == nil {
+		err = closeErr
+	}
+	if closeErr := dst.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst.Name())
+		return "", err
+	}
+	return dst.Name(), nil
+}
+
+func fileOpener(path string) registry.BlobOpener {
+	return func() (io.ReadCloser, error) {
+		return os.Open(path)
+	}
+}
+
+// describeLayerFile digests layer file and detects its media type by compression
+func describeLayerFile(path string) (ocispec.Descriptor, error) {
+	desc := ocispec.Descriptor{}
+	compression, err := layer.Compression(path)
+	if err != nil {
+		return desc, err
+	}
+	switch compression {
+	case archive.Uncompressed:
+		desc.MediaType = ocispec.MediaTypeImageLayer
+	case archive.Gzip:
+		desc.MediaType = ocispec.MediaTypeImageLayerGzip
+	case archive.Zstd:
+		desc.MediaType = ocispec.MediaTypeImageLayerZstd
+	default:
+		return desc, errors.Errorf("unsupported compression of layer %s", path)
+	}
+
+	file, err := os.Open(path)
+	if err != nil {
+		return desc, err
+	}
+	defer file.Close()
+	digester := digest.Canonical.Digester()
+	if desc.Size, err = io.Copy(digester.Hash(), file); err != nil {
+		return desc, err
+	}
+	desc.Digest = digester.Digest()
+	return desc, nil
+}
+
+func ociLayerMediaType(mediaType string) string {
+	if mediaType == registry.MediaTypeDockerLayer {
+		return ocispec.MediaTypeImageLayerGzip
+	}
+	return mediaType
+}
@@ -0,0 +1,179 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"docker-save/docker"
+	"docker-save/docker/registry/registrytest"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeArchive writes a docker save archive of an image of layers, layers
+// not present are left out as of a partial archive
+func writeArchive(t *testing.T, dir string, repoTag string, layers [][]byte, present []bool) string {
+	t.Helper()
+	entries := map[string][]byte{}
+	item := manifestItem{RepoTags: []string{repoTag}}
+	diffIDs := []digest.Digest{}
+	history := []ocispec.History{}
+	for i, layer := range layers {
+		diffID := digest.FromBytes(layer)
+		diffIDs = append(diffIDs, diffID)
+		history = append(history, ocispec.History{CreatedBy: fmt.Sprintf("layer %d", i+1)})
+		layerPath := diffID.Encoded() + "/layer.tar"
+		item.Layers = append(item.Layers, layerPath)
+		if present[i] {
+			entries[layerPath] = layer
+		}
+	}
+	content, err := json.Marshal(ocispec.Image{
+		Platform: testPlatform,
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: diffIDs},
+		History:  history,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	item.Config = digest.FromBytes(content).Encoded() + ".json"
+	entries[item.Config] = content
+	if entries[manifestFileName], err = json.Marshal([]manifestItem{item}); err != nil {
+		t.Fatal(err)
+	}
+
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range entries {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write(content); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, "archive.tar")
+	if err := os.WriteFile(file, buf.Bytes(), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestPush(t *testing.T) {
+	base := layerTar(t, map[string]string{"etc/os-release": "ID=test"})
+	app := layerTar(t, map[string]string{"app/main": "v1.1"})
+	layers := [][]byte{base, app}
+
+	tests := []struct {
+		name string
+		// setup fills the registry as by earlier docker pushes
+		setup     func(r *registrytest.Registry)
+		present   []bool
+		mountFrom string
+		uploads   int
+		mounts    int
+		wantErr   bool
+	}{
+		{
+			name:    "empty registry",
+			setup:   func(r *registrytest.Registry) {},
+			present: []bool{true, true},
+			uploads: 3,
+		},
+		{
+			name: "layers in manifest of target tag",
+			setup: func(r *registrytest.Registry) {
+				r.AddImage("app", "1.1", testPlatform, base, layerTar(t, map[string]string{"app/main": "v1.0"}))
+			},
+			present: []bool{false, true},
+			uploads: 2,
+		},
+		{
+			name: "layers mountable from another repository",
+			setup: func(r *registrytest.Registry) {
+				r.AddImage("base", "1.0", testPlatform, base)
+			},
+			present:   []bool{false, true},
+			mountFrom: "base:1.0",
+			uploads:   2,
+			mounts:    1,
+		},
+		{
+			name: "uploaded layers found by diff ID",
+			setup: func(r *registrytest.Registry) {
+				r.AddImage("app", "1.1", testPlatform, base)
+			},
+			present: []bool{true, true},
+			uploads: 2,
+		},
+		{
+			name:    "layers missing",
+			setup:   func(r *registrytest.Registry) {},
+			present: []bool{false, true},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := registrytest.New()
+			defer r.Close()
+			tt.setup(r)
+			uploads := r.Uploads()
+			dir := t.TempDir()
+			input := writeArchive(t, dir, "app:1.1", layers, tt.present)
+
+			args := []string{"app:1.1", "-i", input, "-w", dir, "--to", r.Host() + "/app:1.1"}
+			if tt.mountFrom != "" {
+				args = append(args, "--mount-from", tt.mountFrom)
+			}
+			err := runCommand(NewPushCommand(docker.NewDockerCli()), args...)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("pushed an image with layers neither in archive nor in registry")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := r.Uploads() - uploads; got != tt.uploads {
+				t.Errorf("%d blobs uploaded, want %d", got, tt.uploads)
+			}
+			if r.Mounts() != tt.mounts {
+				t.Errorf("%d blobs mounted, want %d", r.Mounts(), tt.mounts)
+			}
+
+			content, ok := r.Manifest("app", "1.1")
+			if !ok {
+				t.Fatal("manifest not pushed")
+			}
+			manifest := ocispec.Manifest{}
+			if err := json.Unmarshal(content, &manifest); err != nil {
+				t.Fatal(err)
+			}
+			if len(manifest.Layers) != len(layers) {
+				t.Fatalf("%d layers in manifest, want %d", len(manifest.Layers), len(layers))
+			}
+			for i, layer := range manifest.Layers {
+				blob, ok := r.Blob(layer.Digest)
+				if !ok || !r.HasBlob("app", layer.Digest) {
+					t.Fatalf("layer %d blob %s missing from repository", i+1, layer.Digest)
+				}
+				if layer.MediaType != ocispec.MediaTypeImageLayerGzip || archive.DetectCompression(blob) != archive.Gzip {
+					t.Errorf("layer %d of %s is not gzipped", i+1, layer.MediaType)
+				}
+				if int64(len(blob)) != layer.Size {
+					t.Errorf("layer %d size %d, want %d", i+1, layer.Size, len(blob))
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package image
+
+import (
+	"context"
+	"docker-save/docker"
+	"docker-save/docker/image"
+	"docker-save/docker/progress"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/cli/cli/command"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slices"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+type rebaseOptions struct {
+	commonImageOptions
+	output  string
+	oldBase string
+	newBase string
+	tag     string
+	load    bool
+}
+
+// NewRebaseCommand creates a new `docker-save rebase` command
+func NewRebaseCommand(dockerCli docker.Cli) *cobra.Command {
+	var opts rebaseOptions
+
+	cmd := &cobra.Command{
+		Use:   "rebase IMAGE --old-base OLD --new-base NEW",
+		Short: "Rebase the layers of an image above an old base image onto a new one, without rebuilding",
+		Args:  docker.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.images = args
+			return RunRebase(cmd.Context(), dockerCli, opts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.output, "output", "o", "", "Write to a file, instead of STDOUT")
+	flags.StringVar(&opts.oldBase, "old-base", "", "Base image the image is currently built on")
+	flags.StringVar(&opts.newBase, "new-base", "", "Base image to rebase the image onto")
+	flags.StringVarP(&opts.tag, "tag", "t", "", "Tag the rebased image, instead of the tags of image")
+	flags.BoolVar(&opts.load, "load", false, "Load the rebased image into docker, instead of writing an archive")
+	flags.StringVarP(&opts.workdir, "workdir", "w", ".", "Directory for store tar files, default to current dir")
+	flags.BoolVarP(&opts.keep, "keep", "k", false, "Keep workdir afterwards, default to auto clean")
+	flags.BoolVar(&opts.cache, "cache", false, "Reuse configs and layers exported before from the managed cache, export only images not cached")
+	flags.StringSliceVar(&opts.platforms, "platform", nil, "Rebase the given platform of multi-platform images, e.g. linux/arm64")
+	_ = cmd.MarkFlagRequired("old-base")
+	_ = cmd.MarkFlagRequired("new-base")
+	cmd.MarkFlagsMutuallyExclusive("output", "load")
+
+	return cmd
+}
+
+// RunRebase saves or loads an image with its layers above old base put onto new base
+func RunRebase(ctx context.Context, dockerCli docker.Cli, opts rebaseOptions) error {
+	if !opts.load {
+		if opts.output == "" && dockerCli.Out().IsTerminal() {
+			return errors.New("cowardly refusing to save to a terminal. Use the -o flag or redirect")
+		}
+		if err := command.ValidateOutputPath(opts.output); err != nil {
+			return errors.Wrap(err, "failed to save image")
+		}
+	}
+	repoTags, err := parseTagFlag(opts.tag)
+	if err != nil {
+		return err
+	}
+	platforms, err := image.ParsePlatforms(opts.platforms)
+	if err != nil {
+		return err
+	}
+	if len(platforms) > 1 {
+		return errors.New("rebase supports a single --platform")
+	}
+	var platform *ocispec.Platform
+	if len(platforms) == 1 {
+		platform = &platforms[0]
+	}
+
+	// fail fast before exporting anything
+	name := opts.images[0]
+	inspects, err := ImageInspect(ctx, dockerCli, []string{name, opts.oldBase, opts.newBase}, platform)
+	if err != nil {
+		return err
+	}
+	if !hasLayerPrefix(inspects[0].RootFS.Layers, inspects[1].RootFS.Layers) {
+		return errors.Errorf("image %s is not based on %s", name, opts.oldBase)
+	}
+	imgPlatform := ocispec.Platform{OS: inspects[0].Os, Architecture: inspects[0].Architecture, Variant: inspects[0].Variant}
+	basePlatform := ocispec.Platform{OS: inspects[2].Os, Architecture: inspects[2].Architecture, Variant: inspects[2].Variant}
+	if image.FormatPlatform(imgPlatform) != image.FormatPlatform(basePlatform) {
+		return errors.Errorf("new base %s is %s, image %s is %s", opts.newBase,
+			image.FormatPlatform(basePlatform), name, image.FormatPlatform(imgPlatform))
+	}
+
+	// configs of old base tell which history entries belong to it, its layers are
+	// shared with image and cost nothing to export
+	exportOpts := opts.commonImageOptions
+	exportOpts.images = []string{name, opts.oldBase, opts.newBase}
+	tempDirPattern := func() string {
+		return ImagesConcatFmt(opts.images) + "-"
+	}
+	untarDir, err := ExportUntarImages(ctx, dockerCli, exportOpts, tempDirPattern)
+	if shouldCleanUntarDir(opts.commonImageOptions) && untarDir != "" {
+		defer os.RemoveAll(untarDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	manifests, err := ResolveManifests(untarDir)
+	if err != nil {
+		return err
+	}
+	if manifests, _, err = selectPlatformManifests(untarDir, manifests, platforms); err != nil {
+		return err
+	}
+	images := []*image.Image{}
+	found := []manifestItem{}
+	for _, ref := range exportOpts.images {
+		i := slices.IndexFunc(manifests, func(m manifestItem) bool {
+			return manifestMatchesName(m, ref)
+		})
+		if i < 0 {
+			return errors.Errorf("image %s not found in exported archive", ref)
+		}
+		img, err := loadImageConfig(untarDir, manifests[i])
+		if err != nil {
+			return err
+		}
+		found = append(found, manifests[i])
+		images = append(images, img)
+	}
+	m, img, oldImg, newImg := found[0], images[0], images[1], images[2]
+	oldDiffIDs := oldImg.RootFS.DiffIDs
+	if len(img.RootFS.DiffIDs) < len(oldDiffIDs) || !slices.Equal(img.RootFS.DiffIDs[:len(oldDiffIDs)], oldDiffIDs) ||
+		!hasHistoryPrefix(img.History, oldImg.History) {
+		return errors.Errorf("image %s is not based on %s", name, opts.oldBase)
+	}
+	if len(repoTags) == 0 {
+		repoTags = m.RepoTags
+	}
+
+	layers := append(append([]string{}, found[2].Layers...), m.Layers[len(oldDiffIDs):]...)
+	unused := []string{}
+	for _, other := range found {
+		for _, layerPath := range other.Layers {
+			if !slices.Contains(layers, layerPath) {
+				unused = append(unused, layerPath)
+			}
+		}
+	}
+	if err := downloadRegistryLayers(ctx, dockerCli, untarDir, unused); err != nil {
+		return err
+	}
+
+	rebaseDir, err := os.MkdirTemp(untarDir, ".rebase-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(rebaseDir)
+	config, err := rebaseConfig(img, oldImg, newImg)
+	if err != nil {
+		return err
+	}
+	configFile := digest.FromBytes(config).Encoded() + ".json"
+	if err := os.WriteFile(filepath.Join(rebaseDir, configFile), config, 0644); err != nil {
+		return err
+	}
+	linked := map[string]bool{}
+	for _, layerPath := range layers {
+		if linked[layerPath] {
+			continue
+		}
+		linked[layerPath] = true
+		source, err := safePath(untarDir, layerPath)
+		if err != nil {
+			return err
+		}
+		if err := linkOrCopy(source, filepath.Join(rebaseDir, filepath.FromSlash(layerPath))); err != nil {
+			return err
+		}
+	}
+
+	rebased := manifestItem{Config: configFile, RepoTags: repoTags, Layers: layers}
+	tar, size, err := tarImages(ctx, rebaseDir, []manifestItem{rebased}, nil, nil)
+	if err != nil {
+		return err
+	}
+	if opts.load {
+		return loadImages(ctx, dockerCli, tar, size)
+	}
+	_, _, err = outputSave(ctx, dockerCli, saveOptions{output: opts.output}, tar, size)
+	return err
+}
+
+// hasLayerPrefix tells whether layers start with all base layers
+func hasLayerPrefix(layers []string, base []string) bool {
+	return len(base) <= len(layers) && slices.Equal(layers[:len(base)], base)
+}
+
+// hasHistoryPrefix tells whether history starts with all base history entries,
+// compared by command and whether they created a layer
+func hasHistoryPrefix(history []image.History, base []image.History) bool {
+	return len(base) <= len(history) && slices.EqualFunc(history[:len(base)], base, func(h image.History, b image.History) bool {
+		return h.CreatedBy == b.CreatedBy && h.EmptyLayer == b.EmptyLayer
+	})
+}
+
+// rebaseConfig rewrites diff IDs and history of image config, replacing those of
+// old base with those of new base, other fields are kept as is
+func rebaseConfig(img *image.Image, oldImg *image.Image, newImg *image.Image) ([]byte, error) {
+	config := map[string]json.RawMessage{}
+	if err := json.Unmarshal(img.RawJSON(), &config); err != nil {
+		return nil, err
+	}
+
+	rootFS := *img.RootFS
+	rootFS.DiffIDs = append(append([]digest.Digest{}, newImg.RootFS.DiffIDs...), img.RootFS.DiffIDs[len(oldImg.RootFS.DiffIDs):]...)
+	content, err := json.Marshal(rootFS)
+	if err != nil {
+		return nil, err
+	}
+	config["rootfs"] = content
+
+	history := append(append([]image.History{}, newImg.History...), img.History[len(oldImg.History):]...)
+	if content, err = json.Marshal(history); err != nil {
+		return nil, err
+	}
+	config["history"] = content
+	return json.Marshal(config)
+}
+
+// loadImages loads archive of images into docker, printing its messages
+func loadImages(ctx context.Context, dockerCli docker.Cli, archive io.ReadCloser, size int64) error {
+	defer archive.Close()
+	tracker := progress.FromContext(ctx).Start("load", "docker", size)
+	defer tracker.Done()
+	response, err := dockerCli.Client().ImageLoad(ctx, tracker.Reader(archive))
+	if err != nil {
+		return err
+	}
+	defer response.Body.Close()
+	if !response.JSON {
+		_, err = io.Copy(dockerCli.Out(), response.Body)
+		return err
+	}
+	decoder := json.NewDecoder(response.Body)
+	for {
+		var message loadMessage
+		if err := decoder.Decode(&message); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		if message.Error != nil {
+			return errors.New(message.Error.Message)
+		}
+		fmt.Fprint(dockerCli.Out(), message.Stream)
+	}
+}
+
+// loadMessage is the part of docker load messages worth printing, progress
+// of docker is left out in favor of our own
+type loadMessage struct {
+	Stream string `json:"stream"`
+	Error  *struct {
+		Message string `json:"message"`
+	} `json:"errorDetail"`
+}
@@ -0,0 +1,31 @@
+package image
+
+import (
+	"docker-save/docker/image"
+	"testing"
+)
+
+func TestHasHistoryPrefix(t *testing.T) {
+	base := []image.History{
+		{CreatedBy: "ADD rootfs.tar /"},
+		{CreatedBy: `CMD ["sh"]`, EmptyLayer: true},
+	}
+	tests := []struct {
+		name    string
+		history []image.History
+		want    bool
+	}{
+		{"based", append(append([]image.History{}, base...), image.History{CreatedBy: "COPY app /app"}), true},
+		{"base itself", base, true},
+		{"shorter", base[:1], false},
+		{"other command", []image.History{{CreatedBy: "ADD other.tar /"}, base[1], {CreatedBy: "COPY app /app"}}, false},
+		{"empty layer differs", []image.History{base[0], {CreatedBy: `CMD ["sh"]`}, {CreatedBy: "COPY app /app"}}, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := hasHistoryPrefix(tt.history, base); got != tt.want {
+				t.Errorf("hasHistoryPrefix %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
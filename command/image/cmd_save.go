@@ -4,22 +4,60 @@ Copyright © 2023 William Wang <williamw0825@gmail.com>
 package image
 
 import (
+	"context"
 	"docker-save/docker"
+	"docker-save/docker/image"
+	"docker-save/docker/progress"
+	"docker-save/docker/registry"
+	"docker-save/docker/utils"
 	"github.com/docker/cli/cli/command"
-	"github.com/docker/docker/pkg/archive"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/go-digest"
 	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"golang.org/x/exp/slices"
 	"io"
 	"os"
+	"path/filepath"
+	"regexp"
 	"strconv"
 	"strings"
 )
 
 type saveOptions struct {
 	commonImageOptions
-	output string
-	last   string
+	output       string
+	last         string
+	legacyCompat bool
+	verify       bool
+	atomic       bool
+	checksum     bool
+	jsonManifest bool
+	splitSize    string
+	volumeSize   int64
+	outputDir    string
+	nameTemplate string
+	bundle       bool
+
+	includeCreatedBy string
+	excludeCreatedBy string
+	createdBy        createdByFilter
+
+	first          []string
+	layers         []string
+	excludeDiffIDs []string
+	minLayerSize   string
+	maxLayerSize   string
+	selection      layerSelection
+	perImage       bool
+}
+
+// createdByFilter keeps layers whose history command matches include, if any,
+// and does not match exclude, if any
+type createdByFilter struct {
+	include *regexp.Regexp
+	exclude *regexp.Regexp
 }
 
 // NewSaveCommand creates a new `docker save` command
@@ -29,27 +67,62 @@ func NewSaveCommand(dockerCli docker.Cli) *cobra.Command {
 	cmd := &cobra.Command{
 		Use: "docker-save IMAGE [IMAGE...]",
 		Long: `A tool for saving docker images to a tar archive (streamed to STDOUT by default)
-add support for filtering image layers`,
+add support for filtering image layers, images prefixed with registry:// are read
+from the registry directly, only layers surviving filtering are downloaded`,
 		Args: docker.RequiresMinArgs(1),
 		RunE: func(cmd *cobra.Command, args []string) error {
 			opts.images = args
-			return RunSave(dockerCli, opts)
+			return RunSave(cmd.Context(), dockerCli, opts)
 		},
 	}
 
 	flags := cmd.Flags()
 
 	flags.StringVarP(&opts.output, "output", "o", "", "Write to a file, instead of STDOUT")
+	flags.StringVar(&opts.outputDir, "output-dir", "", "Write a separate archive for each image into the directory, instead of one archive")
+	flags.StringVar(&opts.nameTemplate, "name-template", defaultNameTemplate, "Template of archive names in --output-dir, with fields .Name (e.g. app_1.0), .Repo, .Tag and .Index")
 	flags.StringVarP(&opts.workdir, "workdir", "w", ".", "Directory for store tar files, default to current dir")
-	flags.StringVarP(&opts.last, "last", "l", "", "Export the last n image layers, one number for all images, or comma separated numbers for each image")
+	flags.StringVarP(&opts.last, "last", "l", "", "Export the last n image layers, one number for all images, comma separated numbers for each image, or IMAGE=N,IMAGE=N")
+	flags.StringArrayVar(&opts.first, "first", nil, "Export the first n image layers, N for all images or IMAGE=N, repeatable")
+	flags.StringArrayVar(&opts.layers, "layers", nil, "Export layers by 1-based index and range, e.g. 1-3,7,9- for all images or IMAGE=1-3,7, repeatable")
+	flags.StringVar(&opts.minLayerSize, "min-layer-size", "", "Export only layers of at least the size, e.g. 100MB")
+	flags.StringVar(&opts.maxLayerSize, "max-layer-size", "", "Export only layers of at most the size, e.g. 1MB")
+	flags.StringSliceVar(&opts.excludeDiffIDs, "exclude-diffid", nil, "Do not export layers of the diff IDs or their prefixes, e.g. sha256:4a8b")
 	flags.BoolVarP(&opts.keep, "keep", "k", false, "Keep workdir afterwards, default to auto clean")
 	flags.StringVarP(&opts.cacheFrom, "cache-from", "c", "", "Use untar-images directory already exists other than export from docker")
+	flags.BoolVar(&opts.cache, "cache", false, "Reuse configs and layers exported before from the managed cache, export only images not cached")
+	flags.IntVar(&opts.parallel, "parallel", 1, "Export and inspect up to n images from docker concurrently, merging shared layers")
+	flags.StringSliceVar(&opts.platforms, "platform", nil, "Save only the given platforms of multi-platform images, e.g. linux/amd64,linux/arm64")
+	flags.BoolVar(&opts.verify, "verify", false, "Verify layers and configs of the written archive, requires -o")
+	flags.BoolVar(&opts.atomic, "atomic", false, "Write to a hidden temp file next to the output, sync and rename it when complete, requires -o")
+	flags.BoolVar(&opts.checksum, "checksum", false, "Write a sha256sum compatible OUTPUT.sha256 after the output is complete, requires -o")
+	flags.BoolVar(&opts.jsonManifest, "json-manifest", false, "Write OUTPUT.manifest.json describing the images and layers saved, requires -o")
+	flags.StringVar(&opts.splitSize, "split-size", "", "Split the output into volumes OUTPUT.000, OUTPUT.001... of at most the size with an OUTPUT.index, e.g. 4G, requires -o")
+	flags.StringVar(&opts.includeCreatedBy, "include-created-by", "", "Export only layers whose history command matches the regex, e.g. '^COPY '")
+	flags.StringVar(&opts.excludeCreatedBy, "exclude-created-by", "", "Do not export layers whose history command matches the regex")
+	flags.BoolVar(&opts.legacyCompat, "legacy-compat", false, "Regenerate legacy per-layer json, VERSION and repositories files, for older docker load")
 
 	return cmd
 }
 
 // RunSave performs a save against the engine based on the specified options
-func RunSave(dockerCli docker.Cli, opts saveOptions) error {
+func RunSave(ctx context.Context, dockerCli docker.Cli, opts saveOptions) error {
+	if opts.outputDir != "" {
+		perImage, err := perImageSaveOptions(opts)
+		if err != nil {
+			return err
+		}
+		if err := os.MkdirAll(opts.outputDir, 0755); err != nil {
+			return err
+		}
+		for _, imageOpts := range perImage {
+			if err := RunSave(ctx, dockerCli, imageOpts); err != nil {
+				return errors.Wrapf(err, "failed to save %s", imageOpts.images[0])
+			}
+		}
+		return nil
+	}
+
 	if opts.output == "" && dockerCli.Out().IsTerminal() {
 		return errors.New("cowardly refusing to save to a terminal. Use the -o flag or redirect")
 	}
@@ -57,34 +130,88 @@ func RunSave(dockerCli docker.Cli, opts saveOptions) error {
 	if err := command.ValidateOutputPath(opts.output); err != nil {
 		return errors.Wrap(err, "failed to save image")
 	}
+	if opts.output == "" && (opts.verify || opts.atomic || opts.checksum || opts.jsonManifest || opts.splitSize != "") {
+		return errors.New("--verify, --atomic, --checksum, --json-manifest and --split-size require the -o flag")
+	}
+	if opts.includeCreatedBy != "" {
+		include, err := regexp.Compile(opts.includeCreatedBy)
+		if err != nil {
+			return errors.Wrap(err, "invalid --include-created-by")
+		}
+		opts.createdBy.include = include
+	}
+	if opts.excludeCreatedBy != "" {
+		exclude, err := regexp.Compile(opts.excludeCreatedBy)
+		if err != nil {
+			return errors.Wrap(err, "invalid --exclude-created-by")
+		}
+		opts.createdBy.exclude = exclude
+	}
+	selection, err := newLayerSelection(opts)
+	if err != nil {
+		return err
+	}
+	opts.selection = selection
+	if opts.splitSize != "" {
+		size, err := units.FromHumanSize(opts.splitSize)
+		if err != nil || size <= 0 {
+			return errors.Errorf("invalid --split-size %q", opts.splitSize)
+		}
+		opts.volumeSize = size
+	}
 
-	if needToFilterImageLayers(opts) {
-		return exportImagesWithFilter(dockerCli, opts)
+	if err := saveImages(ctx, dockerCli, opts); err != nil {
+		return err
+	}
+	if opts.verify {
+		verifyOpts := verifyOptions{commonImageOptions{input: opts.output, workdir: opts.workdir}}
+		return RunVerify(ctx, dockerCli, verifyOpts)
+	}
+	return nil
+}
+
+func saveImages(ctx context.Context, dockerCli docker.Cli, opts saveOptions) error {
+	if needToFilterImageLayers(opts) || hasRegistryImages(opts.images) {
+		return exportImagesWithFilter(ctx, dockerCli, opts)
 	} else {
-		imagesTar, err := ExportImages(dockerCli, opts.images)
+		platforms, err := image.ParsePlatforms(opts.platforms)
+		if err != nil {
+			return err
+		}
+		imagesTar, err := ExportImages(ctx, dockerCli, opts.images, platforms, opts.parallel)
 		if err != nil {
 			return err
 		}
-		return outputSave(dockerCli, opts.output, imagesTar)
+		_, _, err = outputSave(ctx, dockerCli, opts, imagesTar, 0)
+		return err
 	}
 }
 
 func needToFilterImageLayers(opts saveOptions) bool {
-	if opts.last != "" {
+	if opts.last != "" || len(opts.first) > 0 || len(opts.layers) > 0 || len(opts.excludeDiffIDs) > 0 {
+		return true
+	}
+	if opts.minLayerSize != "" || opts.maxLayerSize != "" {
+		return true
+	}
+	if opts.createdBy.include != nil || opts.createdBy.exclude != nil {
+		return true
+	}
+	if opts.legacyCompat || opts.jsonManifest || opts.bundle {
 		return true
 	}
 	return false
 }
 
-func exportImagesWithFilter(dockerCli docker.Cli, opts saveOptions) error {
+func exportImagesWithFilter(ctx context.Context, dockerCli docker.Cli, opts saveOptions) error {
 	tempDirPattern := func() string {
 		if opts.output != "" {
-			return opts.output + "-"
+			return filepath.Base(opts.output) + "-"
 		}
 		return ImagesConcatFmt(opts.images) + "-"
 	}
 
-	untarDir, err := ExportUntarImages(dockerCli, opts.commonImageOptions, tempDirPattern)
+	untarDir, err := ExportUntarImages(ctx, dockerCli, opts.commonImageOptions, tempDirPattern)
 	if shouldCleanUntarDir(opts.commonImageOptions) && untarDir != "" {
 		// must not be run before func outputSave
 		defer os.RemoveAll(untarDir)
@@ -97,51 +224,247 @@ func exportImagesWithFilter(dockerCli docker.Cli, opts saveOptions) error {
 	if err != nil {
 		return err
 	}
+	platforms, err := image.ParsePlatforms(opts.platforms)
+	if err != nil {
+		return err
+	}
+	manifests, otherManifests, err := selectPlatformManifests(untarDir, manifests, platforms)
+	if err != nil {
+		return err
+	}
 
 	excludedLayers := []string{}
+	keptLayers := []string{}
 	for _, m := range manifests {
-		excludedLayers = append(excludedLayers, layersToExclude(m, opts)...)
+		img, err := loadImageConfig(untarDir, m)
+		if err != nil {
+			return err
+		}
+		excluded, err := layersToExclude(untarDir, m, img, opts)
+		if err != nil {
+			return err
+		}
+		excludedLayers = append(excludedLayers, excluded...)
+		for _, layer := range m.Layers {
+			if !slices.Contains(excluded, layer) {
+				keptLayers = append(keptLayers, layer)
+			}
+		}
 	}
-	tarOptions := &archive.TarOptions{
-		Compression:     archive.Uncompressed,
-		ExcludePatterns: excludedLayers,
+	if !opts.perImage {
+		for _, flag := range opts.selection.unmatched() {
+			logrus.Warnf("%s matches no image", flag)
+		}
+	}
+	excludedLayers = excludeUnshared(excludedLayers, keptLayers)
+	excludedLayers = append(excludedLayers, unusedFiles(otherManifests, manifests)...)
+	if err := downloadRegistryLayers(ctx, dockerCli, untarDir, excludedLayers); err != nil {
+		return err
+	}
+	excludedLayers = append(excludedLayers, registrySourceFileName, untarMetadataFileName)
+
+	extraFiles := []generatedFile{}
+	if opts.bundle {
+		index, err := generateBundleIndex(untarDir, manifests)
+		if err != nil {
+			return err
+		}
+		extraFiles = append(extraFiles, index)
 	}
-	tar, err := archive.TarWithOptions(untarDir, tarOptions)
+	if opts.legacyCompat {
+		legacyFiles, err := generateLegacyFiles(untarDir, manifests, excludedLayers)
+		if err != nil {
+			return err
+		}
+		extraFiles = append(extraFiles, legacyFiles...)
+		excludedLayers = append(excludedLayers, legacyRepositoriesFileName)
+	} else if err := warnLegacyFiles(untarDir, manifests); err != nil {
+		return err
+	}
+	tar, size, err := tarImages(ctx, untarDir, manifests, excludedLayers, extraFiles)
 	if err != nil {
 		return err
 	}
 
-	return outputSave(dockerCli, opts.output, tar)
+	dgst, written, err := outputSave(ctx, dockerCli, opts, tar, size)
+	if err != nil || !opts.jsonManifest {
+		return err
+	}
+	return writeJSONManifest(opts.output, dgst, written, untarDir, manifests, excludedLayers)
 }
 
-func outputSave(dockerCli docker.Cli, output string, body io.ReadCloser) error {
-	defer body.Close()
-	if output == "" {
-		_, err := io.Copy(dockerCli.Out(), body)
+// warnLegacyFiles warns legacy files left inconsistent by filtering, which
+// older docker load rejects
+func warnLegacyFiles(untarDir string, manifests []manifestItem) error {
+	problems, err := validateLegacyFiles(untarDir, manifests)
+	if err != nil {
 		return err
 	}
+	for _, problem := range problems {
+		logrus.Warnf("legacy file inconsistent: %s", problem)
+	}
+	if len(problems) > 0 {
+		logrus.Warn("older docker load may reject the archive, use --legacy-compat to regenerate legacy files")
+	}
+	return nil
+}
+
+// outputSave writes body of the expected size, 0 if unknown, to output, its
+// volumes if split, or STDOUT, returning digest and size of what is written
+func outputSave(ctx context.Context, dockerCli docker.Cli, opts saveOptions, body io.ReadCloser, size int64) (digest.Digest, int64, error) {
+	defer body.Close()
+	name := opts.output
+	if name == "" {
+		name = "STDOUT"
+	}
+	tracker := progress.FromContext(ctx).Start("write", name, size)
+	defer tracker.Done()
 
-	return command.CopyToFile(output, body)
+	// partial output file is removed when interrupted
+	reader := tracker.Reader(utils.ContextReader(ctx, body))
+	if opts.volumeSize > 0 {
+		index, err := writeVolumes(opts.output, reader, opts.volumeSize, opts.atomic)
+		if err != nil {
+			return "", 0, err
+		}
+		if opts.checksum {
+			if err := writeChecksum(opts.output, index.Volumes); err != nil {
+				return "", 0, err
+			}
+		}
+		return index.Digest, index.Size, nil
+	}
+
+	digester := digest.Canonical.Digester()
+	counter := &countingWriter{}
+	reader = io.TeeReader(reader, io.MultiWriter(digester.Hash(), counter))
+	if opts.output == "" {
+		_, err := io.Copy(dockerCli.Out(), reader)
+		return digester.Digest(), counter.n, err
+	}
+
+	var err error
+	if opts.atomic {
+		err = utils.WriteFileAtomic(opts.output, reader, 0644)
+	} else {
+		err = command.CopyToFile(opts.output, reader)
+	}
+	if err != nil {
+		return "", 0, err
+	}
+	if opts.checksum {
+		file := splitVolume{Name: filepath.Base(opts.output), Digest: digester.Digest()}
+		if err := writeChecksum(opts.output, []splitVolume{file}); err != nil {
+			return "", 0, err
+		}
+	}
+	return digester.Digest(), counter.n, nil
 }
 
-func layersToExclude(m manifestItem, opts saveOptions) []string {
+// layersToExclude returns layers not selected by --last, --first, --layers,
+// --exclude-diffid, layer size and history command filters
+func layersToExclude(untarDir string, m manifestItem, img *image.Image, opts saveOptions) ([]string, error) {
 	layers := m.Layers
-	end := len(layers)
-	if opts.last != "" {
-		imageIndex := findInputImageIndex(m, opts)
-		lastValue, _ := findLastValue(imageIndex, opts)
-		end = end - lastValue
+	kept := make([]bool, len(layers))
+	for i := range kept {
+		kept[i] = true
 	}
-	if end < 1 {
-		return []string{}
+	keep := func(selected func(i int) bool) {
+		for i := range kept {
+			kept[i] = kept[i] && selected(i)
+		}
 	}
-	return layers[:end]
+
+	if last, ok := lastValue(m, opts); ok {
+		keep(func(i int) bool { return i >= len(layers)-last })
+	}
+	if first := opts.selection.first.lookup(m); first != "" {
+		n, _ := strconv.Atoi(first)
+		keep(func(i int) bool { return i < n })
+	}
+	if selector := opts.selection.layers.lookup(m); selector != "" {
+		ranges, _ := parseLayerRanges(selector)
+		keep(func(i int) bool { return inLayerRanges(ranges, i+1) })
+	}
+	if len(opts.selection.excludeDiffIDs) > 0 {
+		diffIDs := img.RootFS.DiffIDs
+		if len(diffIDs) != len(layers) {
+			return nil, errors.Errorf("image %s has %d diff IDs, not %d, can not filter by diff ID", configID(m), len(diffIDs), len(layers))
+		}
+		keep(func(i int) bool { return !matchesDiffID(diffIDs[i], opts.selection.excludeDiffIDs) })
+	}
+	if opts.selection.sizes.isSet() {
+		sources, err := readRegistryLayerSources(untarDir)
+		if err != nil {
+			return nil, err
+		}
+		for i, layer := range layers {
+			if !kept[i] {
+				continue
+			}
+			size, _, err := layerSize(untarDir, layer, sources)
+			if err != nil {
+				return nil, err
+			}
+			kept[i] = opts.selection.sizes.contains(size)
+		}
+	}
+	if opts.createdBy.include != nil || opts.createdBy.exclude != nil {
+		history := filterNoEmptyHistory(append([]image.History{}, img.History...))
+		if len(history) != len(layers) {
+			return nil, errors.Errorf("image %s has %d layers in history, not %d, can not filter by history command", configID(m), len(history), len(layers))
+		}
+		keep(func(i int) bool { return opts.createdBy.keep(history[i].CreatedBy) })
+	}
+
+	excluded := []string{}
+	for i, layer := range layers {
+		if !kept[i] && !slices.Contains(excluded, layer) {
+			excluded = append(excluded, layer)
+		}
+	}
+	return excluded, nil
+}
+
+// lastValue returns n of --last for image of m, keyed by image or positional
+func lastValue(m manifestItem, opts saveOptions) (int, bool) {
+	if opts.last == "" {
+		return 0, false
+	}
+	if opts.selection.last != nil {
+		value := opts.selection.last.lookup(m)
+		if value == "" {
+			return 0, false
+		}
+		n, _ := strconv.Atoi(value)
+		return n, true
+	}
+	imageIndex := findInputImageIndex(m, opts)
+	if imageIndex < 0 {
+		// like IMAGE=N values matching no image, layers are all kept
+		name := configID(m)
+		if len(m.RepoTags) > 0 {
+			name = m.RepoTags[0]
+		}
+		logrus.Warnf("--last has no value for image %s, all of its layers are kept", name)
+		return 0, false
+	}
+	n, _ := findLastValue(imageIndex, opts)
+	return n, true
+}
+
+func (f createdByFilter) keep(command string) bool {
+	command = normalizeCommand(command)
+	if f.include != nil && !f.include.MatchString(command) {
+		return false
+	}
+	return f.exclude == nil || !f.exclude.MatchString(command)
 }
 
 func findInputImageIndex(m manifestItem, opts saveOptions) int {
 	imageIndex := -1
 	for i, image := range opts.images {
-		if slices.Contains(m.RepoTags, image) || strings.HasPrefix(m.Config, image) {
+		if manifestMatchesImage(m, image) {
 			imageIndex = i
 			break
 		}
@@ -149,6 +472,15 @@ func findInputImageIndex(m manifestItem, opts saveOptions) int {
 	return imageIndex
 }
 
+func manifestMatchesImage(m manifestItem, image string) bool {
+	if registry.IsReference(image) {
+		if ref, err := registry.ParseReference(image); err == nil {
+			image = ref.RepoTag()
+		}
+	}
+	return slices.Contains(m.RepoTags, image) || strings.HasPrefix(configID(m), strings.TrimPrefix(image, "sha256:"))
+}
+
 func findLastValue(imageIndex int, opts saveOptions) (int, error) {
 	lastArr := strings.Split(opts.last, ",")
 	if imageIndex < 0 {
@@ -0,0 +1,116 @@
+package image
+
+import (
+	"context"
+	"docker-save/docker"
+	"docker-save/docker/sbom"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slices"
+	"os"
+	"strings"
+	"time"
+)
+
+type sbomOptions struct {
+	commonImageOptions
+	format string
+	output string
+}
+
+// NewSBOMCommand creates a new `docker-save sbom` command
+func NewSBOMCommand(dockerCli docker.Cli) *cobra.Command {
+	var opts sbomOptions
+
+	cmd := &cobra.Command{
+		Use:   "sbom IMAGE",
+		Short: "Generate an SBOM of an image from OS package databases and lockfiles of its layers",
+		Args:  docker.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.images = args
+			return RunSBOM(cmd.Context(), dockerCli, opts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVar(&opts.format, "format", sbom.FormatSPDXJSON, "Format of SBOM, one of "+strings.Join(sbom.Formats, "|"))
+	flags.StringVarP(&opts.output, "output", "o", "", "Write to a file, instead of STDOUT")
+	flags.StringVarP(&opts.input, "input", "i", "", "Read layers from a saved tar archive, instead of docker")
+	flags.StringVarP(&opts.workdir, "workdir", "w", ".", "Directory for store tar files, default to current dir")
+	flags.BoolVarP(&opts.keep, "keep", "k", false, "Keep workdir afterwards, default to auto clean")
+	flags.BoolVar(&opts.cache, "cache", false, "Reuse configs and layers exported before from the managed cache, export only images not cached")
+	flags.StringSliceVar(&opts.platforms, "platform", nil, "Generate SBOM of the given platform of a multi-platform image, e.g. linux/arm64")
+
+	return cmd
+}
+
+// RunSBOM generates an SBOM of image, packages are attributed to the layers
+// introducing them, packages of layers absent from a partial archive are listed
+// as far as upper layers record them
+func RunSBOM(ctx context.Context, dockerCli docker.Cli, opts sbomOptions) error {
+	if !slices.Contains(sbom.Formats, opts.format) {
+		return errors.Errorf("unknown SBOM format %q, expect one of %s", opts.format, strings.Join(sbom.Formats, "|"))
+	}
+
+	tempDirPattern := func() string {
+		return ImagesConcatFmt(opts.images) + "-"
+	}
+	untarDir, err := ExportUntarImages(ctx, dockerCli, opts.commonImageOptions, tempDirPattern)
+	if shouldCleanUntarDir(opts.commonImageOptions) && untarDir != "" {
+		defer os.RemoveAll(untarDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	m, img, err := imageManifest(untarDir, opts.commonImageOptions)
+	if err != nil {
+		return err
+	}
+	if len(img.RootFS.DiffIDs) != len(m.Layers) {
+		return errors.New("DiffIDs in image config not equal to layers exists.")
+	}
+	if err := downloadRegistryLayers(ctx, dockerCli, untarDir, nil); err != nil {
+		return err
+	}
+	layers := []sbom.Layer{}
+	for i, layerPath := range m.Layers {
+		file, err := safePath(untarDir, layerPath)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			logrus.Warnf("layer %d absent from archive, packages are attributed to layers above recording them", i+1)
+			file = ""
+		} else if err != nil {
+			return err
+		}
+		layers = append(layers, sbom.Layer{File: file, DiffID: img.RootFS.DiffIDs[i]})
+	}
+
+	inv, err := sbom.Catalog(layers)
+	if err != nil {
+		return err
+	}
+	for _, skipped := range inv.Skipped {
+		logrus.Warnf("packages not cataloged from %s", skipped)
+	}
+	name := opts.images[0]
+	if len(m.RepoTags) > 0 {
+		name = m.RepoTags[0]
+	}
+	subject := sbom.Subject{Name: name, ID: digest.NewDigestFromEncoded(digest.SHA256, configID(m))}
+	content, err := sbom.Encode(opts.format, subject, inv, time.Now())
+	if err != nil {
+		return err
+	}
+	content = append(content, '\n')
+	if opts.output == "" {
+		_, err = dockerCli.Out().Write(content)
+		return err
+	}
+	return os.WriteFile(opts.output, content, 0644)
+}
@@ -0,0 +1,131 @@
+package image
+
+import (
+	"context"
+	"docker-save/docker"
+	"docker-save/docker/layer"
+	"docker-save/docker/progress"
+	"docker-save/docker/scan"
+	"docker-save/docker/utils"
+	"fmt"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"github.com/spf13/cobra"
+	"os"
+)
+
+type scanOptions struct {
+	commonImageOptions
+	excludes []string
+}
+
+// NewScanCommand creates a new `docker-save scan` command
+func NewScanCommand(dockerCli docker.Cli) *cobra.Command {
+	var opts scanOptions
+
+	cmd := &cobra.Command{
+		Use:   "scan IMAGE",
+		Short: "Scan every layer of an image for secrets and sensitive files, including files deleted by upper layers",
+		Args:  docker.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.images = args
+			return RunScan(cmd.Context(), dockerCli, opts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.input, "input", "i", "", "Read layers from a saved tar archive, instead of docker")
+	flags.StringSliceVar(&opts.excludes, "exclude", nil, "Skip paths matching the prefixes or globs, e.g. usr/share/doc,*/tests/*")
+	flags.StringVarP(&opts.workdir, "workdir", "w", ".", "Directory for store tar files, default to current dir")
+	flags.BoolVarP(&opts.keep, "keep", "k", false, "Keep workdir afterwards, default to auto clean")
+	flags.BoolVar(&opts.cache, "cache", false, "Reuse configs and layers exported before from the managed cache, export only images not cached")
+	flags.StringSliceVar(&opts.platforms, "platform", nil, "Scan the given platform of a multi-platform image, e.g. linux/arm64")
+
+	return cmd
+}
+
+// RunScan scans layers of image as shipped, a secret removed by an upper layer
+// is still in the layer which added it, scanning fails if anything is found
+func RunScan(ctx context.Context, dockerCli docker.Cli, opts scanOptions) error {
+	tempDirPattern := func() string {
+		return ImagesConcatFmt(opts.images) + "-"
+	}
+	untarDir, err := ExportUntarImages(ctx, dockerCli, opts.commonImageOptions, tempDirPattern)
+	if shouldCleanUntarDir(opts.commonImageOptions) && untarDir != "" {
+		defer os.RemoveAll(untarDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	m, img, err := imageManifest(untarDir, opts.commonImageOptions)
+	if err != nil {
+		return err
+	}
+	if err := downloadRegistryLayers(ctx, dockerCli, untarDir, nil); err != nil {
+		return err
+	}
+	commands := []string{}
+	if history := filterNoEmptyHistory(img.History); len(history) == len(m.Layers) {
+		for _, h := range history {
+			commands = append(commands, normalizeCommand(h.CreatedBy))
+		}
+	}
+
+	scanner := scan.NewScanner(opts.excludes)
+	for i, layerPath := range m.Layers {
+		file, err := safePath(untarDir, layerPath)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			logrus.Warnf("layer %d absent from archive, not scanned", i+1)
+			scanner.SkipLayer()
+			continue
+		}
+		if err := scanLayer(ctx, scanner, file, i+1); err != nil {
+			return err
+		}
+	}
+
+	findings := scanner.Findings()
+	layers := map[int]bool{}
+	for _, finding := range findings {
+		layers[finding.Layer] = true
+		fmt.Fprintln(dockerCli.Out(), formatFinding(finding))
+		if finding.Layer <= len(commands) {
+			fmt.Fprintf(dockerCli.Out(), "          Command: %s\n", omitCommand(commands[finding.Layer-1], 100))
+		}
+	}
+	if len(findings) > 0 {
+		return errors.Errorf("found %d potential secrets in %d layers of %s", len(findings), len(layers), opts.images[0])
+	}
+	fmt.Fprintln(dockerCli.Out(), "No secrets found")
+	return nil
+}
+
+func scanLayer(ctx context.Context, scanner *scan.Scanner, file string, number int) error {
+	reader, err := layer.Open(file)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	tracker := progress.FromContext(ctx).Start("scan", fmt.Sprintf("layer %d", number), 0)
+	defer tracker.Done()
+	return scanner.ScanLayer(tracker.Reader(utils.ContextReader(ctx, reader)))
+}
+
+func formatFinding(finding scan.Finding) string {
+	location := finding.Path
+	if finding.Line > 0 {
+		location = fmt.Sprintf("%s:%d", location, finding.Line)
+	}
+	if finding.Masked != "" {
+		location += " " + finding.Masked
+	}
+	if finding.RemovedBy > 0 {
+		location += fmt.Sprintf(" (removed by layer %d, still shipped in layer %d)", finding.RemovedBy, finding.Layer)
+	}
+	return fmt.Sprintf("Layer %2d: %-24s %s", finding.Layer, finding.Rule, location)
+}
@@ -0,0 +1,247 @@
+package image
+
+import (
+	"context"
+	"docker-save/docker"
+	"docker-save/docker/image"
+	"docker-save/docker/layer"
+	"docker-save/docker/progress"
+	"encoding/json"
+	"fmt"
+	"github.com/distribution/reference"
+	"github.com/docker/cli/cli/command"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"golang.org/x/exp/slices"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"time"
+)
+
+type squashOptions struct {
+	commonImageOptions
+	output string
+	from   int
+	last   int
+	tag    string
+}
+
+// NewSquashCommand creates a new `docker-save squash` command
+func NewSquashCommand(dockerCli docker.Cli) *cobra.Command {
+	var opts squashOptions
+
+	cmd := &cobra.Command{
+		Use:   "squash IMAGE --from N",
+		Short: "Squash layers N to the top of an image into one layer, and save it as a tar archive",
+		Args:  docker.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.images = args
+			return RunSquash(cmd.Context(), dockerCli, opts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.output, "output", "o", "", "Write to a file, instead of STDOUT")
+	flags.IntVar(&opts.from, "from", 0, "Squash layers from the 1-based index to the top")
+	flags.IntVarP(&opts.last, "last", "l", 0, "Export the last n image layers after squashing, all by default")
+	flags.StringVarP(&opts.tag, "tag", "t", "", "Tag the squashed image, instead of the tags of image")
+	flags.StringVarP(&opts.workdir, "workdir", "w", ".", "Directory for store tar files, default to current dir")
+	flags.BoolVarP(&opts.keep, "keep", "k", false, "Keep workdir afterwards, default to auto clean")
+	flags.BoolVar(&opts.cache, "cache", false, "Reuse configs and layers exported before from the managed cache, export only images not cached")
+	flags.StringSliceVar(&opts.platforms, "platform", nil, "Squash the given platform of a multi-platform image, e.g. linux/arm64")
+	_ = cmd.MarkFlagRequired("from")
+
+	return cmd
+}
+
+// RunSquash saves an image with its top layers merged into one
+func RunSquash(ctx context.Context, dockerCli docker.Cli, opts squashOptions) error {
+	if opts.output == "" && dockerCli.Out().IsTerminal() {
+		return errors.New("cowardly refusing to save to a terminal. Use the -o flag or redirect")
+	}
+	if err := command.ValidateOutputPath(opts.output); err != nil {
+		return errors.Wrap(err, "failed to save image")
+	}
+	if opts.from < 1 {
+		return errors.New("--from must be at least 1")
+	}
+	repoTags, err := parseTagFlag(opts.tag)
+	if err != nil {
+		return err
+	}
+
+	tempDirPattern := func() string {
+		return ImagesConcatFmt(opts.images) + "-"
+	}
+	untarDir, err := ExportUntarImages(ctx, dockerCli, opts.commonImageOptions, tempDirPattern)
+	if shouldCleanUntarDir(opts.commonImageOptions) && untarDir != "" {
+		defer os.RemoveAll(untarDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	m, img, err := singleManifest(untarDir, opts.commonImageOptions)
+	if err != nil {
+		return err
+	}
+	if opts.from > len(m.Layers) {
+		return errors.Errorf("--from %d is beyond the %d layers of %s", opts.from, len(m.Layers), opts.images[0])
+	}
+	if len(repoTags) == 0 {
+		repoTags = m.RepoTags
+	}
+
+	// base layers dropped by --last are neither downloaded nor written
+	base := m.Layers[:opts.from-1]
+	dropped := []string{}
+	if opts.last > 0 && opts.last < len(base)+1 {
+		dropped = base[:len(base)+1-opts.last]
+	}
+	if err := downloadRegistryLayers(ctx, dockerCli, untarDir, dropped); err != nil {
+		return err
+	}
+
+	squashDir, err := os.MkdirTemp(untarDir, ".squash-")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(squashDir)
+	squashed, diffID, err := squashLayers(ctx, untarDir, squashDir, m.Layers[opts.from-1:])
+	if err != nil {
+		return err
+	}
+	config, err := squashConfig(img, opts.from, diffID)
+	if err != nil {
+		return err
+	}
+	configFile := digest.FromBytes(config).Encoded() + ".json"
+	if err := os.WriteFile(filepath.Join(squashDir, configFile), config, 0644); err != nil {
+		return err
+	}
+	for _, layerPath := range base {
+		if slices.Contains(dropped, layerPath) {
+			continue
+		}
+		source, err := safePath(untarDir, layerPath)
+		if err != nil {
+			return err
+		}
+		if err := linkOrCopy(source, filepath.Join(squashDir, filepath.FromSlash(layerPath))); err != nil {
+			return err
+		}
+	}
+
+	squashedManifest := manifestItem{Config: configFile, RepoTags: repoTags, Layers: append(append([]string{}, base...), squashed)}
+	tar, size, err := tarImages(ctx, squashDir, []manifestItem{squashedManifest}, nil, nil)
+	if err != nil {
+		return err
+	}
+	_, _, err = outputSave(ctx, dockerCli, saveOptions{output: opts.output}, tar, size)
+	return err
+}
+
+// parseTagFlag returns repo tags of --tag in familiar form, none if not set
+func parseTagFlag(tag string) ([]string, error) {
+	if tag == "" {
+		return []string{}, nil
+	}
+	named, err := reference.ParseNormalizedNamed(tag)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid --tag")
+	}
+	return []string{reference.FamiliarString(reference.TagNameOnly(named))}, nil
+}
+
+// squashLayers writes layers of untar dir squashed into squash dir, returning
+// its path named by diff ID in legacy layout
+func squashLayers(ctx context.Context, untarDir string, squashDir string, layers []string) (string, digest.Digest, error) {
+	files, err := layerFiles(untarDir, layers)
+	if err != nil {
+		return "", "", err
+	}
+
+	temp, err := os.CreateTemp(squashDir, "layer-")
+	if err != nil {
+		return "", "", err
+	}
+	defer temp.Close()
+	tracker := progress.FromContext(ctx).Start("squash", fmt.Sprintf("%d layers", len(layers)), 0)
+	defer tracker.Done()
+	digester := digest.Canonical.Digester()
+	writer := io.MultiWriter(temp, digester.Hash(), &contextWriter{ctx: ctx, tracker: tracker})
+	if err := layer.Squash(files, writer); err != nil {
+		return "", "", err
+	}
+	if err := temp.Close(); err != nil {
+		return "", "", err
+	}
+
+	diffID := digester.Digest()
+	layerPath := path.Join(diffID.Encoded(), legacyLayerFileName)
+	target := filepath.Join(squashDir, filepath.FromSlash(layerPath))
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return "", "", err
+	}
+	return layerPath, diffID, os.Rename(temp.Name(), target)
+}
+
+// contextWriter counts bytes written for progress, failing once ctx is done
+type contextWriter struct {
+	ctx     context.Context
+	tracker *progress.Tracker
+}
+
+func (w *contextWriter) Write(p []byte) (int, error) {
+	if err := w.ctx.Err(); err != nil {
+		return 0, err
+	}
+	w.tracker.Add(int64(len(p)))
+	return len(p), nil
+}
+
+// squashConfig rewrites diff IDs and history of image config for layers from
+// the 1-based index on squashed into one layer of diffID, other fields are
+// kept as is
+func squashConfig(img *image.Image, from int, diffID digest.Digest) ([]byte, error) {
+	config := map[string]json.RawMessage{}
+	if err := json.Unmarshal(img.RawJSON(), &config); err != nil {
+		return nil, err
+	}
+
+	rootFS := *img.RootFS
+	rootFS.DiffIDs = append(append([]digest.Digest{}, img.RootFS.DiffIDs[:from-1]...), diffID)
+	content, err := json.Marshal(rootFS)
+	if err != nil {
+		return nil, err
+	}
+	config["rootfs"] = content
+
+	// history of squashed layers is replaced, metadata only entries are kept
+	history := []image.History{}
+	layers := 0
+	for _, h := range img.History {
+		if !h.EmptyLayer {
+			layers++
+			if layers >= from {
+				continue
+			}
+		}
+		history = append(history, h)
+	}
+	created := time.Now().UTC()
+	history = append(history, image.History{
+		Created:   &created,
+		CreatedBy: fmt.Sprintf("docker-save squash --from %d", from),
+		Comment:   fmt.Sprintf("squashed %d layers", len(img.RootFS.DiffIDs)-from+1),
+	})
+	if content, err = json.Marshal(history); err != nil {
+		return nil, err
+	}
+	config["history"] = content
+	return json.Marshal(config)
+}
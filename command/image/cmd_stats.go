@@ -4,6 +4,7 @@ Copyright © 2023 William Wang <williamw0825@gmail.com>
 package image
 
 import (
+	"context"
 	"docker-save/docker"
 	"docker-save/docker/image"
 	"fmt"
@@ -19,6 +20,8 @@ import (
 
 type statsOptions struct {
 	commonImageOptions
+	minLayerSize string
+	maxLayerSize string
 }
 
 // NewStatsCommand creates a new `docker-save stat` command
@@ -30,7 +33,7 @@ func NewStatsCommand(dockerCli docker.Cli) *cobra.Command {
 		Short: "Stats image layers with command and size info",
 		RunE: func(cmd *cobra.Command, args []string) error {
 			opts.images = args
-			return RunStats(dockerCli, opts)
+			return RunStats(cmd.Context(), dockerCli, opts)
 		},
 	}
 
@@ -39,17 +42,25 @@ func NewStatsCommand(dockerCli docker.Cli) *cobra.Command {
 	flags.StringVarP(&opts.workdir, "workdir", "w", ".", "Directory for store tar files, default to current dir")
 	flags.BoolVarP(&opts.keep, "keep", "k", false, "Keep workdir afterwards, default to auto clean")
 	flags.StringVarP(&opts.cacheFrom, "cache-from", "c", "", "Use untar-images directory already exists other than export from docker")
+	flags.BoolVar(&opts.cache, "cache", false, "Reuse configs and layers exported before from the managed cache, export only images not cached")
+	flags.StringVar(&opts.minLayerSize, "min-layer-size", "", "Stats only layers of at least the size, e.g. 100MB")
+	flags.StringVar(&opts.maxLayerSize, "max-layer-size", "", "Stats only layers of at most the size, e.g. 1MB")
+	flags.StringSliceVar(&opts.platforms, "platform", nil, "Stats only the given platforms of multi-platform images, e.g. linux/amd64,linux/arm64")
 
 	return cmd
 }
 
 // RunStats to stats image layers information
-func RunStats(dockerCli docker.Cli, opts statsOptions) error {
+func RunStats(ctx context.Context, dockerCli docker.Cli, opts statsOptions) error {
+	sizes, err := parseLayerSizeRange(opts.minLayerSize, opts.maxLayerSize)
+	if err != nil {
+		return err
+	}
 	tempDirPattern := func() string {
 		return ImagesConcatFmt(opts.images) + "-"
 	}
 
-	untarDir, err := ExportUntarImages(dockerCli, opts.commonImageOptions, tempDirPattern)
+	untarDir, err := ExportUntarImages(ctx, dockerCli, opts.commonImageOptions, tempDirPattern)
 	if shouldCleanUntarDir(opts.commonImageOptions) && untarDir != "" {
 		// must not be run before func outputSave
 		defer os.RemoveAll(untarDir)
@@ -62,18 +73,24 @@ func RunStats(dockerCli docker.Cli, opts statsOptions) error {
 	if err != nil {
 		return err
 	}
+	platforms, err := image.ParsePlatforms(opts.platforms)
+	if err != nil {
+		return err
+	}
+	if manifests, _, err = selectPlatformManifests(untarDir, manifests, platforms); err != nil {
+		return err
+	}
+
+	sources, err := readRegistryLayerSources(untarDir)
+	if err != nil {
+		return err
+	}
 
 	for _, manifest := range manifests {
-		configPath, err := safePath(untarDir, manifest.Config)
+		img, err := loadImageConfig(untarDir, manifest)
 		if err != nil {
 			return err
 		}
-		config, err := os.ReadFile(configPath)
-		if err != nil {
-			return err
-		}
-
-		img, err := image.NewFromJSON(config)
 		diff_ids := img.RootFS.DiffIDs
 		layers := manifest.Layers
 		notEmptyHistory := filterNoEmptyHistory(img.History)
@@ -82,17 +99,27 @@ func RunStats(dockerCli docker.Cli, opts statsOptions) error {
 			return errors.New("NotEmptyLayers in history not equal to layers exists.")
 		}
 
-		printManifestStatsHead(dockerCli, manifest)
+		printManifestStatsHead(dockerCli, manifest, img)
 		for i, history := range notEmptyHistory {
-			layerPath, _ := safePath(untarDir, layers[i])
-			layerInfo, _ := os.Stat(layerPath)
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			size, compressed, err := layerSize(untarDir, layers[i], sources)
+			if err != nil {
+				return err
+			}
+			if !sizes.contains(size) {
+				continue
+			}
 			statsItem := LayerStatsItem{
 				Number:  i + 1,
 				DiffID:  diff_ids[i],
 				Layer:   layers[i],
 				Command: history.CreatedBy,
 				Created: history.Created,
-				Size:    layerInfo.Size(),
+				Size:    size,
+				// registry layers are not downloaded for stats
+				Compressed: compressed,
 			}
 			fmt.Fprintln(dockerCli.Out(), statsItem.Format())
 		}
@@ -109,12 +136,18 @@ type LayerStatsItem struct {
 	Created *time.Time    `json:"created,omitempty"`
 	Command string        `json:"command"`
 	Size    int64         `json:"size"`
+	// Compressed tells Size is of the compressed registry blob
+	Compressed bool `json:"compressed,omitempty"`
 }
 
 func (layer LayerStatsItem) Format() string {
+	size := units.HumanSizeWithPrecision(float64(layer.Size), 5)
+	if layer.Compressed {
+		size += " (compressed)"
+	}
 	return fmt.Sprintf("Layer %2d: Size %8s, %-64s DiffID: %s Layer: %s",
 		layer.Number,
-		units.HumanSizeWithPrecision(float64(layer.Size), 5),
+		size,
 		omitCommand(layer.Command, 64),
 		OmitString(layer.DiffID.String(), 36),
 		layer.Layer)
@@ -123,9 +156,14 @@ func (layer LayerStatsItem) Format() string {
 var regex = regexp.MustCompile(`\s+`)
 
 func omitCommand(str string, length int) string {
+	return OmitString(normalizeCommand(str), length)
+}
+
+// normalizeCommand collapses whitespace of history command and drops the
+// buildkit marker
+func normalizeCommand(str string) string {
 	str = regex.ReplaceAllString(str, " ")
-	str = strings.TrimSuffix(str, " # buildkit")
-	return OmitString(str, length)
+	return strings.TrimSuffix(str, " # buildkit")
 }
 
 func filterNoEmptyHistory(history []image.History) []image.History {
@@ -138,14 +176,22 @@ func filterNoEmptyHistory(history []image.History) []image.History {
 	return tmp
 }
 
-func printManifestStatsHead(dockerCli docker.Cli, manifest manifestItem) {
+func printManifestStatsHead(dockerCli docker.Cli, manifest manifestItem, img *image.Image) {
+	fmt.Fprintf(dockerCli.Out(), "Start Stats of %s\n\n", manifestIdentity(manifest, img))
+}
+
+// manifestIdentity names image by its first tag or short ID, with its platform
+func manifestIdentity(manifest manifestItem, img *image.Image) string {
 	identity := ""
 	if len(manifest.RepoTags) > 0 {
 		identity = fmt.Sprintf("Image Tag: %s", manifest.RepoTags[0])
 	} else {
-		identity = fmt.Sprintf("Image Id: %s", manifest.Config[:12])
+		identity = fmt.Sprintf("Image Id: %s", configID(manifest)[:12])
+	}
+	if img.OS != "" {
+		identity = fmt.Sprintf("%s (%s)", identity, image.FormatPlatform(img.Platform()))
 	}
-	fmt.Fprintf(dockerCli.Out(), "Start Stats of %s\n\n", identity)
+	return identity
 }
 
 func printManifestStatsTail(dockerCli docker.Cli, manifest manifestItem) {
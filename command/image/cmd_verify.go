@@ -0,0 +1,296 @@
+package image
+
+import (
+	"context"
+	"docker-save/docker"
+	"docker-save/docker/layer"
+	"fmt"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"github.com/spf13/cobra"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+type verifyOptions struct {
+	commonImageOptions
+}
+
+// NewVerifyCommand creates a new `docker-save verify` command
+func NewVerifyCommand(dockerCli docker.Cli) *cobra.Command {
+	var opts verifyOptions
+
+	cmd := &cobra.Command{
+		Use:   "verify ARCHIVE",
+		Short: "Verify layers and configs of a saved tar archive against their digests",
+		Args:  docker.ExactArgs(1),
+		RunE: func(cmd *cobra.Command, args []string) error {
+			opts.input = args[0]
+			return RunVerify(cmd.Context(), dockerCli, opts)
+		},
+	}
+
+	flags := cmd.Flags()
+
+	flags.StringVarP(&opts.workdir, "workdir", "w", ".", "Directory for store tar files, default to current dir")
+	flags.BoolVarP(&opts.keep, "keep", "k", false, "Keep workdir afterwards, default to auto clean")
+
+	return cmd
+}
+
+// RunVerify verifies a saved archive, layers missing from partial archives are
+// reported but not treated as failure
+func RunVerify(ctx context.Context, dockerCli docker.Cli, opts verifyOptions) error {
+	tempDirPattern := func() string {
+		return filepath.Base(opts.input) + "-"
+	}
+	untarDir, err := ExportUntarImages(ctx, dockerCli, opts.commonImageOptions, tempDirPattern)
+	if shouldCleanUntarDir(opts.commonImageOptions) && untarDir != "" {
+		defer os.RemoveAll(untarDir)
+	}
+	if err != nil {
+		return err
+	}
+
+	result, err := verifyUntarDir(ctx, untarDir)
+	if err != nil {
+		return err
+	}
+	printVerification(dockerCli.Out(), result)
+	if result.corrupted > 0 {
+		return errors.Errorf("archive %s failed verification, %d corrupted files", opts.input, result.corrupted)
+	}
+	return nil
+}
+
+const (
+	verifyOK        = "ok"
+	verifyMissing   = "missing"
+	verifyCorrupted = "corrupted"
+)
+
+type fileVerification struct {
+	path   string
+	status string
+	detail string
+}
+
+type imageVerification struct {
+	manifest manifestItem
+	config   fileVerification
+	layers   []fileVerification
+}
+
+type archiveVerification struct {
+	images    []imageVerification
+	blobs     []fileVerification
+	extra     []string
+	missing   int
+	corrupted int
+}
+
+func (v *archiveVerification) count(file fileVerification) {
+	switch file.status {
+	case verifyMissing:
+		v.missing++
+	case verifyCorrupted:
+		v.corrupted++
+	}
+}
+
+// verifyUntarDir checks configs and layers of untar dir against digests in
+// manifests and image configs, and looks for files no manifest references
+func verifyUntarDir(ctx context.Context, untarDir string) (*archiveVerification, error) {
+	manifests, err := ResolveManifests(untarDir)
+	if err != nil {
+		return nil, err
+	}
+
+	result := &archiveVerification{}
+	known := map[string]bool{manifestFileName: true, legacyRepositoriesFileName: true, ociIndexFileName: true, ociLayoutFileName: true, bundleIndexFileName: true}
+	for _, m := range manifests {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		verification := verifyImage(untarDir, m)
+		result.count(verification.config)
+		for _, layerVerification := range verification.layers {
+			result.count(layerVerification)
+		}
+		result.images = append(result.images, verification)
+
+		known[m.Config] = true
+		for _, layerPath := range m.Layers {
+			known[layerPath] = true
+			if id, legacy := legacyLayerID(layerPath); legacy {
+				known[path.Join(id, legacyConfigFileName)] = true
+				known[path.Join(id, legacyVersionFileName)] = true
+			}
+		}
+	}
+
+	err = filepath.WalkDir(untarDir, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		if err := ctx.Err(); err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(untarDir, file)
+		if err != nil {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+		if known[rel] || isLegacyLayerFile(untarDir, rel) {
+			return nil
+		}
+		if strings.HasPrefix(rel, ociBlobsDir+"/") {
+			// content addressed blobs like OCI manifests are verified by name
+			blob := verifyBlob(untarDir, rel)
+			result.count(blob)
+			result.blobs = append(result.blobs, blob)
+			return nil
+		}
+		result.extra = append(result.extra, rel)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Strings(result.extra)
+	return result, nil
+}
+
+func verifyImage(untarDir string, m manifestItem) imageVerification {
+	verification := imageVerification{
+		manifest: m,
+		config:   fileVerification{path: m.Config, status: verifyOK},
+	}
+	corrupted := func(file *fileVerification, format string, args ...interface{}) {
+		file.status = verifyCorrupted
+		file.detail = fmt.Sprintf(format, args...)
+	}
+
+	diffIDs := []digest.Digest{}
+	configPath, err := safePath(untarDir, m.Config)
+	if err != nil {
+		corrupted(&verification.config, "%v", err)
+	} else if content, err := os.ReadFile(configPath); err != nil {
+		corrupted(&verification.config, "%v", errors.Cause(err))
+	} else if dgst := digest.FromBytes(content); dgst.Encoded() != configID(m) {
+		corrupted(&verification.config, "digest is %s", dgst)
+	} else if img, err := imageConfigFromJSON(content); err != nil {
+		corrupted(&verification.config, "%v", err)
+	} else if len(img.RootFS.DiffIDs) != len(m.Layers) {
+		corrupted(&verification.config, "%d diff IDs for %d layers", len(img.RootFS.DiffIDs), len(m.Layers))
+	} else {
+		diffIDs = img.RootFS.DiffIDs
+	}
+
+	for i, layerPath := range m.Layers {
+		file := fileVerification{path: layerPath, status: verifyOK}
+		target, err := safePath(untarDir, layerPath)
+		if err != nil {
+			corrupted(&file, "%v", err)
+			verification.layers = append(verification.layers, file)
+			continue
+		}
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			file.status = verifyMissing
+			verification.layers = append(verification.layers, file)
+			continue
+		}
+
+		raw, diffID, err := layer.Digests(target)
+		switch {
+		case err != nil:
+			corrupted(&file, "%v", err)
+		case strings.HasPrefix(layerPath, ociBlobsDir+"/") && raw.Encoded() != path.Base(layerPath):
+			corrupted(&file, "digest is %s", raw)
+		case i < len(diffIDs) && diffID != diffIDs[i]:
+			corrupted(&file, "diff ID is %s, expected %s", diffID, diffIDs[i])
+		}
+		verification.layers = append(verification.layers, file)
+	}
+	return verification
+}
+
+func verifyBlob(untarDir string, blob string) fileVerification {
+	file := fileVerification{path: blob, status: verifyOK}
+	expected := digest.NewDigestFromEncoded(digest.Algorithm(path.Base(path.Dir(blob))), path.Base(blob))
+	if err := expected.Validate(); err != nil {
+		file.status = verifyCorrupted
+		file.detail = err.Error()
+		return file
+	}
+	content, err := os.Open(filepath.Join(untarDir, blob))
+	if err != nil {
+		file.status = verifyCorrupted
+		file.detail = err.Error()
+		return file
+	}
+	defer content.Close()
+	verifier := expected.Verifier()
+	if _, err := io.Copy(verifier, content); err != nil || !verifier.Verified() {
+		file.status = verifyCorrupted
+		file.detail = "content does not match digest"
+	}
+	return file
+}
+
+// isLegacyLayerFile tells whether file is in a legacy layer directory whose
+// json names the directory, e.g. generated by --legacy-compat
+func isLegacyLayerFile(untarDir string, file string) bool {
+	id := path.Dir(file)
+	switch path.Base(file) {
+	case legacyLayerFileName, legacyConfigFileName, legacyVersionFileName:
+	default:
+		return false
+	}
+	v1Image, err := readLegacyLayerConfig(untarDir, id)
+	return err == nil && v1Image.ID == id
+}
+
+func printVerification(out io.Writer, result *archiveVerification) {
+	printFile := func(name string, file fileVerification) {
+		line := fmt.Sprintf("%s %s %s", name, OmitString(file.path, 48), file.status)
+		if file.detail != "" {
+			line += ": " + file.detail
+		}
+		fmt.Fprintln(out, line)
+	}
+
+	layers := 0
+	for _, verification := range result.images {
+		name := strings.Join(verification.manifest.RepoTags, ",")
+		if name == "" {
+			name = "<none>"
+		}
+		id := configID(verification.manifest)
+		if len(id) > 12 {
+			id = id[:12]
+		}
+		fmt.Fprintf(out, "Image: %s (%s)\n", name, id)
+		printFile("Config:  ", verification.config)
+		for i, file := range verification.layers {
+			printFile(fmt.Sprintf("Layer %2d:", i+1), file)
+			layers++
+		}
+		fmt.Fprintln(out)
+	}
+	for _, blob := range result.blobs {
+		if blob.status != verifyOK {
+			printFile("Blob:    ", blob)
+		}
+	}
+	for _, extra := range result.extra {
+		fmt.Fprintf(out, "Extra:    %s\n", extra)
+	}
+	fmt.Fprintf(out, "Verified %d images, %d layers, %d missing, %d corrupted, %d extra files\n",
+		len(result.images), layers, result.missing, result.corrupted, len(result.extra))
+}
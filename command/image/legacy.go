@@ -0,0 +1,263 @@
+package image
+
+import (
+	"docker-save/docker/image"
+	"docker-save/docker/registry"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slices"
+	"os"
+	"path"
+	"sort"
+)
+
+// legacyVersion is the content of VERSION file of legacy layer directories
+const legacyVersion = "1.0"
+
+// legacyRepositories maps familiar name and tag to v1 ID of the top layer
+type legacyRepositories map[string]map[string]string
+
+// legacyLayerID returns v1 ID of layer path <v1 id>/layer.tar, or blob hex
+// of layer path blobs/sha256/<hex> which has no legacy directory
+func legacyLayerID(layerPath string) (string, bool) {
+	if path.Base(layerPath) == legacyLayerFileName {
+		return path.Dir(layerPath), true
+	}
+	return path.Base(layerPath), false
+}
+
+func readLegacyRepositories(untarDir string) (legacyRepositories, error) {
+	repositoriesPath, err := safePath(untarDir, legacyRepositoriesFileName)
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(repositoriesPath)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	repositories := legacyRepositories{}
+	if err := json.Unmarshal(content, &repositories); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", legacyRepositoriesFileName)
+	}
+	return repositories, nil
+}
+
+func readLegacyLayerConfig(untarDir string, id string) (*image.V1Image, error) {
+	configPath, err := safePath(untarDir, path.Join(id, legacyConfigFileName))
+	if err != nil {
+		return nil, err
+	}
+	content, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	v1Image := &image.V1Image{}
+	if err := json.Unmarshal(content, v1Image); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", path.Join(id, legacyConfigFileName))
+	}
+	return v1Image, nil
+}
+
+func hasLegacyLayerFiles(untarDir string, manifests []manifestItem) bool {
+	for _, m := range manifests {
+		for _, layerPath := range m.Layers {
+			id, legacy := legacyLayerID(layerPath)
+			if !legacy {
+				continue
+			}
+			if configPath, err := safePath(untarDir, path.Join(id, legacyConfigFileName)); err == nil {
+				if _, err := os.Stat(configPath); err == nil {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// validateLegacyFiles checks legacy per-layer json and VERSION files and the
+// repositories file are consistent with manifests, returns problems found,
+// archives without any legacy file have nothing to check
+func validateLegacyFiles(untarDir string, manifests []manifestItem) ([]string, error) {
+	repositories, err := readLegacyRepositories(untarDir)
+	if err != nil {
+		return nil, err
+	}
+	if repositories == nil && !hasLegacyLayerFiles(untarDir, manifests) {
+		return []string{}, nil
+	}
+
+	problems := []string{}
+	checked := map[string]bool{}
+	topIDs := map[string]bool{}
+	for _, m := range manifests {
+		parent := ""
+		for _, layerPath := range m.Layers {
+			id, legacy := legacyLayerID(layerPath)
+			if legacy && !checked[id] {
+				checked[id] = true
+				problems = append(problems, validateLegacyLayer(untarDir, id, parent)...)
+			}
+			parent = id
+		}
+		if len(m.Layers) == 0 || repositories == nil {
+			continue
+		}
+
+		ids, err := legacyTopIDs(untarDir, m)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			topIDs[id] = true
+		}
+		for _, repoTag := range m.RepoTags {
+			ref, err := registry.ParseReference(repoTag)
+			if err != nil {
+				continue
+			}
+			if id := repositories[ref.Name()][ref.Tag]; !slices.Contains(ids, id) {
+				problems = append(problems, fmt.Sprintf("%s: %s points to %q, expected %s", legacyRepositoriesFileName, repoTag, id, ids[0]))
+			}
+		}
+	}
+
+	for _, name := range sortedKeys(repositories) {
+		for _, tag := range sortedKeys(repositories[name]) {
+			if id := repositories[name][tag]; !topIDs[id] {
+				problems = append(problems, fmt.Sprintf("%s: %s:%s points to %s which is not in archive", legacyRepositoriesFileName, name, tag, id))
+			}
+		}
+	}
+	return problems, nil
+}
+
+// legacyTopIDs returns IDs repositories file may map tags of manifest to, docker
+// 25+ maps them to the top layer blob, and v1 ID of the top layer is used when
+// legacy directories are generated for OCI layouts
+func legacyTopIDs(untarDir string, m manifestItem) ([]string, error) {
+	id, legacy := legacyLayerID(m.Layers[len(m.Layers)-1])
+	if legacy {
+		return []string{id}, nil
+	}
+	img, err := loadImageConfig(untarDir, m)
+	if err != nil {
+		return nil, err
+	}
+	v1Layers, err := img.V1Layers()
+	if err != nil || len(v1Layers) == 0 {
+		return []string{id}, err
+	}
+	return []string{id, v1Layers[len(v1Layers)-1].ID.Encoded()}, nil
+}
+
+func validateLegacyLayer(untarDir string, id string, parent string) []string {
+	problems := []string{}
+	versionPath, err := safePath(untarDir, path.Join(id, legacyVersionFileName))
+	if err != nil {
+		return append(problems, err.Error())
+	}
+	if version, err := os.ReadFile(versionPath); err != nil {
+		problems = append(problems, fmt.Sprintf("%s/%s: %v", id, legacyVersionFileName, errors.Cause(err)))
+	} else if string(version) != legacyVersion {
+		problems = append(problems, fmt.Sprintf("%s/%s: unsupported version %q", id, legacyVersionFileName, version))
+	}
+
+	v1Image, err := readLegacyLayerConfig(untarDir, id)
+	if err != nil {
+		return append(problems, fmt.Sprintf("%s/%s: %v", id, legacyConfigFileName, errors.Cause(err)))
+	}
+	if v1Image.ID != id {
+		problems = append(problems, fmt.Sprintf("%s/%s: id is %q", id, legacyConfigFileName, v1Image.ID))
+	}
+	if parent != "" && v1Image.Parent != parent {
+		problems = append(problems, fmt.Sprintf("%s/%s: parent is %q, expected %s", id, legacyConfigFileName, v1Image.Parent, parent))
+	}
+	return problems
+}
+
+// generateLegacyFiles regenerates legacy per-layer directories and the
+// repositories file of manifests, so that pre v1.10 docker load accepts the
+// archive, layers in legacy directories keep their v1 IDs, others get v1 IDs
+// computed the way docker save does and are hard linked into new directories
+func generateLegacyFiles(untarDir string, manifests []manifestItem, excludedLayers []string) ([]generatedFile, error) {
+	generated := []generatedFile{}
+	links := []generatedFile{}
+	seen := map[string]bool{}
+	repositories := legacyRepositories{}
+	for _, m := range manifests {
+		img, err := loadImageConfig(untarDir, m)
+		if err != nil {
+			return nil, err
+		}
+		v1Layers, err := img.V1Layers()
+		if err != nil {
+			return nil, err
+		}
+		if len(v1Layers) != len(m.Layers) {
+			return nil, errors.Errorf("DiffIDs in image config of %s not equal to layers exists.", configID(m))
+		}
+
+		parent := ""
+		for i, layerPath := range m.Layers {
+			v1Image := v1Layers[i].Image
+			id, legacy := legacyLayerID(layerPath)
+			if !legacy {
+				id = v1Layers[i].ID.Encoded()
+			}
+			v1Image.ID = id
+			if parent != "" {
+				v1Image.Parent = parent
+			}
+			parent = id
+			if seen[id] {
+				continue
+			}
+			seen[id] = true
+
+			content, err := json.Marshal(v1Image)
+			if err != nil {
+				return nil, err
+			}
+			generated = append(generated,
+				generatedFile{name: path.Join(id, legacyVersionFileName), content: []byte(legacyVersion)},
+				generatedFile{name: path.Join(id, legacyConfigFileName), content: content})
+			if !legacy && !slices.Contains(excludedLayers, layerPath) {
+				links = append(links, generatedFile{name: path.Join(id, legacyLayerFileName), linkname: layerPath})
+			}
+		}
+
+		for _, repoTag := range m.RepoTags {
+			ref, err := registry.ParseReference(repoTag)
+			if err != nil {
+				continue
+			}
+			if _, ok := repositories[ref.Name()]; !ok {
+				repositories[ref.Name()] = map[string]string{}
+			}
+			repositories[ref.Name()][ref.Tag] = parent
+		}
+	}
+
+	if len(repositories) > 0 {
+		content, err := json.Marshal(repositories)
+		if err != nil {
+			return nil, err
+		}
+		generated = append(generated, generatedFile{name: legacyRepositoriesFileName, content: content})
+	}
+	return append(generated, links...), nil
+}
+
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,184 @@
+package image
+
+import (
+	"context"
+	"docker-save/docker"
+	"docker-save/docker/image"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+)
+
+// untarMetadataFileName records what a kept untar dir was exported from, so that
+// reusing it by --cache-from can be validated
+const untarMetadataFileName = ".docker-save-metadata.json"
+
+type untarMetadata struct {
+	Images    []untarImageMetadata `json:"images"`
+	Platforms []string             `json:"platforms,omitempty"`
+	Created   time.Time            `json:"created"`
+}
+
+type untarImageMetadata struct {
+	Reference string `json:"reference"`
+	ID        string `json:"id"`
+}
+
+func readUntarMetadata(untarDir string) (*untarMetadata, error) {
+	content, err := os.ReadFile(filepath.Join(untarDir, untarMetadataFileName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	metadata := &untarMetadata{}
+	if err := json.Unmarshal(content, metadata); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", untarMetadataFileName)
+	}
+	return metadata, nil
+}
+
+// writeUntarMetadata records images exported into untar dir with their IDs
+// as inspected before the export
+func writeUntarMetadata(untarDir string, opts commonImageOptions, inspects []types.ImageInspect) error {
+	platforms, err := normalizePlatforms(opts.platforms)
+	if err != nil {
+		return err
+	}
+	metadata := untarMetadata{Images: []untarImageMetadata{}, Platforms: platforms, Created: time.Now().UTC()}
+	for i, inspect := range inspects {
+		metadata.Images = append(metadata.Images, untarImageMetadata{Reference: opts.images[i], ID: inspect.ID})
+	}
+
+	content, err := json.Marshal(metadata)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(untarDir, untarMetadataFileName), content, 0644)
+}
+
+// reuseCacheFrom validates --cache-from dir against images and platforms
+// requested and image IDs in docker or registry, a dir kept by docker-save is
+// exported again on mismatch, validation is skipped with a warning when docker
+// or registry is unreachable and the dir was exported for the requested images,
+// dirs without the record or holding other images are refused
+func reuseCacheFrom(ctx context.Context, dockerCli docker.Cli, opts commonImageOptions) error {
+	untarDir := opts.cacheFrom
+	metadata, err := readUntarMetadata(untarDir)
+	if err != nil {
+		return err
+	}
+	if metadata == nil {
+		return errors.Errorf("%s has no record of exported images and can not be validated, re-create it with --keep", untarDir)
+	}
+
+	problems, err := cacheFromProblems(ctx, dockerCli, metadata, opts)
+	if err != nil {
+		return err
+	}
+	if len(problems) == 0 {
+		return nil
+	}
+	for _, problem := range problems {
+		logrus.Warnf("%s is stale: %s", untarDir, problem)
+	}
+
+	logrus.Warnf("exporting images into %s again", untarDir)
+	if err := clearDir(untarDir); err != nil {
+		return err
+	}
+	return exportRecorded(ctx, dockerCli, opts, untarDir)
+}
+
+func cacheFromProblems(ctx context.Context, dockerCli docker.Cli, metadata *untarMetadata, opts commonImageOptions) ([]string, error) {
+	problems := []string{}
+	platforms, err := normalizePlatforms(opts.platforms)
+	if err != nil {
+		return nil, err
+	}
+	if fmt.Sprint(platforms) != fmt.Sprint(metadata.Platforms) {
+		problems = append(problems, fmt.Sprintf("exported for platforms %v, not %v", metadata.Platforms, platforms))
+	}
+	recorded := map[string]string{}
+	for _, img := range metadata.Images {
+		recorded[img.Reference] = img.ID
+	}
+	for _, image := range opts.images {
+		if _, ok := recorded[image]; !ok {
+			problems = append(problems, fmt.Sprintf("%s was not exported into it", image))
+		}
+	}
+	// the whole dir is archived, images not requested would be saved as well
+	for _, img := range metadata.Images {
+		if !slices.Contains(opts.images, img.Reference) {
+			return nil, errors.Errorf("refusing to reuse %s which holds %s not requested", opts.cacheFrom, img.Reference)
+		}
+	}
+
+	for _, image := range opts.images {
+		id, ok := recorded[image]
+		if !ok {
+			continue
+		}
+		inspects, err := ImageInspect(ctx, dockerCli, []string{image}, nil)
+		if isOffline(err) {
+			if len(problems) > 0 {
+				return nil, errors.Wrapf(err, "refusing to reuse %s which was not exported for the requested images", opts.cacheFrom)
+			}
+			logrus.Warnf("can not validate %s against image IDs: %v", opts.cacheFrom, err)
+			return problems, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if inspects[0].ID != id {
+			problems = append(problems, fmt.Sprintf("%s is %s now, exported %s", image, inspects[0].ID, id))
+		}
+	}
+	return problems, nil
+}
+
+// isOffline tells whether err is caused by docker or registry being unreachable
+func isOffline(err error) bool {
+	if err == nil || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return false
+	}
+	var urlErr *url.Error
+	return client.IsErrConnectionFailed(err) || errors.As(err, &urlErr)
+}
+
+func normalizePlatforms(platforms []string) ([]string, error) {
+	parsed, err := image.ParsePlatforms(platforms)
+	if err != nil {
+		return nil, err
+	}
+	normalized := []string{}
+	for _, platform := range parsed {
+		normalized = append(normalized, image.FormatPlatform(platform))
+	}
+	sort.Strings(normalized)
+	return normalized, nil
+}
+
+func clearDir(dir string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+	for _, entry := range entries {
+		if err := os.RemoveAll(filepath.Join(dir, entry.Name())); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,54 @@
+package image
+
+import (
+	"context"
+	"docker-save/docker"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestReuseCacheFromRefused(t *testing.T) {
+	tests := []struct {
+		name     string
+		metadata *untarMetadata
+		images   []string
+		want     string
+	}{
+		{
+			name:   "no record",
+			images: []string{"app:1.0"},
+			want:   "no record",
+		},
+		{
+			name: "images not requested",
+			metadata: &untarMetadata{Images: []untarImageMetadata{
+				{Reference: "app:1.0", ID: "sha256:a"},
+				{Reference: "db:1.0", ID: "sha256:b"},
+			}},
+			images: []string{"app:1.0"},
+			want:   "holds db:1.0 not requested",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.metadata != nil {
+				content, err := json.Marshal(tt.metadata)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(filepath.Join(dir, untarMetadataFileName), content, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			opts := commonImageOptions{images: tt.images, cacheFrom: dir}
+			err := reuseCacheFrom(context.Background(), docker.NewDockerCli(), opts)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("error %v, want %q", err, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,269 @@
+package image
+
+import (
+	"docker-save/docker/registry"
+	"encoding/json"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slices"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Docker 25+ writes an OCI image layout along with manifest.json, where
+// configs and layers are content addressed blobs/<alg>/<hex> files
+const (
+	ociIndexFileName  = "index.json"
+	ociLayoutFileName = ocispec.ImageLayoutFile
+	ociBlobsDir       = ocispec.ImageBlobsDir
+
+	// containerd and docker store full image name in this annotation
+	containerdImageNameAnnotation = "io.containerd.image.name"
+)
+
+func isOCILayout(untarDir string) bool {
+	_, err := os.Stat(filepath.Join(untarDir, ociLayoutFileName))
+	return err == nil
+}
+
+func blobPath(dgst digest.Digest) string {
+	return path.Join(ociBlobsDir, dgst.Algorithm().String(), dgst.Encoded())
+}
+
+// configID returns the hex image ID of manifest item, config file is named
+// <hex>.json in legacy archives and blobs/sha256/<hex> in OCI layouts
+func configID(m manifestItem) string {
+	return strings.TrimSuffix(path.Base(m.Config), ".json")
+}
+
+func readOCIBlob(untarDir string, dgst digest.Digest, v interface{}) error {
+	blob, err := safePath(untarDir, blobPath(dgst))
+	if err != nil {
+		return err
+	}
+	content, err := os.ReadFile(blob)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(content, v)
+}
+
+func readOCIIndex(untarDir string) (ocispec.Index, error) {
+	var index ocispec.Index
+	content, err := os.ReadFile(filepath.Join(untarDir, ociIndexFileName))
+	if err != nil {
+		return index, err
+	}
+	if err := json.Unmarshal(content, &index); err != nil {
+		return index, errors.Wrapf(err, "invalid %s", ociIndexFileName)
+	}
+	return index, nil
+}
+
+// walkOCIManifests calls fn with each image manifest referenced by desc,
+// descending into nested indexes, manifests whose blobs are absent are skipped
+func walkOCIManifests(untarDir string, desc ocispec.Descriptor, fn func(ocispec.Manifest) error) error {
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, registry.MediaTypeDockerManifestList:
+		var index ocispec.Index
+		if err := readOCIBlob(untarDir, desc.Digest, &index); err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				return nil
+			}
+			return err
+		}
+		for _, child := range index.Manifests {
+			if err := walkOCIManifests(untarDir, child, fn); err != nil {
+				return err
+			}
+		}
+		return nil
+	case ocispec.MediaTypeImageManifest, registry.MediaTypeDockerManifest:
+		var manifest ocispec.Manifest
+		if err := readOCIBlob(untarDir, desc.Digest, &manifest); err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				return nil
+			}
+			return err
+		}
+		return fn(manifest)
+	default:
+		return nil
+	}
+}
+
+// manifestsFromOCIIndex derives manifest items from index.json for OCI layouts
+// without manifest.json
+func manifestsFromOCIIndex(untarDir string) ([]manifestItem, error) {
+	index, err := readOCIIndex(untarDir)
+	if err != nil {
+		return nil, err
+	}
+	manifests := []manifestItem{}
+	for _, desc := range index.Manifests {
+		repoTags := []string{}
+		if repoTag := ociRepoTag(desc); repoTag != "" {
+			repoTags = append(repoTags, repoTag)
+		}
+		err := walkOCIManifests(untarDir, desc, func(manifest ocispec.Manifest) error {
+			item := manifestItem{Config: blobPath(manifest.Config.Digest), RepoTags: repoTags}
+			for _, layer := range manifest.Layers {
+				item.Layers = append(item.Layers, blobPath(layer.Digest))
+			}
+			manifests = append(manifests, item)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return manifests, nil
+}
+
+func ociRepoTag(desc ocispec.Descriptor) string {
+	name := desc.Annotations[containerdImageNameAnnotation]
+	if name == "" {
+		name = desc.Annotations[ocispec.AnnotationRefName]
+	}
+	if name == "" {
+		return ""
+	}
+	ref, err := registry.ParseReference(name)
+	if err != nil {
+		return ""
+	}
+	return ref.RepoTag()
+}
+
+// ociBlobs returns blobs of desc and of the indexes, manifests and configs it
+// references, absent blobs are skipped
+func ociBlobs(untarDir string, desc ocispec.Descriptor) ([]string, error) {
+	blobs := []string{}
+	switch desc.MediaType {
+	case ocispec.MediaTypeImageIndex, registry.MediaTypeDockerManifestList:
+		var index ocispec.Index
+		if err := readOCIBlob(untarDir, desc.Digest, &index); err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				return blobs, nil
+			}
+			return nil, err
+		}
+		blobs = append(blobs, blobPath(desc.Digest))
+		for _, child := range index.Manifests {
+			childBlobs, err := ociBlobs(untarDir, child)
+			if err != nil {
+				return nil, err
+			}
+			blobs = append(blobs, childBlobs...)
+		}
+	case ocispec.MediaTypeImageManifest, registry.MediaTypeDockerManifest:
+		var manifest ocispec.Manifest
+		if err := readOCIBlob(untarDir, desc.Digest, &manifest); err != nil {
+			if os.IsNotExist(errors.Cause(err)) {
+				return blobs, nil
+			}
+			return nil, err
+		}
+		blobs = append(blobs, blobPath(desc.Digest), blobPath(manifest.Config.Digest))
+	}
+	return blobs, nil
+}
+
+// excludesLayers tells whether any layer of manifests is excluded
+func excludesLayers(manifests []manifestItem, excluded []string) bool {
+	for _, m := range manifests {
+		for _, layer := range m.Layers {
+			if slices.Contains(excluded, layer) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// ociLayoutFiles returns index.json, oci-layout and the index and manifest
+// blobs they reference, for leaving the OCI layout out of partial archives, as
+// OCI manifests must reference all of their layers, configs of manifests are
+// kept for manifest.json
+func ociLayoutFiles(untarDir string, manifests []manifestItem) ([]string, error) {
+	index, err := readOCIIndex(untarDir)
+	if err != nil {
+		return nil, err
+	}
+	keptConfigs := map[string]bool{}
+	for _, m := range manifests {
+		keptConfigs[m.Config] = true
+	}
+	files := []string{ociIndexFileName, ociLayoutFileName}
+	for _, desc := range index.Manifests {
+		blobs, err := ociBlobs(untarDir, desc)
+		if err != nil {
+			return nil, err
+		}
+		for _, blob := range blobs {
+			if !keptConfigs[blob] && !slices.Contains(files, blob) {
+				files = append(files, blob)
+			}
+		}
+	}
+	return files, nil
+}
+
+// pruneOCIIndex drops index.json entries which reference none of kept
+// manifests, returns the pruned index.json and blobs only used by dropped
+// entries, their nested indexes, manifests and configs
+func pruneOCIIndex(untarDir string, kept []manifestItem) ([]byte, []string, error) {
+	index, err := readOCIIndex(untarDir)
+	if err != nil {
+		return nil, nil, err
+	}
+	keptConfigs := map[string]bool{}
+	for _, m := range kept {
+		keptConfigs[m.Config] = true
+	}
+
+	manifests := []ocispec.Descriptor{}
+	keptBlobs := map[string]bool{}
+	droppedBlobs := []string{}
+	for _, desc := range index.Manifests {
+		keep := false
+		err := walkOCIManifests(untarDir, desc, func(manifest ocispec.Manifest) error {
+			if keptConfigs[blobPath(manifest.Config.Digest)] {
+				keep = true
+			}
+			return nil
+		})
+		if err != nil {
+			return nil, nil, err
+		}
+		blobs, err := ociBlobs(untarDir, desc)
+		if err != nil {
+			return nil, nil, err
+		}
+		if keep {
+			manifests = append(manifests, desc)
+			for _, blob := range blobs {
+				keptBlobs[blob] = true
+			}
+		} else {
+			droppedBlobs = append(droppedBlobs, blobPath(desc.Digest))
+			droppedBlobs = append(droppedBlobs, blobs...)
+		}
+	}
+	index.Manifests = manifests
+	dropped := []string{}
+	for _, blob := range droppedBlobs {
+		if !keptBlobs[blob] && !keptConfigs[blob] && !slices.Contains(dropped, blob) {
+			dropped = append(dropped, blob)
+		}
+	}
+
+	content, err := json.Marshal(index)
+	if err != nil {
+		return nil, nil, err
+	}
+	return content, dropped, nil
+}
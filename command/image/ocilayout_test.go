@@ -0,0 +1,132 @@
+package image
+
+import (
+	"encoding/json"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/exp/slices"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// writeOCIBlob stores v as a blob of the OCI layout in dir
+func writeOCIBlob(t *testing.T, dir string, mediaType string, v interface{}) ocispec.Descriptor {
+	t.Helper()
+	content, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	dgst := digest.FromBytes(content)
+	file := filepath.Join(dir, filepath.FromSlash(blobPath(dgst)))
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(file, content, 0644); err != nil {
+		t.Fatal(err)
+	}
+	return ocispec.Descriptor{MediaType: mediaType, Digest: dgst, Size: int64(len(content))}
+}
+
+// writeOCIImage stores the manifest and config of an image of one layer,
+// returns the manifest descriptor and its manifest.json item
+func writeOCIImage(t *testing.T, dir string, name string) (ocispec.Descriptor, manifestItem) {
+	t.Helper()
+	layer := digest.FromString(name)
+	config := writeOCIBlob(t, dir, ocispec.MediaTypeImageConfig, ocispec.Image{
+		Platform: testPlatform,
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: []digest.Digest{layer}},
+	})
+	desc := writeOCIBlob(t, dir, ocispec.MediaTypeImageManifest, ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+		Config:    config,
+		Layers:    []ocispec.Descriptor{{MediaType: ocispec.MediaTypeImageLayer, Digest: layer}},
+	})
+	return desc, manifestItem{
+		Config:   blobPath(config.Digest),
+		RepoTags: []string{name + ":latest"},
+		Layers:   []string{blobPath(layer)},
+	}
+}
+
+// writeOCILayout writes an OCI layout of app, as a manifest, and of other,
+// nested in an index
+func writeOCILayout(t *testing.T) (string, manifestItem, manifestItem) {
+	t.Helper()
+	dir := t.TempDir()
+	appDesc, app := writeOCIImage(t, dir, "app")
+	otherDesc, other := writeOCIImage(t, dir, "other")
+	otherIndex := writeOCIBlob(t, dir, ocispec.MediaTypeImageIndex, ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{otherDesc},
+	})
+	index, err := json.Marshal(ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+		Manifests: []ocispec.Descriptor{appDesc, otherIndex},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ociIndexFileName), index, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, ociLayoutFileName), []byte(`{"imageLayoutVersion":"1.0.0"}`), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return dir, app, other
+}
+
+func TestPruneOCIIndex(t *testing.T) {
+	dir, app, other := writeOCILayout(t)
+
+	content, dropped, err := pruneOCIIndex(dir, []manifestItem{app})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var index ocispec.Index
+	if err := json.Unmarshal(content, &index); err != nil {
+		t.Fatal(err)
+	}
+	if len(index.Manifests) != 1 || index.Manifests[0].MediaType != ocispec.MediaTypeImageManifest {
+		t.Fatalf("index entries %+v, want the manifest of app", index.Manifests)
+	}
+	// index and manifest of other and its config
+	if len(dropped) != 3 || !slices.Contains(dropped, other.Config) {
+		t.Errorf("dropped %v, want index, manifest and config of other", dropped)
+	}
+	if slices.Contains(dropped, app.Config) || slices.Contains(dropped, blobPath(index.Manifests[0].Digest)) {
+		t.Errorf("dropped %v, blobs of app", dropped)
+	}
+}
+
+func TestGenerateIndexFilesOfPartialOCILayout(t *testing.T) {
+	dir, app, other := writeOCILayout(t)
+
+	tests := []struct {
+		name     string
+		excluded []string
+		index    bool
+	}{
+		{"all layers", nil, true},
+		{"layers excluded", app.Layers, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			generated, unused, err := generateIndexFiles(dir, []manifestItem{app}, tt.excluded)
+			if err != nil {
+				t.Fatal(err)
+			}
+			index := slices.ContainsFunc(generated, func(f generatedFile) bool { return f.name == ociIndexFileName })
+			if index != tt.index || slices.Contains(unused, ociIndexFileName) == tt.index || slices.Contains(unused, ociLayoutFileName) == tt.index {
+				t.Errorf("generated %v, unused %v, want index.json %t", generated, unused, tt.index)
+			}
+			if !slices.Contains(unused, other.Config) || slices.Contains(unused, app.Config) {
+				t.Errorf("unused %v, want config of other only", unused)
+			}
+		})
+	}
+}
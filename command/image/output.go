@@ -0,0 +1,98 @@
+package image
+
+import (
+	"bytes"
+	"docker-save/docker/image"
+	"docker-save/docker/utils"
+	"encoding/json"
+	"fmt"
+	"github.com/opencontainers/go-digest"
+	"golang.org/x/exp/slices"
+	"os"
+	"path/filepath"
+)
+
+const (
+	checksumSuffix     = ".sha256"
+	jsonManifestSuffix = ".manifest.json"
+)
+
+// archiveManifest describes images and layers in a saved archive, written
+// next to it by --json-manifest
+type archiveManifest struct {
+	Archive string                 `json:"archive"`
+	Digest  digest.Digest          `json:"digest"`
+	Size    int64                  `json:"size"`
+	Images  []archiveManifestImage `json:"images"`
+}
+
+type archiveManifestImage struct {
+	RepoTags []string               `json:"repoTags"`
+	ID       digest.Digest          `json:"id"`
+	Platform string                 `json:"platform,omitempty"`
+	Layers   []archiveManifestLayer `json:"layers"`
+}
+
+type archiveManifestLayer struct {
+	DiffID   digest.Digest `json:"diffID"`
+	Path     string        `json:"path"`
+	Size     int64         `json:"size,omitempty"`
+	Included bool          `json:"included"`
+}
+
+// writeChecksum writes sidecar of output in the format of sha256sum listing
+// files written, output itself or its volumes, after they are complete
+func writeChecksum(output string, files []splitVolume) error {
+	content := ""
+	for _, file := range files {
+		content += fmt.Sprintf("%s  %s\n", file.Digest.Encoded(), file.Name)
+	}
+	return utils.WriteFileAtomic(output+checksumSuffix, bytes.NewReader([]byte(content)), 0644)
+}
+
+// writeJSONManifest writes sidecar of output describing images in manifests,
+// with layers in excludedLayers marked as not included
+func writeJSONManifest(output string, dgst digest.Digest, size int64, untarDir string, manifests []manifestItem, excludedLayers []string) error {
+	described := archiveManifest{Archive: filepath.Base(output), Digest: dgst, Size: size, Images: []archiveManifestImage{}}
+	for _, m := range manifests {
+		img, err := loadImageConfig(untarDir, m)
+		if err != nil {
+			return err
+		}
+		described.Images = append(described.Images, describeImage(untarDir, m, img, excludedLayers))
+	}
+
+	content, err := json.MarshalIndent(described, "", "  ")
+	if err != nil {
+		return err
+	}
+	return utils.WriteFileAtomic(output+jsonManifestSuffix, bytes.NewReader(append(content, '\n')), 0644)
+}
+
+func describeImage(untarDir string, m manifestItem, img *image.Image, excludedLayers []string) archiveManifestImage {
+	described := archiveManifestImage{
+		RepoTags: m.RepoTags,
+		ID:       digest.NewDigestFromEncoded(digest.SHA256, configID(m)),
+		Layers:   []archiveManifestLayer{},
+	}
+	if described.RepoTags == nil {
+		described.RepoTags = []string{}
+	}
+	if platform := img.Platform(); platform.OS != "" {
+		described.Platform = image.FormatPlatform(platform)
+	}
+	for i, layerPath := range m.Layers {
+		layer := archiveManifestLayer{Path: layerPath, Included: !slices.Contains(excludedLayers, layerPath)}
+		if i < len(img.RootFS.DiffIDs) {
+			layer.DiffID = img.RootFS.DiffIDs[i]
+		}
+		// layers of registry images excluded are never downloaded
+		if target, err := safePath(untarDir, layerPath); err == nil {
+			if stat, err := os.Stat(target); err == nil {
+				layer.Size = stat.Size()
+			}
+		}
+		described.Layers = append(described.Layers, layer)
+	}
+	return described
+}
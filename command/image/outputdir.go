@@ -0,0 +1,83 @@
+package image
+
+import (
+	"bytes"
+	"docker-save/docker/registry"
+	"github.com/pkg/errors"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"text/template"
+)
+
+const defaultNameTemplate = "{{.Name}}.tar"
+
+// archiveName is the data of --name-template for an image
+type archiveName struct {
+	// Name is the image simplified like the names of temp dirs, e.g. app_1.0
+	Name string
+	// Repo is the familiar repository with slashes replaced, e.g. org_app
+	Repo string
+	// Tag is the tag of image, latest if omitted, empty if referred by digest
+	Tag string
+	// Index is the position of image in arguments, starting from 1
+	Index int
+}
+
+func newArchiveName(image string, index int) archiveName {
+	name := archiveName{Name: simplifyImageStr(registry.TrimScheme(image)), Index: index}
+	if ref, err := registry.ParseReference(image); err == nil && !strings.HasPrefix(image, "sha256:") {
+		name.Repo = strings.NewReplacer("/", "_", ":", "_").Replace(ref.Name())
+		name.Tag = ref.Tag
+	} else {
+		name.Repo = name.Name
+	}
+	return name
+}
+
+// perImageSaveOptions splits opts of --output-dir into options saving each image
+// into its own archive named by --name-template, with its --last value
+func perImageSaveOptions(opts saveOptions) ([]saveOptions, error) {
+	if opts.output != "" {
+		return nil, errors.New("--output-dir and -o can not be used together")
+	}
+	if opts.cacheFrom != "" {
+		return nil, errors.New("--output-dir and --cache-from can not be used together, use --cache instead")
+	}
+	tmpl, err := template.New("name").Option("missingkey=error").Parse(opts.nameTemplate)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid --name-template")
+	}
+
+	perImage := []saveOptions{}
+	outputs := map[string]string{}
+	for i, image := range opts.images {
+		var name bytes.Buffer
+		if err := tmpl.Execute(&name, newArchiveName(image, i+1)); err != nil {
+			return nil, errors.Wrap(err, "invalid --name-template")
+		}
+		if name.Len() == 0 || name.String() == "." || name.String() == ".." || strings.ContainsAny(name.String(), `/\`) {
+			return nil, errors.Errorf("--name-template gives invalid file name %q for %s", name.String(), image)
+		}
+		output := filepath.Join(opts.outputDir, name.String())
+		if other, ok := outputs[output]; ok {
+			return nil, errors.Errorf("--name-template gives the same file name %s for %s and %s", name.String(), other, image)
+		}
+		outputs[output] = image
+
+		imageOpts := opts
+		imageOpts.images = []string{image}
+		imageOpts.output = output
+		imageOpts.outputDir = ""
+		imageOpts.perImage = true
+		if opts.last != "" && !strings.Contains(opts.last, "=") {
+			last, err := findLastValue(i, opts)
+			if err != nil {
+				return nil, errors.Wrapf(err, "invalid --last for %s", image)
+			}
+			imageOpts.last = strconv.Itoa(last)
+		}
+		perImage = append(perImage, imageOpts)
+	}
+	return perImage, nil
+}
@@ -0,0 +1,42 @@
+package image
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+func TestPerImageSaveOptionsNames(t *testing.T) {
+	tests := []struct {
+		template string
+		want     string
+		wantErr  bool
+	}{
+		{template: defaultNameTemplate, want: "app_1.0.tar"},
+		{template: "{{.Index}}-{{.Repo}}-{{.Tag}}.tar", want: "1-org_app-1.0.tar"},
+		{template: "", wantErr: true},
+		{template: ".", wantErr: true},
+		{template: "..", wantErr: true},
+		{template: "../{{.Name}}.tar", wantErr: true},
+		{template: `{{.Name}}\x.tar`, wantErr: true},
+		{template: "{{.Missing}}", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.template, func(t *testing.T) {
+			opts := saveOptions{outputDir: "out", nameTemplate: tt.template}
+			opts.images = []string{"org/app:1.0"}
+			perImage, err := perImageSaveOptions(opts)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("name %s accepted", perImage[0].output)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if perImage[0].output != filepath.Join("out", tt.want) {
+				t.Errorf("output %s, want %s", perImage[0].output, filepath.Join("out", tt.want))
+			}
+		})
+	}
+}
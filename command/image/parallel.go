@@ -0,0 +1,195 @@
+package image
+
+import (
+	"context"
+	"docker-save/docker"
+	"docker-save/docker/utils"
+	"encoding/json"
+	"github.com/docker/docker/api/types"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"golang.org/x/exp/slices"
+	"io/fs"
+	"os"
+	"path/filepath"
+)
+
+// parallelExport returns an export func saving each image from docker on its
+// own, at most n at a time, merged into untar dir with shared files kept once
+func parallelExport(n int) func(context.Context, docker.Cli, []string, []ocispec.Platform, string) error {
+	return func(ctx context.Context, dockerCli docker.Cli, images []string, platforms []ocispec.Platform, unTarDir string) error {
+		exportDirs := make([]string, len(images))
+		defer func() {
+			for _, dir := range exportDirs {
+				if dir != "" {
+					os.RemoveAll(dir)
+				}
+			}
+		}()
+		for i := range images {
+			dir, err := os.MkdirTemp(unTarDir, ".export-")
+			if err != nil {
+				return err
+			}
+			exportDirs[i] = dir
+		}
+
+		err := utils.Parallel(ctx, n, len(images), func(ctx context.Context, i int) error {
+			return doExportAndUntar(ctx, dockerCli, images[i:i+1], platforms, exportDirs[i])
+		})
+		if err != nil {
+			return err
+		}
+		for _, dir := range exportDirs {
+			if err := mergeUntarDir(dir, unTarDir); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// mergeUntarDir moves files of src into dst, keeping those dst already has
+// which are the same for content addressed configs and layers, and merges
+// manifest.json, index.json and repositories
+func mergeUntarDir(src string, dst string) error {
+	// index files of src refer to blobs, read them before moving
+	manifests, err := ResolveManifests(src)
+	if err != nil {
+		return err
+	}
+	var index *ocispec.Index
+	if isOCILayout(src) {
+		srcIndex, err := readOCIIndex(src)
+		if err != nil {
+			return err
+		}
+		index = &srcIndex
+	}
+	repositories, err := readLegacyRepositories(src)
+	if err != nil {
+		return err
+	}
+
+	err = filepath.WalkDir(src, func(file string, entry fs.DirEntry, err error) error {
+		if err != nil || entry.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(src, file)
+		if err != nil {
+			return err
+		}
+		switch filepath.ToSlash(rel) {
+		case manifestFileName, ociIndexFileName, legacyRepositoriesFileName:
+			return nil
+		}
+		target := filepath.Join(dst, rel)
+		if _, err := os.Lstat(target); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		return os.Rename(file, target)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err := mergeManifests(dst, manifests); err != nil {
+		return err
+	}
+	if index != nil {
+		if err := mergeOCIIndex(dst, *index); err != nil {
+			return err
+		}
+	}
+	if repositories != nil {
+		return mergeLegacyRepositories(dst, repositories)
+	}
+	return nil
+}
+
+func mergeManifests(dst string, manifests []manifestItem) error {
+	merged := []manifestItem{}
+	if _, err := os.Stat(filepath.Join(dst, manifestFileName)); err == nil {
+		if merged, err = ResolveManifests(dst); err != nil {
+			return err
+		}
+	}
+	for _, m := range manifests {
+		i := slices.IndexFunc(merged, func(existing manifestItem) bool { return existing.Config == m.Config })
+		if i < 0 {
+			merged = append(merged, m)
+			continue
+		}
+		for _, repoTag := range m.RepoTags {
+			if !slices.Contains(merged[i].RepoTags, repoTag) {
+				merged[i].RepoTags = append(merged[i].RepoTags, repoTag)
+			}
+		}
+	}
+	return writeManifests(dst, merged)
+}
+
+func mergeOCIIndex(dst string, index ocispec.Index) error {
+	merged, err := readOCIIndex(dst)
+	if os.IsNotExist(err) {
+		merged = index
+	} else if err != nil {
+		return err
+	} else {
+		for _, desc := range index.Manifests {
+			if !slices.ContainsFunc(merged.Manifests, func(existing ocispec.Descriptor) bool {
+				return existing.Digest == desc.Digest &&
+					existing.Annotations[containerdImageNameAnnotation] == desc.Annotations[containerdImageNameAnnotation]
+			}) {
+				merged.Manifests = append(merged.Manifests, desc)
+			}
+		}
+	}
+	content, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dst, ociIndexFileName), content, 0644)
+}
+
+func mergeLegacyRepositories(dst string, repositories legacyRepositories) error {
+	merged, err := readLegacyRepositories(dst)
+	if err != nil {
+		return err
+	}
+	if merged == nil {
+		merged = legacyRepositories{}
+	}
+	for name, tags := range repositories {
+		if merged[name] == nil {
+			merged[name] = map[string]string{}
+		}
+		for tag, id := range tags {
+			merged[name][tag] = id
+		}
+	}
+	content, err := json.Marshal(merged)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(dst, legacyRepositoriesFileName), content, 0644)
+}
+
+// imageInspectParallel inspects images like ImageInspect, at most n at a time
+func imageInspectParallel(ctx context.Context, dockerCli docker.Cli, images []string, platform *ocispec.Platform, n int) ([]types.ImageInspect, error) {
+	inspects := make([]types.ImageInspect, len(images))
+	err := utils.Parallel(ctx, n, len(images), func(ctx context.Context, i int) error {
+		result, err := ImageInspect(ctx, dockerCli, images[i:i+1], platform)
+		if err != nil {
+			return err
+		}
+		inspects[i] = result[0]
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return inspects, nil
+}
@@ -0,0 +1,267 @@
+package image
+
+import (
+	"context"
+	"docker-save/docker"
+	"docker-save/docker/image"
+	"docker-save/docker/layer"
+	"docker-save/docker/registry"
+	"encoding/json"
+	"github.com/docker/docker/api/types"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slices"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+)
+
+// registrySourceFileName records layers of registry images which are not
+// downloaded into untar dir until they survive filtering
+const registrySourceFileName = ".registry-source.json"
+
+// registryLayerSource tells where a layer file of untar dir comes from
+type registryLayerSource struct {
+	Image      string             `json:"image"`
+	Descriptor ocispec.Descriptor `json:"descriptor"`
+}
+
+func hasRegistryImages(images []string) bool {
+	return slices.ContainsFunc(images, registry.IsReference)
+}
+
+func splitRegistryImages(images []string) ([]string, []string) {
+	daemonImages := []string{}
+	registryImages := []string{}
+	for _, image := range images {
+		if registry.IsReference(image) {
+			registryImages = append(registryImages, image)
+		} else {
+			daemonImages = append(daemonImages, image)
+		}
+	}
+	return daemonImages, registryImages
+}
+
+// resolveRegistryImage resolves image for platform, default platform if nil
+func resolveRegistryImage(ctx context.Context, dockerCli docker.Cli, image string, platform *ocispec.Platform) (*registry.Image, error) {
+	ref, err := registry.ParseReference(image)
+	if err != nil {
+		return nil, err
+	}
+	if platform == nil {
+		defaultPlatform := registry.DefaultPlatform()
+		platform = &defaultPlatform
+	}
+	return dockerCli.RegistryClient(ref.Host).ResolveImage(ctx, ref, *platform)
+}
+
+// registryImageInspect builds inspect info of a registry image from its manifest and config
+func registryImageInspect(ctx context.Context, dockerCli docker.Cli, image string, platform *ocispec.Platform) (types.ImageInspect, error) {
+	inspect := types.ImageInspect{}
+	img, err := resolveRegistryImage(ctx, dockerCli, image, platform)
+	if err != nil {
+		return inspect, err
+	}
+	config, err := imageConfigFromJSON(img.Config)
+	if err != nil {
+		return inspect, err
+	}
+
+	inspect.ID = img.Manifest.Config.Digest.String()
+	inspect.RepoTags = []string{img.Reference.String()}
+	inspect.RepoDigests = []string{img.Reference.Name() + "@" + img.Descriptor.Digest.String()}
+	inspect.Size = img.Size()
+	inspect.Os = config.OS
+	inspect.Architecture = config.Architecture
+	inspect.Variant = config.Variant
+	inspect.RootFS.Type = config.RootFS.Type
+	for _, diffID := range config.RootFS.DiffIDs {
+		inspect.RootFS.Layers = append(inspect.RootFS.Layers, diffID.String())
+	}
+	return inspect, nil
+}
+
+func imageConfigFromJSON(config []byte) (*image.Image, error) {
+	img, err := image.NewFromJSON(config)
+	if err != nil {
+		return nil, errors.Wrap(err, "invalid image config")
+	}
+	return img, nil
+}
+
+// fetchRegistryImages adds manifests and configs of registry images to untarDir,
+// one for each of platforms, layers are only recorded in registry source file to
+// be downloaded on demand
+func fetchRegistryImages(ctx context.Context, dockerCli docker.Cli, images []string, platforms []ocispec.Platform, untarDir string) error {
+	manifests := []manifestItem{}
+	if _, err := os.Stat(filepath.Join(untarDir, manifestFileName)); err == nil {
+		if manifests, err = ResolveManifests(untarDir); err != nil {
+			return err
+		}
+	}
+	sources, err := readRegistryLayerSources(untarDir)
+	if err != nil {
+		return err
+	}
+
+	if len(platforms) == 0 {
+		platforms = []ocispec.Platform{registry.DefaultPlatform()}
+	}
+	for _, image := range images {
+		for _, platform := range platforms {
+			item, err := fetchRegistryImage(ctx, dockerCli, image, platform, untarDir, sources)
+			if err != nil {
+				return err
+			}
+			manifests = append(manifests, item)
+		}
+	}
+
+	if err := writeRegistryLayerSources(untarDir, sources); err != nil {
+		return err
+	}
+	return writeManifests(untarDir, manifests)
+}
+
+func fetchRegistryImage(ctx context.Context, dockerCli docker.Cli, image string, platform ocispec.Platform, untarDir string, sources map[string]registryLayerSource) (manifestItem, error) {
+	img, err := resolveRegistryImage(ctx, dockerCli, image, &platform)
+	if err != nil {
+		return manifestItem{}, err
+	}
+	configFile := img.Manifest.Config.Digest.Encoded() + ".json"
+	if err := os.WriteFile(filepath.Join(untarDir, configFile), img.Config, 0644); err != nil {
+		return manifestItem{}, err
+	}
+
+	item := manifestItem{Config: configFile}
+	if repoTag := img.Reference.RepoTag(); repoTag != "" {
+		item.RepoTags = []string{repoTag}
+	}
+	for _, layer := range img.Manifest.Layers {
+		layerPath := path.Join(layer.Digest.Encoded(), legacyLayerFileName)
+		item.Layers = append(item.Layers, layerPath)
+		sources[layerPath] = registryLayerSource{Image: image, Descriptor: layer}
+	}
+	return item, nil
+}
+
+func readRegistryLayerSources(untarDir string) (map[string]registryLayerSource, error) {
+	sources := map[string]registryLayerSource{}
+	content, err := os.ReadFile(filepath.Join(untarDir, registrySourceFileName))
+	if os.IsNotExist(err) {
+		return sources, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(content, &sources); err != nil {
+		return nil, errors.Wrapf(err, "invalid %s", registrySourceFileName)
+	}
+	return sources, nil
+}
+
+func writeRegistryLayerSources(untarDir string, sources map[string]registryLayerSource) error {
+	content, err := json.Marshal(sources)
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(filepath.Join(untarDir, registrySourceFileName), content, 0644)
+}
+
+// downloadRegistryLayers downloads registry layers which are not excluded
+func downloadRegistryLayers(ctx context.Context, dockerCli docker.Cli, untarDir string, excludedLayers []string) error {
+	sources, err := readRegistryLayerSources(untarDir)
+	if err != nil {
+		return err
+	}
+	for layerPath, source := range sources {
+		if slices.Contains(excludedLayers, layerPath) {
+			continue
+		}
+		target, err := safePath(untarDir, layerPath)
+		if err != nil {
+			return err
+		}
+		if _, err := os.Stat(target); err == nil {
+			continue
+		}
+		if err := downloadRegistryLayer(ctx, dockerCli, source, target); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func downloadRegistryLayer(ctx context.Context, dockerCli docker.Cli, source registryLayerSource, target string) error {
+	ref, err := registry.ParseReference(source.Image)
+	if err != nil {
+		return err
+	}
+	blob, _, err := dockerCli.RegistryClient(ref.Host).GetBlob(ctx, ref.Repository, source.Descriptor.Digest)
+	if err != nil {
+		return err
+	}
+	defer blob.Close()
+
+	if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+		return err
+	}
+	partial := target + ".partial"
+	file, err := os.Create(partial)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(partial)
+
+	verifier := source.Descriptor.Digest.Verifier()
+	_, err = io.Copy(io.MultiWriter(file, verifier), blob)
+	if closeErr := file.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return errors.Wrapf(err, "download layer %s", source.Descriptor.Digest)
+	}
+	if !verifier.Verified() {
+		return errors.Errorf("layer %s of %s failed digest verification", source.Descriptor.Digest, source.Image)
+	}
+	return os.Rename(partial, target)
+}
+
+// layerSize returns uncompressed size of the layer file, or size of the
+// registry blob from its manifest when it is not downloaded, which is
+// compressed, telling which
+func layerSize(untarDir string, layerPath string, sources map[string]registryLayerSource) (int64, bool, error) {
+	target, err := safePath(untarDir, layerPath)
+	if err != nil {
+		return 0, false, err
+	}
+	_, err = os.Stat(target)
+	if source, ok := sources[layerPath]; ok && os.IsNotExist(err) {
+		return source.Descriptor.Size, true, nil
+	}
+	if err != nil {
+		return 0, false, err
+	}
+	size, err := layer.UncompressedSize(target)
+	return size, false, err
+}
+
+// uncompressedLayerSize returns uncompressed size of the layer file, registry
+// layers not downloaded yet are downloaded into untar dir first, as registries
+// only tell compressed sizes
+func uncompressedLayerSize(ctx context.Context, dockerCli docker.Cli, untarDir string, layerPath string, sources map[string]registryLayerSource) (int64, error) {
+	target, err := safePath(untarDir, layerPath)
+	if err != nil {
+		return 0, err
+	}
+	_, err = os.Stat(target)
+	if source, ok := sources[layerPath]; ok && os.IsNotExist(err) {
+		err = downloadRegistryLayer(ctx, dockerCli, source, target)
+	}
+	if err != nil {
+		return 0, err
+	}
+	return layer.UncompressedSize(target)
+}
@@ -0,0 +1,144 @@
+package image
+
+import (
+	"archive/tar"
+	"bytes"
+	"context"
+	"docker-save/docker"
+	"docker-save/docker/registry"
+	"docker-save/docker/registry/registrytest"
+	"encoding/json"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/spf13/cobra"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var testPlatform = ocispec.Platform{OS: "linux", Architecture: "amd64"}
+
+// layerTar builds an uncompressed layer of files by name
+func layerTar(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for name, content := range files {
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// readArchive reads entries of a tar archive by name
+func readArchive(t *testing.T, file string) map[string][]byte {
+	t.Helper()
+	f, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	entries := map[string][]byte{}
+	tr := tar.NewReader(f)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		content, err := io.ReadAll(tr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		entries[hdr.Name] = content
+	}
+}
+
+func archiveManifests(t *testing.T, entries map[string][]byte) []manifestItem {
+	t.Helper()
+	manifests := []manifestItem{}
+	if err := json.Unmarshal(entries[manifestFileName], &manifests); err != nil {
+		t.Fatal(err)
+	}
+	return manifests
+}
+
+// runCommand runs cmd with args, as from the command line
+func runCommand(cmd *cobra.Command, args ...string) error {
+	cmd.SetArgs(args)
+	cmd.SilenceUsage = true
+	cmd.SilenceErrors = true
+	return cmd.ExecuteContext(context.Background())
+}
+
+func TestSaveRegistryImage(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	img := r.AddImage("app", "1.0", testPlatform,
+		layerTar(t, map[string]string{"base": "base"}),
+		layerTar(t, map[string]string{"app": "app"}))
+	ref := registry.Scheme + r.Host() + "/app:1.0"
+
+	tests := []struct {
+		name   string
+		args   []string
+		layers int
+	}{
+		{"all layers", nil, 2},
+		{"last layer", []string{"--last", "1"}, 1},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			output := filepath.Join(dir, "app.tar")
+			args := append([]string{"-w", dir, "-o", output, ref}, tt.args...)
+			if err := runCommand(NewSaveCommand(docker.NewDockerCli()), args...); err != nil {
+				t.Fatal(err)
+			}
+
+			entries := readArchive(t, output)
+			manifests := archiveManifests(t, entries)
+			if len(manifests) != 1 || len(manifests[0].Layers) != 2 {
+				t.Fatalf("manifests %+v, want one image of 2 layers", manifests)
+			}
+			found := 0
+			for _, layer := range manifests[0].Layers {
+				if _, ok := entries[layer]; ok {
+					found++
+				}
+			}
+			if found != tt.layers {
+				t.Errorf("%d layers in archive, want %d", found, tt.layers)
+			}
+			if _, ok := entries[img.Manifest.Config.Digest.Encoded()+".json"]; !ok {
+				t.Error("config missing from archive")
+			}
+		})
+	}
+}
+
+func TestStatsRegistryImageDownloadsNoLayers(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	r.AddImage("app", "1.0", testPlatform,
+		layerTar(t, map[string]string{"base": "base"}),
+		layerTar(t, map[string]string{"app": "app"}))
+
+	args := []string{"-w", t.TempDir(), registry.Scheme + r.Host() + "/app:1.0", "--max-layer-size", "1GB"}
+	if err := runCommand(NewStatsCommand(docker.NewDockerCli()), args...); err != nil {
+		t.Fatal(err)
+	}
+	// the config only, layer sizes come from the manifest
+	if r.Downloads() != 1 {
+		t.Errorf("%d blobs downloaded, want the config only", r.Downloads())
+	}
+}
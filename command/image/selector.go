@@ -0,0 +1,232 @@
+package image
+
+import (
+	"github.com/distribution/reference"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slices"
+	"strconv"
+	"strings"
+)
+
+// layerSelection holds layer selectors of save besides positional --last,
+// --last, --first and --layers are given for all images or as IMAGE=VALUE
+// for the image, which wins
+type layerSelection struct {
+	last           *imageValues
+	first          *imageValues
+	layers         *imageValues
+	excludeDiffIDs []string
+	sizes          layerSizeRange
+}
+
+func newLayerSelection(opts saveOptions) (layerSelection, error) {
+	selection := layerSelection{excludeDiffIDs: opts.excludeDiffIDs}
+	var err error
+	if selection.sizes, err = parseLayerSizeRange(opts.minLayerSize, opts.maxLayerSize); err != nil {
+		return selection, err
+	}
+	for _, pattern := range opts.excludeDiffIDs {
+		if err := validateDiffIDPrefix(pattern); err != nil {
+			return selection, errors.Wrapf(err, "invalid --exclude-diffid %q", pattern)
+		}
+	}
+	if strings.Contains(opts.last, "=") {
+		if selection.last, err = parseImageValues("--last", strings.Split(opts.last, ","), validateCount); err != nil {
+			return selection, err
+		}
+	} else if opts.last != "" {
+		for _, value := range strings.Split(opts.last, ",") {
+			if err := validateCount(value); err != nil {
+				return selection, errors.Wrapf(err, "invalid --last %q", value)
+			}
+		}
+	}
+	if selection.first, err = parseImageValues("--first", opts.first, validateCount); err != nil {
+		return selection, err
+	}
+	selection.layers, err = parseImageValues("--layers", opts.layers, func(value string) error {
+		_, err := parseLayerRanges(value)
+		return err
+	})
+	return selection, err
+}
+
+// imageValues are values of a flag for all images, or keyed by image
+type imageValues struct {
+	flag    string
+	all     string
+	keys    []string
+	keyed   map[string]string
+	matched map[string]bool
+}
+
+func parseImageValues(flag string, values []string, validate func(string) error) (*imageValues, error) {
+	v := &imageValues{flag: flag, keyed: map[string]string{}, matched: map[string]bool{}}
+	for _, value := range values {
+		key, val, keyed := strings.Cut(value, "=")
+		if !keyed {
+			key, val = "", value
+		}
+		if keyed && key == "" {
+			return nil, errors.Errorf("invalid %s %q, expect VALUE or IMAGE=VALUE", flag, value)
+		}
+		if err := validate(val); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s %q", flag, value)
+		}
+		if !keyed {
+			v.all = val
+			continue
+		}
+		if _, ok := v.keyed[key]; !ok {
+			v.keys = append(v.keys, key)
+		}
+		v.keyed[key] = val
+	}
+	return v, nil
+}
+
+// lookup returns the value for image of m, empty if none is given
+func (v *imageValues) lookup(m manifestItem) string {
+	if v == nil {
+		return ""
+	}
+	for _, key := range v.keys {
+		if manifestMatchesName(m, key) {
+			v.matched[key] = true
+			return v.keyed[key]
+		}
+	}
+	return v.all
+}
+
+// unmatched returns IMAGE=VALUE flags matching no image looked up
+func (v *imageValues) unmatched() []string {
+	unmatched := []string{}
+	if v == nil {
+		return unmatched
+	}
+	for _, key := range v.keys {
+		if !v.matched[key] {
+			unmatched = append(unmatched, v.flag+" "+key+"="+v.keyed[key])
+		}
+	}
+	return unmatched
+}
+
+func (s layerSelection) unmatched() []string {
+	unmatched := s.last.unmatched()
+	unmatched = append(unmatched, s.first.unmatched()...)
+	return append(unmatched, s.layers.unmatched()...)
+}
+
+// manifestMatchesName is manifestMatchesImage accepting familiar names without
+// tag, e.g. app for app:latest
+func manifestMatchesName(m manifestItem, name string) bool {
+	if manifestMatchesImage(m, name) {
+		return true
+	}
+	named, err := reference.ParseNormalizedNamed(name)
+	return err == nil && manifestMatchesImage(m, reference.FamiliarString(reference.TagNameOnly(named)))
+}
+
+func validateCount(value string) error {
+	n, err := strconv.Atoi(value)
+	if err == nil && n < 0 {
+		err = errors.New("negative count")
+	}
+	return err
+}
+
+// minDiffIDPrefix is the number of hex digits --exclude-diffid needs at least,
+// shorter prefixes are likely typos matching many layers
+const minDiffIDPrefix = 4
+
+func validateDiffIDPrefix(pattern string) error {
+	hex := pattern
+	if _, encoded, ok := strings.Cut(pattern, ":"); ok {
+		hex = encoded
+	}
+	if len(hex) < minDiffIDPrefix {
+		return errors.Errorf("expect at least %d hex digits of a diff ID", minDiffIDPrefix)
+	}
+	for _, c := range hex {
+		if !strings.ContainsRune("0123456789abcdef", c) {
+			return errors.Errorf("%q is not a hex digit", c)
+		}
+	}
+	return nil
+}
+
+// parseLayerRanges parses 1-based layer indexes and ranges, e.g. 1-3,7,9-
+func parseLayerRanges(str string) ([][2]int, error) {
+	ranges := [][2]int{}
+	for _, part := range strings.Split(str, ",") {
+		from, to, isRange := strings.Cut(strings.TrimSpace(part), "-")
+		start, err := strconv.Atoi(from)
+		if err != nil || start < 1 {
+			return nil, errors.Errorf("invalid layer index %q, expect N, N-M or N-", part)
+		}
+		end := start
+		if isRange {
+			end = 0
+			if to != "" {
+				if end, err = strconv.Atoi(to); err != nil || end < start {
+					return nil, errors.Errorf("invalid layer range %q, expect N, N-M or N-", part)
+				}
+			}
+		}
+		ranges = append(ranges, [2]int{start, end})
+	}
+	return ranges, nil
+}
+
+func inLayerRanges(ranges [][2]int, index int) bool {
+	return slices.ContainsFunc(ranges, func(r [2]int) bool {
+		return index >= r[0] && (r[1] == 0 || index <= r[1])
+	})
+}
+
+func matchesDiffID(diffID digest.Digest, patterns []string) bool {
+	return slices.ContainsFunc(patterns, func(pattern string) bool {
+		return strings.HasPrefix(diffID.String(), pattern) || strings.HasPrefix(diffID.Encoded(), pattern)
+	})
+}
+
+// layerSizeRange selects layers by size, bounds are inclusive and nil if not
+// given, a bound of 0 is honoured
+type layerSizeRange struct {
+	min *int64
+	max *int64
+}
+
+func parseLayerSizeRange(min string, max string) (layerSizeRange, error) {
+	sizes := layerSizeRange{}
+	if min != "" {
+		size, err := units.FromHumanSize(min)
+		if err != nil {
+			return sizes, errors.Wrap(err, "invalid --min-layer-size")
+		}
+		sizes.min = &size
+	}
+	if max != "" {
+		size, err := units.FromHumanSize(max)
+		if err != nil {
+			return sizes, errors.Wrap(err, "invalid --max-layer-size")
+		}
+		sizes.max = &size
+	}
+	if sizes.min != nil && sizes.max != nil && *sizes.min > *sizes.max {
+		return sizes, errors.New("--min-layer-size is larger than --max-layer-size")
+	}
+	return sizes, nil
+}
+
+func (r layerSizeRange) isSet() bool {
+	return r.min != nil || r.max != nil
+}
+
+func (r layerSizeRange) contains(size int64) bool {
+	return (r.min == nil || size >= *r.min) && (r.max == nil || size <= *r.max)
+}
@@ -0,0 +1,155 @@
+package image
+
+import (
+	"docker-save/docker/image"
+	"fmt"
+	"github.com/opencontainers/go-digest"
+	"reflect"
+	"testing"
+)
+
+func TestParseLayerRanges(t *testing.T) {
+	tests := []struct {
+		str     string
+		want    [][2]int
+		wantErr bool
+	}{
+		{str: "3", want: [][2]int{{3, 3}}},
+		{str: "1-3,7,9-", want: [][2]int{{1, 3}, {7, 7}, {9, 0}}},
+		{str: " 2 , 4-5", want: [][2]int{{2, 2}, {4, 5}}},
+		{str: "2-2", want: [][2]int{{2, 2}}},
+		{str: "", wantErr: true},
+		{str: "0", wantErr: true},
+		{str: "-3", wantErr: true},
+		{str: "3-1", wantErr: true},
+		{str: "1-x", wantErr: true},
+		{str: "1,,2", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.str, func(t *testing.T) {
+			got, err := parseLayerRanges(tt.str)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatalf("parsed %v", got)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ranges %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLayersToExclude(t *testing.T) {
+	m := manifestItem{Config: "config.json", RepoTags: []string{"app:1.0"}}
+	img := &image.Image{RootFS: &image.RootFS{Type: "layers"}}
+	for i := 1; i <= 4; i++ {
+		m.Layers = append(m.Layers, fmt.Sprintf("l%d/layer.tar", i))
+		img.RootFS.DiffIDs = append(img.RootFS.DiffIDs, digest.FromString(fmt.Sprint(i)))
+	}
+
+	tests := []struct {
+		name string
+		opts saveOptions
+		want []string
+	}{
+		{"no selector", saveOptions{}, []string{}},
+		{"last", saveOptions{last: "2"}, []string{"l1/layer.tar", "l2/layer.tar"}},
+		{"last of image", saveOptions{last: "app:1.0=1"}, []string{"l1/layer.tar", "l2/layer.tar", "l3/layer.tar"}},
+		{"last of other image", saveOptions{last: "db=1"}, []string{}},
+		{"first", saveOptions{first: []string{"1"}}, []string{"l2/layer.tar", "l3/layer.tar", "l4/layer.tar"}},
+		{"layers", saveOptions{layers: []string{"1,3-"}}, []string{"l2/layer.tar"}},
+		{"layers of image wins", saveOptions{layers: []string{"1", "app:1.0=4"}}, []string{"l1/layer.tar", "l2/layer.tar", "l3/layer.tar"}},
+		{"first and last", saveOptions{first: []string{"3"}, last: "2"}, []string{"l1/layer.tar", "l2/layer.tar", "l4/layer.tar"}},
+		{"diff ID prefix", saveOptions{excludeDiffIDs: []string{img.RootFS.DiffIDs[1].Encoded()[:8]}}, []string{"l2/layer.tar"}},
+		{"diff ID of algorithm", saveOptions{excludeDiffIDs: []string{img.RootFS.DiffIDs[1].String()[:11]}}, []string{"l2/layer.tar"}},
+		{"last of image without slot", saveOptions{commonImageOptions: commonImageOptions{images: []string{"db:1.0"}}, last: "2"}, []string{}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := tt.opts
+			if opts.images == nil {
+				opts.images = []string{"app:1.0"}
+			}
+			selection, err := newLayerSelection(opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			opts.selection = selection
+			got, err := layersToExclude(t.TempDir(), m, img, opts)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("excluded %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLayerSelectionInvalid(t *testing.T) {
+	tests := []struct {
+		name string
+		opts saveOptions
+	}{
+		{"last not a number", saveOptions{last: "abc"}},
+		{"last of second image not a number", saveOptions{last: "1,x"}},
+		{"last negative", saveOptions{last: "-1"}},
+		{"last of image not a number", saveOptions{last: "app=x"}},
+		{"diff ID empty", saveOptions{excludeDiffIDs: []string{""}}},
+		{"diff ID algorithm only", saveOptions{excludeDiffIDs: []string{"sha256:"}}},
+		{"diff ID too short", saveOptions{excludeDiffIDs: []string{"sha256:4a8"}}},
+		{"diff ID not hex", saveOptions{excludeDiffIDs: []string{"zzzz"}}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if _, err := newLayerSelection(tt.opts); err == nil {
+				t.Error("invalid selection accepted")
+			}
+		})
+	}
+}
+
+func TestLayerSizeRange(t *testing.T) {
+	tests := []struct {
+		name     string
+		min, max string
+		size     int64
+		want     bool
+		wantErr  bool
+	}{
+		{name: "none", size: 10, want: true},
+		{name: "max 0 keeps empty layer", max: "0", size: 0, want: true},
+		{name: "max 0 drops layer", max: "0", size: 1, want: false},
+		{name: "min 0", min: "0", size: 0, want: true},
+		{name: "min", min: "1KB", size: 999, want: false},
+		{name: "within", min: "1KB", max: "1MB", size: 1000, want: true},
+		{name: "above max", min: "1KB", max: "1MB", size: 1000001, want: false},
+		{name: "min above max", min: "1MB", max: "0", wantErr: true},
+		{name: "invalid", max: "big", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			sizes, err := parseLayerSizeRange(tt.min, tt.max)
+			if tt.wantErr {
+				if err == nil {
+					t.Fatal("invalid range accepted")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if sizes.isSet() != (tt.min != "" || tt.max != "") {
+				t.Errorf("isSet %v", sizes.isSet())
+			}
+			if got := sizes.contains(tt.size); got != tt.want {
+				t.Errorf("contains(%d) %v, want %v", tt.size, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,202 @@
+package image
+
+import (
+	"bufio"
+	"bytes"
+	"docker-save/docker/utils"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/cli/cli/command"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// splitIndexSuffix names the index of volumes written by --split-size, which
+// is written after all volumes are complete
+const splitIndexSuffix = ".index"
+
+type splitIndex struct {
+	Archive string        `json:"archive"`
+	Size    int64         `json:"size"`
+	Digest  digest.Digest `json:"digest"`
+	Volumes []splitVolume `json:"volumes"`
+}
+
+type splitVolume struct {
+	Name   string        `json:"name"`
+	Size   int64         `json:"size"`
+	Digest digest.Digest `json:"digest"`
+}
+
+func volumeName(output string, i int) string {
+	return fmt.Sprintf("%s.%03d", output, i)
+}
+
+// writeVolumes writes r into volumes of output at most volumeSize bytes each,
+// and then the index of them, volumes written are removed on failure
+func writeVolumes(output string, r io.Reader, volumeSize int64, atomic bool) (index *splitIndex, err error) {
+	index = &splitIndex{Archive: filepath.Base(output), Volumes: []splitVolume{}}
+	defer func() {
+		if err != nil {
+			for _, volume := range index.Volumes {
+				os.Remove(filepath.Join(filepath.Dir(output), volume.Name))
+			}
+		}
+	}()
+
+	buffered := bufio.NewReader(r)
+	digester := digest.Canonical.Digester()
+	for i := 0; ; i++ {
+		if _, err := buffered.Peek(1); err == io.EOF && i > 0 {
+			break
+		} else if err != nil && err != io.EOF {
+			return index, err
+		}
+		name := volumeName(output, i)
+		volumeDigester := digest.Canonical.Digester()
+		counter := &countingWriter{}
+		reader := io.TeeReader(io.LimitReader(buffered, volumeSize), io.MultiWriter(digester.Hash(), volumeDigester.Hash(), counter))
+		if atomic {
+			err = utils.WriteFileAtomic(name, reader, 0644)
+		} else {
+			err = command.CopyToFile(name, reader)
+		}
+		if err != nil {
+			return index, err
+		}
+		index.Volumes = append(index.Volumes, splitVolume{Name: filepath.Base(name), Size: counter.n, Digest: volumeDigester.Digest()})
+		index.Size += counter.n
+	}
+	index.Digest = digester.Digest()
+
+	content, err := json.MarshalIndent(index, "", "  ")
+	if err != nil {
+		return index, err
+	}
+	return index, utils.WriteFileAtomic(output+splitIndexSuffix, bytes.NewReader(append(content, '\n')), 0644)
+}
+
+type countingWriter struct {
+	n int64
+}
+
+func (w *countingWriter) Write(p []byte) (int, error) {
+	w.n += int64(len(p))
+	return len(p), nil
+}
+
+// splitIndexPath returns index of the split set input refers to, by the index,
+// the first volume or the archive name, none if input is a plain archive
+func splitIndexPath(input string) string {
+	switch {
+	case strings.HasSuffix(input, splitIndexSuffix):
+		return input
+	case strings.HasSuffix(input, ".000"):
+		return strings.TrimSuffix(input, ".000") + splitIndexSuffix
+	}
+	if _, err := os.Stat(input); os.IsNotExist(err) {
+		if _, err := os.Stat(input + splitIndexSuffix); err == nil {
+			return input + splitIndexSuffix
+		}
+	}
+	return ""
+}
+
+// openArchive opens a plain archive or a split set as one stream with its size,
+// volumes are checked against their size and digest in the index as read
+func openArchive(input string) (io.ReadCloser, int64, error) {
+	indexPath := splitIndexPath(input)
+	if indexPath == "" {
+		file, err := os.Open(input)
+		if err != nil {
+			return nil, 0, err
+		}
+		stat, err := file.Stat()
+		if err != nil {
+			file.Close()
+			return nil, 0, err
+		}
+		return file, stat.Size(), nil
+	}
+
+	content, err := os.ReadFile(indexPath)
+	if err != nil {
+		return nil, 0, err
+	}
+	index := &splitIndex{}
+	if err := json.Unmarshal(content, index); err != nil {
+		return nil, 0, errors.Wrapf(err, "invalid split index %s", indexPath)
+	}
+	return &volumesReader{dir: filepath.Dir(indexPath), volumes: index.Volumes}, index.Size, nil
+}
+
+type volumesReader struct {
+	dir      string
+	volumes  []splitVolume
+	current  *os.File
+	reader   io.Reader
+	verifier digest.Verifier
+	read     int64
+}
+
+func (r *volumesReader) Read(p []byte) (int, error) {
+	for {
+		if r.current == nil {
+			if len(r.volumes) == 0 {
+				return 0, io.EOF
+			}
+			if err := r.open(); err != nil {
+				return 0, err
+			}
+		}
+		n, err := r.reader.Read(p)
+		r.read += int64(n)
+		if err == io.EOF {
+			if err := r.next(); err != nil {
+				return n, err
+			}
+			if n == 0 {
+				continue
+			}
+			return n, nil
+		}
+		return n, err
+	}
+}
+
+func (r *volumesReader) open() error {
+	volume := r.volumes[0]
+	if err := volume.Digest.Validate(); err != nil {
+		return errors.Wrapf(err, "invalid digest of volume %s", volume.Name)
+	}
+	file, err := os.Open(filepath.Join(r.dir, filepath.Base(volume.Name)))
+	if err != nil {
+		return errors.Wrap(err, "missing volume of split archive")
+	}
+	r.current, r.verifier, r.read = file, volume.Digest.Verifier(), 0
+	r.reader = io.TeeReader(file, r.verifier)
+	return nil
+}
+
+// next checks the volume read up and moves on to the next one
+func (r *volumesReader) next() error {
+	volume := r.volumes[0]
+	r.current.Close()
+	r.current = nil
+	r.volumes = r.volumes[1:]
+	if r.read != volume.Size || !r.verifier.Verified() {
+		return errors.Errorf("volume %s of split archive is corrupted", volume.Name)
+	}
+	return nil
+}
+
+func (r *volumesReader) Close() error {
+	if r.current != nil {
+		return r.current.Close()
+	}
+	return nil
+}
@@ -3,10 +3,20 @@ package image
 import (
 	"context"
 	"docker-save/docker"
+	"docker-save/docker/image"
+	"docker-save/docker/progress"
+	"docker-save/docker/registry"
+	"docker-save/docker/utils"
 	"encoding/json"
 	"github.com/docker/docker/api/types"
+	"github.com/docker/docker/client"
 	"github.com/docker/docker/pkg/archive"
 	"github.com/moby/sys/symlink"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"github.com/sirupsen/logrus"
+	"golang.org/x/exp/slices"
 	"io"
 	"os"
 	"path/filepath"
@@ -22,9 +32,11 @@ const (
 )
 
 type manifestItem struct {
-	Config   string
-	RepoTags []string
-	Layers   []string
+	Config       string
+	RepoTags     []string
+	Layers       []string
+	Parent       string                               `json:",omitempty"`
+	LayerSources map[digest.Digest]ocispec.Descriptor `json:",omitempty"`
 }
 
 type commonImageOptions struct {
@@ -32,28 +44,36 @@ type commonImageOptions struct {
 	workdir   string
 	keep      bool
 	cacheFrom string
+	input     string
+	platforms []string
+	cache     bool
+	parallel  int
 }
 
-// ExportImages export images
-func ExportImages(dockerCli docker.Cli, images []string) (io.ReadCloser, error) {
+// ExportImages export images, only the given platforms of multi-platform images if any,
+// images are inspected up to n at a time
+func ExportImages(ctx context.Context, dockerCli docker.Cli, images []string, platforms []ocispec.Platform, n int) (io.ReadCloser, error) {
 	// check docker service & image first
-	err := imageInspectCheck(dockerCli, images)
+	err := imageInspectCheck(ctx, dockerCli, images, n)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx := context.Background()
-	return dockerCli.Client().ImageSave(ctx, images)
+	saveOpts := []client.ImageSaveOption{}
+	if len(platforms) > 0 {
+		saveOpts = append(saveOpts, client.ImageSaveWithPlatforms(platforms...))
+	}
+	return dockerCli.Client().ImageSave(ctx, images, saveOpts...)
 }
 
 // GetPatternFunc is a function which used to generate temp dir pattern
 type GetPatternFunc func() string
 
 // ExportUntarImages export and untar images
-func ExportUntarImages(dockerCli docker.Cli, opts commonImageOptions, getPatternFunc GetPatternFunc) (string, error) {
+func ExportUntarImages(ctx context.Context, dockerCli docker.Cli, opts commonImageOptions, getPatternFunc GetPatternFunc) (string, error) {
 	if opts.cacheFrom != "" {
-		// use cached untar dir
-		return opts.cacheFrom, nil
+		// use cached untar dir, exported again if stale
+		return opts.cacheFrom, reuseCacheFrom(ctx, dockerCli, opts)
 	}
 
 	untarDir, err := os.MkdirTemp(opts.workdir, getPatternFunc())
@@ -61,10 +81,60 @@ func ExportUntarImages(dockerCli docker.Cli, opts commonImageOptions, getPattern
 		return "", err
 	}
 
-	if err := doExportAndUntar(dockerCli, opts.images, untarDir); err != nil {
-		return untarDir, err
+	if opts.input != "" {
+		// use saved tar archive other than export from docker, which is not
+		// recorded as --cache-from validates against docker or registry
+		if opts.keep {
+			logrus.Warnf("%s is kept without a record of images and can not be reused with --cache-from", untarDir)
+		}
+		return untarDir, untarArchive(ctx, opts.input, untarDir)
+	}
+
+	return untarDir, exportRecorded(ctx, dockerCli, opts, untarDir)
+}
+
+// exportRecorded exports images into untar dir, recording them for --cache-from
+// with --keep, IDs are inspected before the export so that a tag moved in
+// between makes the dir stale instead of recording content it does not hold
+func exportRecorded(ctx context.Context, dockerCli docker.Cli, opts commonImageOptions, untarDir string) error {
+	var inspects []types.ImageInspect
+	if opts.keep || opts.cacheFrom != "" {
+		var err error
+		if inspects, err = imageInspectParallel(ctx, dockerCli, opts.images, nil, opts.parallel); err != nil {
+			return err
+		}
+	}
+	if err := exportIntoDir(ctx, dockerCli, opts, untarDir); err != nil {
+		return err
+	}
+	if inspects == nil {
+		return nil
 	}
-	return untarDir, nil
+	return writeUntarMetadata(untarDir, opts, inspects)
+}
+
+// exportIntoDir exports daemon images and fetches registry images into untar dir
+func exportIntoDir(ctx context.Context, dockerCli docker.Cli, opts commonImageOptions, untarDir string) error {
+	platforms, err := image.ParsePlatforms(opts.platforms)
+	if err != nil {
+		return err
+	}
+	daemonImages, registryImages := splitRegistryImages(opts.images)
+	if len(daemonImages) > 0 {
+		export := doExportAndUntar
+		if opts.cache {
+			export = cachedExport(opts.parallel)
+		} else if opts.parallel > 1 && len(daemonImages) > 1 {
+			export = parallelExport(opts.parallel)
+		}
+		if err := export(ctx, dockerCli, daemonImages, platforms, untarDir); err != nil {
+			return err
+		}
+	}
+	if len(registryImages) > 0 {
+		return fetchRegistryImages(ctx, dockerCli, registryImages, platforms, untarDir)
+	}
+	return nil
 }
 
 func ResolveManifests(workDir string) ([]manifestItem, error) {
@@ -73,6 +143,12 @@ func ResolveManifests(workDir string) ([]manifestItem, error) {
 		return nil, err
 	}
 	manifestFile, err := os.Open(manifestPath)
+	if os.IsNotExist(err) && isOCILayout(workDir) {
+		return manifestsFromOCIIndex(workDir)
+	}
+	if err != nil {
+		return nil, err
+	}
 	defer manifestFile.Close()
 
 	var manifest []manifestItem
@@ -82,33 +158,161 @@ func ResolveManifests(workDir string) ([]manifestItem, error) {
 	return manifest, nil
 }
 
-func doExportAndUntar(dockerCli docker.Cli, images []string, unTarDir string) error {
-	imagesTar, err := ExportImages(dockerCli, images)
+func writeManifests(workDir string, manifests []manifestItem) error {
+	content, err := json.Marshal(manifests)
 	if err != nil {
 		return err
 	}
-	if err := archive.Untar(imagesTar, unTarDir, &archive.TarOptions{NoLchown: true}); err != nil {
+	return os.WriteFile(filepath.Join(workDir, manifestFileName), content, 0644)
+}
+
+// loadImageConfig reads image config of manifest item from untar dir
+func loadImageConfig(untarDir string, m manifestItem) (*image.Image, error) {
+	configPath, err := safePath(untarDir, m.Config)
+	if err != nil {
+		return nil, err
+	}
+	config, err := os.ReadFile(configPath)
+	if err != nil {
+		return nil, err
+	}
+	return imageConfigFromJSON(config)
+}
+
+// selectPlatformManifests splits manifests into ones built for platforms and the
+// others, all manifests are selected if no platform is given
+func selectPlatformManifests(untarDir string, manifests []manifestItem, platforms []ocispec.Platform) ([]manifestItem, []manifestItem, error) {
+	if len(platforms) == 0 {
+		return manifests, []manifestItem{}, nil
+	}
+	selected := []manifestItem{}
+	others := []manifestItem{}
+	for _, m := range manifests {
+		img, err := loadImageConfig(untarDir, m)
+		if err != nil {
+			return nil, nil, err
+		}
+		if slices.ContainsFunc(platforms, func(p ocispec.Platform) bool {
+			return image.MatchPlatform(p, img.Platform())
+		}) {
+			selected = append(selected, m)
+		} else {
+			others = append(others, m)
+		}
+	}
+	return selected, others, nil
+}
+
+// singleManifest returns the only manifest of untar dir for the requested
+// platform, with its image config
+func singleManifest(untarDir string, opts commonImageOptions) (manifestItem, *image.Image, error) {
+	manifests, err := ResolveManifests(untarDir)
+	if err != nil {
+		return manifestItem{}, nil, err
+	}
+	platforms, err := image.ParsePlatforms(opts.platforms)
+	if err != nil {
+		return manifestItem{}, nil, err
+	}
+	if manifests, _, err = selectPlatformManifests(untarDir, manifests, platforms); err != nil {
+		return manifestItem{}, nil, err
+	}
+	switch len(manifests) {
+	case 0:
+		return manifestItem{}, nil, errors.Errorf("image %s not found in exported archive", opts.images[0])
+	case 1:
+	default:
+		return manifestItem{}, nil, errors.Errorf("image %s has %d platforms, choose one with --platform", opts.images[0], len(manifests))
+	}
+	img, err := loadImageConfig(untarDir, manifests[0])
+	return manifests[0], img, err
+}
+
+// imageManifest is singleManifest picking image by name among images of the
+// input archive
+func imageManifest(untarDir string, opts commonImageOptions) (manifestItem, *image.Image, error) {
+	if opts.input == "" {
+		return singleManifest(untarDir, opts)
+	}
+	manifests, err := ResolveManifests(untarDir)
+	if err != nil {
+		return manifestItem{}, nil, err
+	}
+	platforms, err := image.ParsePlatforms(opts.platforms)
+	if err != nil {
+		return manifestItem{}, nil, err
+	}
+	if manifests, _, err = selectPlatformManifests(untarDir, manifests, platforms); err != nil {
+		return manifestItem{}, nil, err
+	}
+	m, err := findManifest(manifests, opts.images[0])
+	if err != nil {
+		return manifestItem{}, nil, err
+	}
+	img, err := loadImageConfig(untarDir, m)
+	return m, img, err
+}
+
+func findManifest(manifests []manifestItem, image string) (manifestItem, error) {
+	for _, m := range manifests {
+		if manifestMatchesImage(m, image) {
+			return m, nil
+		}
+	}
+	if len(manifests) == 1 {
+		return manifests[0], nil
+	}
+	return manifestItem{}, errors.Errorf("image %s not found in archive", image)
+}
+
+func doExportAndUntar(ctx context.Context, dockerCli docker.Cli, images []string, platforms []ocispec.Platform, unTarDir string) error {
+	// several images are exported at once only without --parallel
+	imagesTar, err := ExportImages(ctx, dockerCli, images, platforms, 1)
+	if err != nil {
 		return err
 	}
-	return nil
+	tracker := progress.FromContext(ctx).Start("export", strings.Join(images, ","), 0)
+	defer tracker.Done()
+	return archive.Untar(tracker.Reader(imagesTar), unTarDir, &archive.TarOptions{NoLchown: true})
 }
 
-func imageInspectCheck(dockerCli docker.Cli, images []string) error {
-	_, err := ImageInspect(dockerCli, images)
+func untarArchive(ctx context.Context, input string, unTarDir string) error {
+	file, size, err := openArchive(input)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	tracker := progress.FromContext(ctx).Start("untar", filepath.Base(input), size)
+	defer tracker.Done()
+	return archive.Untar(tracker.Reader(utils.ContextReader(ctx, file)), unTarDir, &archive.TarOptions{NoLchown: true})
+}
+
+func imageInspectCheck(ctx context.Context, dockerCli docker.Cli, images []string, n int) error {
+	_, err := imageInspectParallel(ctx, dockerCli, images, nil, n)
 	if err != nil {
 		return err
 	}
 	return nil
 }
 
-func ImageInspect(dockerCli docker.Cli, images []string) ([]types.ImageInspect, error) {
-	ctx := context.Background()
-	getRefFunc := func(ref string) (types.ImageInspect, []byte, error) {
-		return dockerCli.Client().ImageInspectWithRaw(ctx, ref)
+// ImageInspect inspects images, the given platform variant of multi-platform images if not nil
+func ImageInspect(ctx context.Context, dockerCli docker.Cli, images []string, platform *ocispec.Platform) ([]types.ImageInspect, error) {
+	inspectOpts := []client.ImageInspectOption{}
+	if platform != nil {
+		inspectOpts = append(inspectOpts, client.ImageInspectWithPlatform(platform))
+	}
+	getRefFunc := func(ref string) (types.ImageInspect, error) {
+		return dockerCli.Client().ImageInspect(ctx, ref, inspectOpts...)
 	}
 	resultArr := []types.ImageInspect{}
 	for _, image := range images {
-		inspect, _, err := getRefFunc(image)
+		var inspect types.ImageInspect
+		var err error
+		if registry.IsReference(image) {
+			inspect, err = registryImageInspect(ctx, dockerCli, image, platform)
+		} else {
+			inspect, err = getRefFunc(image)
+		}
 		if err != nil {
 			return nil, err
 		}
@@ -0,0 +1,449 @@
+package cache
+
+import (
+	"encoding/json"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	// dirEnv overrides the cache directory, default to docker-save under user cache dir
+	dirEnv = "DOCKER_SAVE_CACHE_DIR"
+	// maxSizeEnv limits cache size, e.g. 20GB, least recently used images are
+	// pruned after each store once exceeded
+	maxSizeEnv = "DOCKER_SAVE_CACHE_MAX_SIZE"
+
+	imagesDir  = "images"
+	aliasesDir = "aliases"
+	configsDir = "configs"
+	layersDir  = "layers"
+	tempDir    = "tmp"
+)
+
+// Image is a cached image, keyed by digest of its config
+type Image struct {
+	ID       digest.Digest   `json:"id"`
+	RepoTags []string        `json:"repoTags,omitempty"`
+	DiffIDs  []digest.Digest `json:"diffIDs"`
+	// LastUsed is when the image was stored or read from cache
+	LastUsed time.Time `json:"-"`
+	// Size sums config and layer files, shared layers are counted for each image
+	Size int64 `json:"-"`
+}
+
+// Cache stores exported image configs by config digest and layers by diff ID,
+// so that images sharing layers with cached ones only need their config
+type Cache struct {
+	root string
+}
+
+// Dir returns the cache directory
+func Dir() (string, error) {
+	if dir := os.Getenv(dirEnv); dir != "" {
+		return dir, nil
+	}
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "docker-save"), nil
+}
+
+// Open opens cache of the default directory, creating it if necessary
+func Open() (*Cache, error) {
+	dir, err := Dir()
+	if err != nil {
+		return nil, err
+	}
+	for _, sub := range []string{imagesDir, aliasesDir, configsDir, layersDir, tempDir} {
+		if err := os.MkdirAll(filepath.Join(dir, sub), 0755); err != nil {
+			return nil, errors.Wrap(err, "create cache dir")
+		}
+	}
+	return &Cache{root: dir}, nil
+}
+
+// Root returns the cache directory
+func (c *Cache) Root() string {
+	return c.root
+}
+
+// TempDir creates a temp dir on the same filesystem as cached files, files
+// under it can be moved into cache
+func (c *Cache) TempDir(pattern string) (string, error) {
+	return os.MkdirTemp(filepath.Join(c.root, tempDir), pattern)
+}
+
+func (c *Cache) imagePath(id digest.Digest) string {
+	return filepath.Join(c.root, imagesDir, id.Algorithm().String(), id.Encoded()+".json")
+}
+
+// aliasPath keys aliases by platform as well, as an index digest is shared by
+// images of all platforms, platform is empty for images inspected without one
+func (c *Cache) aliasPath(ref digest.Digest, platform string) string {
+	key := strings.ReplaceAll(platform, "/", "-")
+	if key == "" {
+		key = "default"
+	}
+	return filepath.Join(c.root, aliasesDir, ref.Algorithm().String(), ref.Encoded(), key)
+}
+
+// ConfigPath returns path of cached config of image id
+func (c *Cache) ConfigPath(id digest.Digest) string {
+	return filepath.Join(c.root, configsDir, id.Algorithm().String(), id.Encoded())
+}
+
+// LayerPath returns path of cached layer tar of diffID
+func (c *Cache) LayerPath(diffID digest.Digest) string {
+	return filepath.Join(c.root, layersDir, diffID.Algorithm().String(), diffID.Encoded())
+}
+
+// GetImage returns cached image id, or the image of platform id is an alias
+// of, if its config and all layers are cached, and marks them as used now
+func (c *Cache) GetImage(id digest.Digest, platform string) (*Image, bool, error) {
+	if err := id.Validate(); err != nil {
+		return nil, false, err
+	}
+	img, err := c.readImage(c.imagePath(id))
+	if os.IsNotExist(err) {
+		return c.getAliasedImage(id, platform)
+	}
+	if err != nil {
+		return nil, false, err
+	}
+
+	now := time.Now()
+	files := append([]string{c.imagePath(id), c.ConfigPath(id)}, c.layerPaths(img)...)
+	for _, file := range files {
+		if err := os.Chtimes(file, now, now); os.IsNotExist(err) {
+			return nil, false, nil
+		} else if err != nil {
+			return nil, false, err
+		}
+	}
+	img.LastUsed = now
+	return img, true, nil
+}
+
+func (c *Cache) getAliasedImage(ref digest.Digest, platform string) (*Image, bool, error) {
+	content, err := os.ReadFile(c.aliasPath(ref, platform))
+	if os.IsNotExist(err) || errors.Is(err, syscall.ENOTDIR) {
+		// legacy aliases are files in place of the ref dir
+		return nil, false, nil
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	id, err := digest.Parse(string(content))
+	if err != nil || id == ref {
+		return nil, false, errors.Errorf("invalid cache alias %s", ref)
+	}
+	if _, err := os.Stat(c.imagePath(id)); os.IsNotExist(err) {
+		return nil, false, nil
+	}
+	return c.GetImage(id, platform)
+}
+
+// PutAlias records ref of platform as an alias of image id, docker with
+// containerd image store identifies images by manifest or index digest instead
+// of config digest
+func (c *Cache) PutAlias(ref digest.Digest, platform string, id digest.Digest) error {
+	if ref == id {
+		return nil
+	}
+	// aliases of older versions are files keyed by ref only
+	dir := filepath.Dir(c.aliasPath(ref, platform))
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		if err := os.Remove(dir); err != nil {
+			return err
+		}
+	}
+	return writeFile(c.aliasPath(ref, platform), []byte(id.String()))
+}
+
+// PutImage stores image with config content and layer files, layer files are
+// moved into cache, layers cached already are kept as is
+func (c *Cache) PutImage(img Image, config []byte, layerFiles []string) error {
+	if len(layerFiles) != len(img.DiffIDs) {
+		return errors.Errorf("%d layer files for %d diff IDs", len(layerFiles), len(img.DiffIDs))
+	}
+	if digest.FromBytes(config) != img.ID {
+		return errors.Errorf("config digest of image %s mismatch", img.ID)
+	}
+	if err := writeFile(c.ConfigPath(img.ID), config); err != nil {
+		return err
+	}
+	for i, layerFile := range layerFiles {
+		target := c.LayerPath(img.DiffIDs[i])
+		if _, err := os.Stat(target); os.IsNotExist(err) {
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+				return err
+			}
+			if err := os.Rename(layerFile, target); err != nil {
+				return errors.Wrapf(err, "cache layer %s", img.DiffIDs[i])
+			}
+		}
+		// exported layers carry mtime of the archive entry, and cached ones
+		// must survive concurrent pruning until the image is stored
+		now := time.Now()
+		if err := os.Chtimes(target, now, now); err != nil {
+			return err
+		}
+	}
+
+	content, err := json.Marshal(img)
+	if err != nil {
+		return err
+	}
+	if err := writeFile(c.imagePath(img.ID), content); err != nil {
+		return err
+	}
+	if maxSize := os.Getenv(maxSizeEnv); maxSize != "" {
+		size, err := units.FromHumanSize(maxSize)
+		if err != nil {
+			return errors.Wrapf(err, "invalid %s", maxSizeEnv)
+		}
+		_, _, err = c.Prune(0, size)
+		return err
+	}
+	return nil
+}
+
+// Images lists cached images, most recently used first
+func (c *Cache) Images() ([]*Image, error) {
+	files, err := filepath.Glob(filepath.Join(c.root, imagesDir, "*", "*.json"))
+	if err != nil {
+		return nil, err
+	}
+	images := []*Image{}
+	for _, file := range files {
+		img, err := c.readImage(file)
+		if os.IsNotExist(err) {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		images = append(images, img)
+	}
+	sort.Slice(images, func(i, j int) bool {
+		return images[i].LastUsed.After(images[j].LastUsed)
+	})
+	return images, nil
+}
+
+// Prune removes images not used within olderThan, then least recently used
+// images until total size is within maxSize, layers no longer referenced by
+// any cached image are removed as well, zero olderThan or maxSize means no
+// limit, returns number of images removed and bytes reclaimed
+func (c *Cache) Prune(olderThan time.Duration, maxSize int64) (int, int64, error) {
+	images, err := c.Images()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	kept := images
+	if olderThan > 0 {
+		deadline := time.Now().Add(-olderThan)
+		kept = []*Image{}
+		for _, img := range images {
+			if img.LastUsed.After(deadline) {
+				kept = append(kept, img)
+			}
+		}
+	}
+	if maxSize > 0 {
+		for len(kept) > 0 && c.TotalSize(kept) > maxSize {
+			kept = kept[:len(kept)-1]
+		}
+	}
+
+	keptIDs := map[digest.Digest]bool{}
+	keptLayers := map[string]bool{}
+	for _, img := range kept {
+		keptIDs[img.ID] = true
+		for _, layer := range c.layerPaths(img) {
+			keptLayers[layer] = true
+		}
+	}
+
+	removed := 0
+	reclaimed := int64(0)
+	remove := func(file string) error {
+		info, err := os.Stat(file)
+		if os.IsNotExist(err) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+		reclaimed += info.Size()
+		return nil
+	}
+	for _, img := range images {
+		if keptIDs[img.ID] {
+			continue
+		}
+		if err := remove(c.imagePath(img.ID)); err != nil {
+			return removed, reclaimed, err
+		}
+		if err := remove(c.ConfigPath(img.ID)); err != nil {
+			return removed, reclaimed, err
+		}
+		removed++
+	}
+
+	// aliases of older versions are not keyed by platform and may be wrong
+	legacyAliases, err := filepath.Glob(filepath.Join(c.root, aliasesDir, "*", "*"))
+	if err != nil {
+		return removed, reclaimed, err
+	}
+	for _, alias := range legacyAliases {
+		if info, err := os.Stat(alias); err == nil && !info.IsDir() {
+			if err := remove(alias); err != nil {
+				return removed, reclaimed, err
+			}
+		}
+	}
+	aliases, err := filepath.Glob(filepath.Join(c.root, aliasesDir, "*", "*", "*"))
+	if err != nil {
+		return removed, reclaimed, err
+	}
+	for _, alias := range aliases {
+		content, err := os.ReadFile(alias)
+		if err != nil {
+			return removed, reclaimed, err
+		}
+		if !keptIDs[digest.Digest(content)] && !recentlyModified(alias, storeGracePeriod) {
+			if err := remove(alias); err != nil {
+				return removed, reclaimed, err
+			}
+			// the ref dir is left once its last alias is removed
+			_ = os.Remove(filepath.Dir(alias))
+		}
+	}
+
+	layers, err := filepath.Glob(filepath.Join(c.root, layersDir, "*", "*"))
+	if err != nil {
+		return removed, reclaimed, err
+	}
+	for _, layer := range layers {
+		if keptLayers[layer] || recentlyModified(layer, storeGracePeriod) {
+			continue
+		}
+		if err := remove(layer); err != nil {
+			return removed, reclaimed, err
+		}
+	}
+
+	temps, err := filepath.Glob(filepath.Join(c.root, tempDir, "*"))
+	if err != nil {
+		return removed, reclaimed, err
+	}
+	for _, temp := range temps {
+		if !recentlyModified(temp, staleTempPeriod) {
+			if err := os.RemoveAll(temp); err != nil {
+				return removed, reclaimed, err
+			}
+		}
+	}
+	return removed, reclaimed, nil
+}
+
+// layers are moved into cache before the image referencing them is stored,
+// unreferenced layers modified within storeGracePeriod may be being stored by
+// a concurrent run, and temp dirs older than staleTempPeriod are left over by
+// interrupted runs
+const (
+	storeGracePeriod = time.Minute
+	staleTempPeriod  = 24 * time.Hour
+)
+
+func recentlyModified(file string, period time.Duration) bool {
+	info, err := os.Stat(file)
+	return err == nil && time.Since(info.ModTime()) < period
+}
+
+// TotalSize returns size of config and layer files of images, shared layers
+// are counted once
+func (c *Cache) TotalSize(images []*Image) int64 {
+	counted := map[string]bool{}
+	size := int64(0)
+	for _, img := range images {
+		for _, file := range append([]string{c.ConfigPath(img.ID)}, c.layerPaths(img)...) {
+			if counted[file] {
+				continue
+			}
+			counted[file] = true
+			if info, err := os.Stat(file); err == nil {
+				size += info.Size()
+			}
+		}
+	}
+	return size
+}
+
+func (c *Cache) layerPaths(img *Image) []string {
+	paths := []string{}
+	for _, diffID := range img.DiffIDs {
+		paths = append(paths, c.LayerPath(diffID))
+	}
+	return paths
+}
+
+func (c *Cache) readImage(file string) (*Image, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	info, err := os.Stat(file)
+	if err != nil {
+		return nil, err
+	}
+	img := &Image{}
+	if err := json.Unmarshal(content, img); err != nil {
+		return nil, errors.Wrapf(err, "invalid cached image %s", file)
+	}
+	if err := img.ID.Validate(); err != nil {
+		return nil, errors.Wrapf(err, "invalid cached image %s", file)
+	}
+	for _, diffID := range img.DiffIDs {
+		if err := diffID.Validate(); err != nil {
+			return nil, errors.Wrapf(err, "invalid cached image %s", file)
+		}
+	}
+	img.LastUsed = info.ModTime()
+	img.Size = c.TotalSize([]*Image{img})
+	return img, nil
+}
+
+// writeFile writes file atomically, concurrent readers see either nothing or
+// the whole content
+func writeFile(file string, content []byte) error {
+	if err := os.MkdirAll(filepath.Dir(file), 0755); err != nil {
+		return err
+	}
+	temp, err := os.CreateTemp(filepath.Dir(file), filepath.Base(file)+"-*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(temp.Name())
+	_, err = temp.Write(content)
+	if closeErr := temp.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		return err
+	}
+	return os.Rename(temp.Name(), file)
+}
@@ -0,0 +1,90 @@
+package cache_test
+
+import (
+	"docker-save/docker/cache"
+	"github.com/opencontainers/go-digest"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// putImage stores an image of one layer of content
+func putImage(t *testing.T, c *cache.Cache, config string, content string) digest.Digest {
+	t.Helper()
+	dir, err := c.TempDir("layer-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	layerFile := filepath.Join(dir, "layer.tar")
+	if err := os.WriteFile(layerFile, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	img := cache.Image{ID: digest.FromString(config), DiffIDs: []digest.Digest{digest.FromString(content)}}
+	if err := c.PutImage(img, []byte(config), []string{layerFile}); err != nil {
+		t.Fatal(err)
+	}
+	return img.ID
+}
+
+func TestAliasesOfPlatformsSharingIndex(t *testing.T) {
+	t.Setenv("DOCKER_SAVE_CACHE_DIR", t.TempDir())
+	c, err := cache.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	amd64 := putImage(t, c, `{"architecture":"amd64"}`, "amd64 layer")
+	arm64 := putImage(t, c, `{"architecture":"arm64"}`, "arm64 layer")
+	// docker with containerd image store inspects both as the index digest
+	index := digest.FromString("index")
+	if err := c.PutAlias(index, "linux/amd64", amd64); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := c.GetImage(index, "linux/arm64/v8"); err != nil || ok {
+		t.Fatalf("arm64 found before cached, err %v", err)
+	}
+	if err := c.PutAlias(index, "linux/arm64/v8", arm64); err != nil {
+		t.Fatal(err)
+	}
+	for platform, want := range map[string]digest.Digest{"linux/amd64": amd64, "linux/arm64/v8": arm64} {
+		img, ok, err := c.GetImage(index, platform)
+		if err != nil || !ok {
+			t.Fatalf("%s not found, err %v", platform, err)
+		}
+		if img.ID != want {
+			t.Errorf("%s is %s, want %s", platform, img.ID, want)
+		}
+	}
+	if _, ok, _ := c.GetImage(index, ""); ok {
+		t.Error("image found for index without platform")
+	}
+}
+
+func TestLegacyAliasReplaced(t *testing.T) {
+	dir := t.TempDir()
+	t.Setenv("DOCKER_SAVE_CACHE_DIR", dir)
+	c, err := cache.Open()
+	if err != nil {
+		t.Fatal(err)
+	}
+	id := putImage(t, c, `{"architecture":"amd64"}`, "layer")
+	index := digest.FromString("index")
+	legacy := filepath.Join(dir, "aliases", index.Algorithm().String(), index.Encoded())
+	if err := os.MkdirAll(filepath.Dir(legacy), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(legacy, []byte(id.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok, err := c.GetImage(index, "linux/amd64"); err != nil || ok {
+		t.Errorf("legacy alias used regardless of platform, err %v", err)
+	}
+	if err := c.PutAlias(index, "linux/amd64", id); err != nil {
+		t.Fatal(err)
+	}
+	if img, ok, err := c.GetImage(index, "linux/amd64"); err != nil || !ok || img.ID != id {
+		t.Errorf("alias not replaced, err %v", err)
+	}
+}
@@ -1,7 +1,9 @@
 package docker
 
 import (
+	"docker-save/docker/registry"
 	"fmt"
+	"github.com/docker/cli/cli/config"
 	"github.com/docker/cli/cli/connhelper"
 	"github.com/docker/cli/cli/streams"
 	"github.com/docker/docker/client"
@@ -24,6 +26,7 @@ type Streams interface {
 // Cli represents the docker command line client.
 type Cli interface {
 	Client() client.APIClient
+	RegistryClient(host string) *registry.Client
 	Streams
 	SetIn(in *streams.In)
 }
@@ -37,8 +40,15 @@ type DockerCli struct {
 	init    sync.Once
 	initErr error
 	client  client.APIClient
+
+	// registryClients caches clients by host, keeping their auth tokens
+	registryMu      sync.Mutex
+	registryClients map[string]*registry.Client
 }
 
+// dockerHubAuthKey is the key of docker hub credentials in docker config file
+const dockerHubAuthKey = "https://index.docker.io/v1/"
+
 func (cli *DockerCli) initialize() error {
 	cli.init.Do(func() {
 		if cli.initErr != nil {
@@ -101,6 +111,34 @@ func (cli *DockerCli) Client() client.APIClient {
 	return cli.client
 }
 
+// RegistryClient returns a distribution API client for host, authenticated
+// with credentials stored by docker login, the same client is returned for a
+// host so tokens are fetched once per scope
+func (cli *DockerCli) RegistryClient(host string) *registry.Client {
+	cli.registryMu.Lock()
+	defer cli.registryMu.Unlock()
+	if c, ok := cli.registryClients[host]; ok {
+		return c
+	}
+	if cli.registryClients == nil {
+		cli.registryClients = map[string]*registry.Client{}
+	}
+
+	authKey := host
+	if host == "docker.io" {
+		authKey = dockerHubAuthKey
+	}
+	credentials := registry.Credentials{}
+	if authConfig, err := config.LoadDefaultConfigFile(cli.Err()).GetAuthConfig(authKey); err == nil {
+		credentials.Username = authConfig.Username
+		credentials.Password = authConfig.Password
+		credentials.IdentityToken = authConfig.IdentityToken
+	}
+	c := registry.NewClient(host, credentials)
+	cli.registryClients[host] = c
+	return c
+}
+
 // Out returns the writer used for stdout
 func (cli *DockerCli) Out() *streams.Out {
 	return cli.out
@@ -9,6 +9,15 @@ import (
 
 // Image stores partial docker image configuration
 type Image struct {
+	// Architecture is the hardware that the image is built and runs on
+	Architecture string `json:"architecture,omitempty"`
+	// Variant is the CPU architecture variant, e.g. v8 of arm64
+	Variant string `json:"variant,omitempty"`
+	// OS is the operating system used to build and run the image
+	OS string `json:"os,omitempty"`
+	// Config is the default runtime configuration of containers, e.g. User and Labels
+	Config *ocispec.ImageConfig `json:"config,omitempty"`
+
 	// RootFS contains information about the image's RootFS, including the
 	// layer IDs.
 	RootFS  *RootFS   `json:"rootfs,omitempty"`
@@ -29,6 +38,16 @@ type RootFS struct {
 // History stores build commands that were used to create an image
 type History = ocispec.History
 
+// Platform returns the platform the image is built for
+func (img *Image) Platform() ocispec.Platform {
+	return ocispec.Platform{OS: img.OS, Architecture: img.Architecture, Variant: img.Variant}
+}
+
+// RawJSON returns the immutable JSON associated with the image.
+func (img *Image) RawJSON() []byte {
+	return img.rawJSON
+}
+
 // NewFromJSON creates an Image configuration from json.
 func NewFromJSON(src []byte) (*Image, error) {
 	img := &Image{}
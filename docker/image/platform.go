@@ -0,0 +1,51 @@
+package image
+
+import (
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// ParsePlatform parses platform in os/arch[/variant] format, e.g. linux/arm64/v8
+func ParsePlatform(str string) (ocispec.Platform, error) {
+	parts := strings.Split(strings.TrimSpace(str), "/")
+	if len(parts) < 2 || len(parts) > 3 || parts[0] == "" || parts[1] == "" {
+		return ocispec.Platform{}, errors.Errorf("invalid platform %q, expect os/arch[/variant]", str)
+	}
+	platform := ocispec.Platform{OS: parts[0], Architecture: parts[1]}
+	if len(parts) == 3 {
+		platform.Variant = parts[2]
+	}
+	return platform, nil
+}
+
+// ParsePlatforms parses each of platforms
+func ParsePlatforms(platforms []string) ([]ocispec.Platform, error) {
+	result := []ocispec.Platform{}
+	for _, str := range platforms {
+		platform, err := ParsePlatform(str)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, platform)
+	}
+	return result, nil
+}
+
+// FormatPlatform formats platform as os/arch[/variant]
+func FormatPlatform(platform ocispec.Platform) string {
+	str := platform.OS + "/" + platform.Architecture
+	if platform.Variant != "" {
+		str += "/" + platform.Variant
+	}
+	return str
+}
+
+// MatchPlatform reports whether platform satisfies the wanted one, variant is
+// only compared when wanted
+func MatchPlatform(wanted ocispec.Platform, platform ocispec.Platform) bool {
+	if wanted.OS != platform.OS || wanted.Architecture != platform.Architecture {
+		return false
+	}
+	return wanted.Variant == "" || wanted.Variant == platform.Variant
+}
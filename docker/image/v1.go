@@ -0,0 +1,108 @@
+package image
+
+import (
+	"encoding/json"
+	"github.com/docker/docker/api/types/container"
+	"github.com/opencontainers/go-digest"
+	"time"
+)
+
+// V1Image is the legacy per-layer image configuration, stored as <v1 id>/json
+// in archives of docker save for pre v1.10 docker load
+type V1Image struct {
+	ID              string            `json:"id,omitempty"`
+	Parent          string            `json:"parent,omitempty"`
+	Comment         string            `json:"comment,omitempty"`
+	Created         *time.Time        `json:"created"`
+	Container       string            `json:"container,omitempty"`
+	ContainerConfig container.Config  `json:"container_config,omitempty"`
+	DockerVersion   string            `json:"docker_version,omitempty"`
+	Author          string            `json:"author,omitempty"`
+	Config          *container.Config `json:"config,omitempty"`
+	Architecture    string            `json:"architecture,omitempty"`
+	Variant         string            `json:"variant,omitempty"`
+	OS              string            `json:"os,omitempty"`
+	Size            int64             `json:",omitempty"`
+}
+
+// V1Layer is a layer of image in legacy format
+type V1Layer struct {
+	ID      digest.Digest
+	ChainID digest.Digest
+	Image   V1Image
+}
+
+// ChainID returns the chain ID of layer stack diffIDs
+func ChainID(diffIDs []digest.Digest) digest.Digest {
+	if len(diffIDs) == 0 {
+		return ""
+	}
+	chainID := diffIDs[0]
+	for _, diffID := range diffIDs[1:] {
+		chainID = digest.FromString(chainID.String() + " " + diffID.String())
+	}
+	return chainID
+}
+
+// V1Layers computes legacy layers of image the same way docker save does,
+// the top layer carries image configuration and lower ones are empty
+func (img *Image) V1Layers() ([]V1Layer, error) {
+	var top V1Image
+	if err := json.Unmarshal(img.rawJSON, &top); err != nil {
+		return nil, err
+	}
+
+	layers := []V1Layer{}
+	var parent digest.Digest
+	for i := range img.RootFS.DiffIDs {
+		epoch := time.Unix(0, 0).UTC()
+		v1Image := V1Image{Created: &epoch}
+		if i == len(img.RootFS.DiffIDs)-1 {
+			v1Image = top
+		}
+		chainID := ChainID(img.RootFS.DiffIDs[:i+1])
+		id, err := CreateV1ID(v1Image, chainID, parent)
+		if err != nil {
+			return nil, err
+		}
+		v1Image.ID = id.Encoded()
+		if parent != "" {
+			v1Image.Parent = parent.Encoded()
+		}
+		v1Image.OS = img.OS
+		layers = append(layers, V1Layer{ID: id, ChainID: chainID, Image: v1Image})
+		parent = id
+	}
+	return layers, nil
+}
+
+// CreateV1ID computes the legacy v1 ID of a layer from its config, chain ID
+// and v1 ID of parent layer
+func CreateV1ID(v1Image V1Image, chainID digest.Digest, parent digest.Digest) (digest.Digest, error) {
+	v1Image.ID = ""
+	v1JSON, err := json.Marshal(v1Image)
+	if err != nil {
+		return "", err
+	}
+	var config map[string]*json.RawMessage
+	if err := json.Unmarshal(v1JSON, &config); err != nil {
+		return "", err
+	}
+	config["layer_id"] = rawJSON(chainID)
+	if parent != "" {
+		config["parent"] = rawJSON(parent)
+	}
+	configJSON, err := json.Marshal(config)
+	if err != nil {
+		return "", err
+	}
+	return digest.FromBytes(configJSON), nil
+}
+
+func rawJSON(value interface{}) *json.RawMessage {
+	jsonval, err := json.Marshal(value)
+	if err != nil {
+		return nil
+	}
+	return (*json.RawMessage)(&jsonval)
+}
@@ -0,0 +1,100 @@
+package layer
+
+import (
+	"bufio"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/opencontainers/go-digest"
+	"io"
+	"os"
+)
+
+// Open opens layer file for reading its uncompressed tar stream, layer files
+// of docker save archives and OCI layouts may be compressed
+func Open(path string) (io.ReadCloser, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	stream, err := archive.DecompressStream(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+	return &layerReader{ReadCloser: stream, file: file}, nil
+}
+
+type layerReader struct {
+	io.ReadCloser
+	file *os.File
+}
+
+func (r *layerReader) Close() error {
+	err := r.ReadCloser.Close()
+	if fileErr := r.file.Close(); err == nil {
+		err = fileErr
+	}
+	return err
+}
+
+// Compression detects compression of layer file
+func Compression(path string) (archive.Compression, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return archive.Uncompressed, err
+	}
+	defer file.Close()
+	head, err := bufio.NewReader(file).Peek(10)
+	if err != nil && err != io.EOF {
+		return archive.Uncompressed, err
+	}
+	return archive.DetectCompression(head), nil
+}
+
+// UncompressedSize returns the size of uncompressed tar stream of layer file
+func UncompressedSize(path string) (int64, error) {
+	compression, err := Compression(path)
+	if err != nil {
+		return 0, err
+	}
+	if compression == archive.Uncompressed {
+		info, err := os.Stat(path)
+		if err != nil {
+			return 0, err
+		}
+		return info.Size(), nil
+	}
+
+	reader, err := Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer reader.Close()
+	return io.Copy(io.Discard, reader)
+}
+
+// Digests returns digest of layer file as is and digest of its uncompressed
+// tar stream, which is the diff ID of layer
+func Digests(path string) (digest.Digest, digest.Digest, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", "", err
+	}
+	defer file.Close()
+
+	raw := digest.Canonical.Digester()
+	tee := io.TeeReader(file, raw.Hash())
+	stream, err := archive.DecompressStream(tee)
+	if err != nil {
+		return "", "", err
+	}
+	defer stream.Close()
+	diff := digest.Canonical.Digester()
+	if _, err := io.Copy(diff.Hash(), stream); err != nil {
+		return "", "", err
+	}
+	// trailing data after compressed stream still counts for raw digest
+	if _, err := io.Copy(io.Discard, tee); err != nil {
+		return "", "", err
+	}
+	return raw.Digest(), diff.Digest(), nil
+}
@@ -0,0 +1,251 @@
+package layer
+
+import (
+	"archive/tar"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/pkg/errors"
+	"io"
+	"path"
+	"strings"
+	"time"
+)
+
+// Squash writes layers, ordered from the lowest, as a single uncompressed layer
+// tar to w. Files of lower layers replaced or removed by upper layers are
+// dropped, while whiteouts are kept to hide files of layers below the squashed
+// ones. Entries are written in layer order so that hard links follow targets,
+// a link target replaced by upper layers is written as the link instead.
+func Squash(layers []string, w io.Writer) error {
+	return squash(layers, w, true)
+}
+
+// Merge writes layers, ordered from the lowest, as the merged root filesystem
+// tar to w, which is Squash without whiteouts as no layer is left below.
+func Merge(layers []string, w io.Writer) error {
+	return squash(layers, w, false)
+}
+
+func squash(layers []string, w io.Writer, whiteouts bool) error {
+	plan, err := squashedEntries(layers)
+	if err != nil {
+		return err
+	}
+
+	tw := tar.NewWriter(w)
+	for i, layerPath := range layers {
+		err := walkLayer(layerPath, func(index int, hdr *tar.Header, tr *tar.Reader) error {
+			if !plan.kept[i][index] {
+				return nil
+			}
+			if !whiteouts && strings.HasPrefix(path.Base(cleanEntryName(hdr.Name)), archive.WhiteoutPrefix) {
+				return nil
+			}
+			if name, ok := plan.renamed[entryRef{i, index}]; ok {
+				if hdr.Typeflag == tar.TypeLink {
+					hdr.Linkname = name
+				} else {
+					hdr.Name = name
+				}
+			}
+			if err := tw.WriteHeader(hdr); err != nil {
+				return err
+			}
+			_, err := io.Copy(tw, tr)
+			return err
+		})
+		if err != nil {
+			return err
+		}
+		if !whiteouts {
+			continue
+		}
+		for _, dir := range plan.opaqueDirs[i] {
+			err := tw.WriteHeader(&tar.Header{
+				Typeflag: tar.TypeReg,
+				Name:     path.Join(dir, archive.WhiteoutOpaqueDir),
+				Mode:     0644,
+				ModTime:  time.Unix(0, 0),
+				Format:   tar.FormatPAX,
+			})
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+// squashState tracks paths set by layers above the one being walked
+type squashState struct {
+	// seen maps paths to whether they are directories, with their layers
+	seen      map[string]bool
+	seenLayer map[string]int
+	deleted   map[string]bool
+	opaque    map[string]bool
+}
+
+// removed tells whether p of a lower layer is removed by upper ones, or is
+// under a directory removed, made opaque or replaced by a file
+func (s *squashState) removed(p string) bool {
+	if s.deleted[p] {
+		return true
+	}
+	for dir := path.Dir(p); dir != "." && dir != "/"; dir = path.Dir(dir) {
+		if s.deleted[dir] || s.opaque[dir] {
+			return true
+		}
+		if isDir, ok := s.seen[dir]; ok && !isDir {
+			return true
+		}
+	}
+	return false
+}
+
+// entryRef locates an entry by layer and entry index
+type entryRef struct {
+	layer int
+	index int
+}
+
+// squashPlan tells entries to keep by layer and entry index, opaque whiteouts to
+// add to directories recreated after being removed, and names to give entries
+type squashPlan struct {
+	kept       [][]bool
+	opaqueDirs [][]string
+	renamed    map[entryRef]string
+}
+
+// hardLink is a kept hard link waiting for its target in lower layers
+type hardLink struct {
+	ref  entryRef
+	name string
+}
+
+// keepLinkTarget keeps target of hard links even if replaced or removed by
+// upper layers, as the first link in place of it, which other links then refer
+// to, as overlay filesystems break links on copy-up
+func (p *squashPlan) keepLinkTarget(target entryRef, hdr *tar.Header, links []hardLink) {
+	if p.kept[target.layer][target.index] || hdr.Typeflag != tar.TypeReg {
+		return
+	}
+	p.kept[target.layer][target.index] = true
+	p.renamed[target] = links[0].name
+	p.kept[links[0].ref.layer][links[0].ref.index] = false
+	for _, link := range links[1:] {
+		p.renamed[link.ref] = links[0].name
+	}
+}
+
+// squashedEntries walks layers from the top to plan entries to write
+func squashedEntries(layers []string) (*squashPlan, error) {
+	plan := &squashPlan{kept: make([][]bool, len(layers)), opaqueDirs: make([][]string, len(layers)), renamed: map[entryRef]string{}}
+	kept, opaqueDirs := plan.kept, plan.opaqueDirs
+	state := &squashState{seen: map[string]bool{}, seenLayer: map[string]int{}, deleted: map[string]bool{}, opaque: map[string]bool{}}
+	pendingLinks := map[string][]hardLink{}
+
+	for i := len(layers) - 1; i >= 0; i-- {
+		seen := map[string]bool{}
+		deleted := map[string]bool{}
+		opaque := map[string]bool{}
+		headers := map[string]*tar.Header{}
+		indexes := map[string]int{}
+		links := map[string][]hardLink{}
+		err := walkLayer(layers[i], func(index int, hdr *tar.Header, _ *tar.Reader) error {
+			name := cleanEntryName(hdr.Name)
+			base := path.Base(name)
+			keep := false
+			switch {
+			case base == archive.WhiteoutOpaqueDir:
+				// hides directory contents of layers below the squashed ones,
+				// even if upper layers add to the directory
+				dir := path.Dir(name)
+				isDir, ok := state.seen[dir]
+				keep = !state.removed(dir) && !state.opaque[dir] && (!ok || isDir)
+				opaque[dir] = true
+			case strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+				// aufs metadata is never applied
+			case strings.HasPrefix(base, archive.WhiteoutPrefix):
+				target := path.Join(path.Dir(name), strings.TrimPrefix(base, archive.WhiteoutPrefix))
+				if isDir, ok := state.seen[target]; ok {
+					// recreated above, a directory must not show contents
+					// of layers below the squashed ones
+					if isDir && !state.opaque[target] {
+						layer := state.seenLayer[target]
+						opaqueDirs[layer] = append(opaqueDirs[layer], target)
+						state.opaque[target] = true
+					}
+				} else {
+					keep = !state.removed(target)
+				}
+				deleted[target] = true
+			default:
+				_, replaced := state.seen[name]
+				keep = !replaced && !state.removed(name)
+				if keep {
+					seen[name] = hdr.Typeflag == tar.TypeDir
+				}
+				headers[name] = hdr
+				indexes[name] = index
+				if keep && hdr.Typeflag == tar.TypeLink {
+					target := cleanEntryName(hdr.Linkname)
+					links[target] = append(links[target], hardLink{ref: entryRef{i, index}, name: hdr.Name})
+				}
+			}
+			kept[i] = append(kept[i], keep)
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read layer %s", layers[i])
+		}
+		// links of upper layers refer to the nearest layer having their targets
+		for target, pending := range pendingLinks {
+			if hdr, ok := headers[target]; ok {
+				plan.keepLinkTarget(entryRef{i, indexes[target]}, hdr, pending)
+				delete(pendingLinks, target)
+			}
+		}
+		for target, layerLinks := range links {
+			if hdr, ok := headers[target]; ok {
+				plan.keepLinkTarget(entryRef{i, indexes[target]}, hdr, layerLinks)
+			} else {
+				pendingLinks[target] = append(pendingLinks[target], layerLinks...)
+			}
+		}
+		for p, isDir := range seen {
+			state.seen[p] = isDir
+			state.seenLayer[p] = i
+		}
+		for p := range deleted {
+			state.deleted[p] = true
+		}
+		for p := range opaque {
+			state.opaque[p] = true
+		}
+	}
+	return plan, nil
+}
+
+func walkLayer(layerPath string, fn func(index int, hdr *tar.Header, tr *tar.Reader) error) error {
+	reader, err := Open(layerPath)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	for index := 0; ; index++ {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(index, hdr, tr); err != nil {
+			return err
+		}
+	}
+}
+
+func cleanEntryName(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
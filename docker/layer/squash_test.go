@@ -0,0 +1,163 @@
+package layer_test
+
+import (
+	"archive/tar"
+	"bytes"
+	"docker-save/docker/layer"
+	"io"
+	"os"
+	"reflect"
+	"testing"
+)
+
+// entry is a tar entry of a test layer, a directory if name ends with /, a
+// hard link if link is set
+type entry struct {
+	name    string
+	content string
+	link    string
+}
+
+func writeLayer(t *testing.T, dir string, entries []entry) string {
+	t.Helper()
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, e := range entries {
+		hdr := &tar.Header{Name: e.name, Mode: 0644, Typeflag: tar.TypeReg, Size: int64(len(e.content))}
+		switch {
+		case e.link != "":
+			hdr.Typeflag, hdr.Linkname, hdr.Size = tar.TypeLink, e.link, 0
+		case e.name[len(e.name)-1] == '/':
+			hdr.Typeflag, hdr.Mode = tar.TypeDir, 0755
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	file, err := os.CreateTemp(dir, "layer-*.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err := file.Write(buf.Bytes()); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+// readEntries lists entries of tar stream as name=content, name=>link for hard
+// links and name/ for directories
+func readEntries(t *testing.T, r io.Reader) []string {
+	t.Helper()
+	entries := []string{}
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return entries
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch hdr.Typeflag {
+		case tar.TypeDir:
+			entries = append(entries, hdr.Name)
+		case tar.TypeLink:
+			entries = append(entries, hdr.Name+"=>"+hdr.Linkname)
+		default:
+			content, err := io.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			entries = append(entries, hdr.Name+"="+string(content))
+		}
+	}
+}
+
+func TestSquashAndMerge(t *testing.T) {
+	tests := []struct {
+		name     string
+		layers   [][]entry
+		squashed []string
+		merged   []string
+	}{
+		{
+			name:     "upper file replaces lower",
+			layers:   [][]entry{{{name: "a", content: "1"}, {name: "b", content: "1"}}, {{name: "a", content: "2"}}},
+			squashed: []string{"b=1", "a=2"},
+			merged:   []string{"b=1", "a=2"},
+		},
+		{
+			name:     "whiteout removes lower file",
+			layers:   [][]entry{{{name: "a", content: "1"}, {name: "b", content: "1"}}, {{name: ".wh.a"}}},
+			squashed: []string{"b=1", ".wh.a="},
+			merged:   []string{"b=1"},
+		},
+		{
+			name: "opaque directory hides lower contents",
+			layers: [][]entry{
+				{{name: "d/"}, {name: "d/x", content: "1"}},
+				{{name: "d/"}, {name: "d/.wh..wh..opq"}, {name: "d/y", content: "2"}},
+			},
+			squashed: []string{"d/", "d/.wh..wh..opq=", "d/y=2"},
+			merged:   []string{"d/", "d/y=2"},
+		},
+		{
+			name: "directory removed and recreated",
+			layers: [][]entry{
+				{{name: "d/"}, {name: "d/x", content: "1"}},
+				{{name: ".wh.d"}},
+				{{name: "d/"}, {name: "d/y", content: "2"}},
+			},
+			squashed: []string{"d/", "d/y=2", "d/.wh..wh..opq="},
+			merged:   []string{"d/", "d/y=2"},
+		},
+		{
+			name:     "hard link to lower target",
+			layers:   [][]entry{{{name: "a", content: "1"}}, {{name: "l", link: "a"}}},
+			squashed: []string{"a=1", "l=>a"},
+			merged:   []string{"a=1", "l=>a"},
+		},
+		{
+			name:     "hard link target replaced",
+			layers:   [][]entry{{{name: "a", content: "1"}, {name: "l", link: "a"}, {name: "m", link: "a"}}, {{name: "a", content: "2"}}},
+			squashed: []string{"l=1", "m=>l", "a=2"},
+			merged:   []string{"l=1", "m=>l", "a=2"},
+		},
+		{
+			name:     "hard link target removed",
+			layers:   [][]entry{{{name: "a", content: "1"}}, {{name: "l", link: "a"}, {name: ".wh.a"}}},
+			squashed: []string{"l=1", ".wh.a="},
+			merged:   []string{"l=1"},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			layers := []string{}
+			for _, entries := range tt.layers {
+				layers = append(layers, writeLayer(t, dir, entries))
+			}
+			var buf bytes.Buffer
+			if err := layer.Squash(layers, &buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := readEntries(t, &buf); !reflect.DeepEqual(got, tt.squashed) {
+				t.Errorf("squashed %q, want %q", got, tt.squashed)
+			}
+			buf.Reset()
+			if err := layer.Merge(layers, &buf); err != nil {
+				t.Fatal(err)
+			}
+			if got := readEntries(t, &buf); !reflect.DeepEqual(got, tt.merged) {
+				t.Errorf("merged %q, want %q", got, tt.merged)
+			}
+		})
+	}
+}
@@ -0,0 +1,253 @@
+package policy
+
+import (
+	"bytes"
+	"docker-save/docker/image"
+	"fmt"
+	"github.com/distribution/reference"
+	"github.com/docker/go-units"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v3"
+	"os"
+	"path"
+	"strings"
+)
+
+// names of rules of a policy
+const (
+	RuleMaxTotalSize   = "max-total-size"
+	RuleMaxLayerSize   = "max-layer-size"
+	RuleMaxLayers      = "max-layers"
+	RuleForbiddenBases = "forbidden-bases"
+	RuleRequiredLabels = "required-labels"
+	RuleNonRootUser    = "non-root-user"
+)
+
+// BaseNameLabel is the OCI annotation of the base image name, recorded as label
+// by docker buildx and most CI tooling
+const BaseNameLabel = "org.opencontainers.image.base.name"
+
+// Policy is a set of rules images must follow, unset rules are not evaluated
+type Policy struct {
+	// MaxTotalSize is the maximum sum of uncompressed layer sizes, e.g. 500MB
+	MaxTotalSize string `yaml:"maxTotalSize"`
+	// MaxLayerSize is the maximum uncompressed size of each layer, e.g. 200MB
+	MaxLayerSize string `yaml:"maxLayerSize"`
+	MaxLayers    int    `yaml:"maxLayers"`
+	// ForbiddenBases are names or globs of base images, e.g. centos:7 or debian:stretch*
+	ForbiddenBases []string `yaml:"forbiddenBases"`
+	// RequiredLabels are label keys, or key=value for an exact value
+	RequiredLabels []string `yaml:"requiredLabels"`
+	// NonRootUser requires the config User to be set to a user other than root
+	NonRootUser bool `yaml:"nonRootUser"`
+
+	maxTotalSize int64
+	maxLayerSize int64
+}
+
+// Subject is an image a policy is evaluated against
+type Subject struct {
+	Image *image.Image
+	// LayerSizes are sizes of layers in order, -1 for layers absent from a
+	// partial archive
+	LayerSizes []int64
+	// BaseLayers are diff IDs of forbidden bases resolved by name, for finding
+	// bases by layers when the image does not label them
+	BaseLayers map[string][]digest.Digest
+}
+
+// Result is the outcome of a rule
+type Result struct {
+	Rule   string
+	Passed bool
+	Detail string
+}
+
+// Load reads a policy from a YAML file, unknown keys are rejected as they are
+// most likely misspelled rules
+func Load(file string) (*Policy, error) {
+	content, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	p := &Policy{}
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(p); err != nil {
+		return nil, errors.Wrapf(err, "invalid policy %s", file)
+	}
+	if p.MaxTotalSize != "" {
+		if p.maxTotalSize, err = units.FromHumanSize(p.MaxTotalSize); err != nil {
+			return nil, errors.Wrap(err, "invalid maxTotalSize")
+		}
+	}
+	if p.MaxLayerSize != "" {
+		if p.maxLayerSize, err = units.FromHumanSize(p.MaxLayerSize); err != nil {
+			return nil, errors.Wrap(err, "invalid maxLayerSize")
+		}
+	}
+	if p.MaxLayers < 0 {
+		return nil, errors.New("invalid maxLayers, must not be negative")
+	}
+	for _, base := range p.ForbiddenBases {
+		if _, err := path.Match(base, ""); err != nil {
+			return nil, errors.Wrapf(err, "invalid forbiddenBases %q", base)
+		}
+	}
+	return p, nil
+}
+
+// Evaluate evaluates rules of policy against subject, in the order of rules
+// documented
+func (p *Policy) Evaluate(subject Subject) []Result {
+	results := []Result{}
+	if p.maxTotalSize > 0 {
+		results = append(results, p.checkTotalSize(subject.LayerSizes))
+	}
+	if p.maxLayerSize > 0 {
+		results = append(results, p.checkLayerSize(subject.LayerSizes))
+	}
+	if p.MaxLayers > 0 {
+		count := len(subject.LayerSizes)
+		results = append(results, Result{
+			Rule:   RuleMaxLayers,
+			Passed: count <= p.MaxLayers,
+			Detail: fmt.Sprintf("%d layers, limit %d", count, p.MaxLayers),
+		})
+	}
+	labels := map[string]string{}
+	user := ""
+	if subject.Image.Config != nil {
+		labels = subject.Image.Config.Labels
+		user = subject.Image.Config.User
+	}
+	if len(p.ForbiddenBases) > 0 {
+		results = append(results, p.checkBases(labels, subject.Image.RootFS.DiffIDs, subject.BaseLayers))
+	}
+	if len(p.RequiredLabels) > 0 {
+		results = append(results, p.checkLabels(labels))
+	}
+	if p.NonRootUser {
+		result := Result{Rule: RuleNonRootUser, Passed: !IsRootUser(user), Detail: fmt.Sprintf("user %q", user)}
+		if user == "" {
+			result.Detail = "user not set, runs as root"
+		}
+		results = append(results, result)
+	}
+	return results
+}
+
+// Passed tells whether all results passed
+func Passed(results []Result) bool {
+	for _, result := range results {
+		if !result.Passed {
+			return false
+		}
+	}
+	return true
+}
+
+// IsRootUser tells whether user, in user[:group] format, is root, an unset
+// user defaults to root
+func IsRootUser(user string) bool {
+	name, _, _ := strings.Cut(user, ":")
+	return name == "" || name == "root" || name == "0"
+}
+
+func (p *Policy) checkTotalSize(sizes []int64) Result {
+	total, absent := int64(0), 0
+	for _, size := range sizes {
+		if size < 0 {
+			absent++
+			continue
+		}
+		total += size
+	}
+	detail := fmt.Sprintf("total %s, limit %s", units.HumanSize(float64(total)), units.HumanSize(float64(p.maxTotalSize)))
+	if absent > 0 {
+		detail += fmt.Sprintf(", %d absent layers not counted", absent)
+	}
+	return Result{Rule: RuleMaxTotalSize, Passed: total <= p.maxTotalSize, Detail: detail}
+}
+
+func (p *Policy) checkLayerSize(sizes []int64) Result {
+	exceeded := []string{}
+	for i, size := range sizes {
+		if size > p.maxLayerSize {
+			exceeded = append(exceeded, fmt.Sprintf("layer %d %s", i+1, units.HumanSize(float64(size))))
+		}
+	}
+	limit := units.HumanSize(float64(p.maxLayerSize))
+	if len(exceeded) > 0 {
+		return Result{Rule: RuleMaxLayerSize, Detail: strings.Join(exceeded, ", ") + ", limit " + limit}
+	}
+	return Result{Rule: RuleMaxLayerSize, Passed: true, Detail: "all layers within " + limit}
+}
+
+// checkBases finds forbidden bases by the base name label, or by layers of
+// bases resolved
+func (p *Policy) checkBases(labels map[string]string, diffIDs []digest.Digest, baseLayers map[string][]digest.Digest) Result {
+	found := []string{}
+	name := labels[BaseNameLabel]
+	for _, base := range p.ForbiddenBases {
+		switch {
+		case name != "" && matchBaseName(base, name):
+			found = append(found, fmt.Sprintf("%s (by label %s)", base, name))
+		case hasLayerPrefix(diffIDs, baseLayers[base]):
+			found = append(found, fmt.Sprintf("%s (by layers)", base))
+		}
+	}
+	if len(found) > 0 {
+		return Result{Rule: RuleForbiddenBases, Detail: "based on " + strings.Join(found, ", ")}
+	}
+	detail := "no forbidden base found"
+	if name != "" {
+		detail = "based on " + name
+	}
+	return Result{Rule: RuleForbiddenBases, Passed: true, Detail: detail}
+}
+
+func (p *Policy) checkLabels(labels map[string]string) Result {
+	missing := []string{}
+	for _, required := range p.RequiredLabels {
+		key, value, exact := strings.Cut(required, "=")
+		actual, ok := labels[key]
+		if !ok || (exact && actual != value) {
+			missing = append(missing, required)
+		}
+	}
+	if len(missing) > 0 {
+		return Result{Rule: RuleRequiredLabels, Detail: "missing " + strings.Join(missing, ", ")}
+	}
+	return Result{Rule: RuleRequiredLabels, Passed: true, Detail: fmt.Sprintf("all %d labels present", len(p.RequiredLabels))}
+}
+
+// matchBaseName matches name of base as given and in its familiar form, e.g.
+// docker.io/library/centos:7 as centos:7
+func matchBaseName(pattern string, name string) bool {
+	names := []string{name}
+	if named, err := reference.ParseNormalizedNamed(name); err == nil {
+		names = append(names, reference.FamiliarString(named), named.String())
+	}
+	for _, n := range names {
+		if matched, _ := path.Match(pattern, n); matched {
+			return true
+		}
+	}
+	return false
+}
+
+// hasLayerPrefix tells whether layers start with all base layers, an empty base
+// never matches
+func hasLayerPrefix(layers []digest.Digest, base []digest.Digest) bool {
+	if len(base) == 0 || len(base) > len(layers) {
+		return false
+	}
+	for i := range base {
+		if layers[i] != base[i] {
+			return false
+		}
+	}
+	return true
+}
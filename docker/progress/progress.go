@@ -0,0 +1,225 @@
+package progress
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/docker/go-units"
+	"github.com/pkg/errors"
+	"golang.org/x/exp/slices"
+	"io"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Modes of reporting progress
+const (
+	ModeAuto  = "auto"
+	ModeTTY   = "tty"
+	ModePlain = "plain"
+	ModeJSON  = "json"
+	ModeQuiet = "quiet"
+)
+
+const (
+	ttyInterval   = 200 * time.Millisecond
+	plainInterval = 10 * time.Second
+	barWidth      = 30
+)
+
+// Reporter reports progress of phases like export and write to out
+type Reporter struct {
+	out      io.Writer
+	mode     string
+	interval time.Duration
+	mu       sync.Mutex
+	// active trackers drawn one line each in tty mode, lines is the number of
+	// lines drawn last time
+	active []*Tracker
+	lines  int
+}
+
+// New creates a reporter of mode, auto mode draws bars if out is a terminal
+// and prints log lines otherwise
+func New(out io.Writer, mode string, terminal bool) (*Reporter, error) {
+	switch mode {
+	case ModeAuto:
+		mode = ModePlain
+		if terminal {
+			mode = ModeTTY
+		}
+	case ModeTTY, ModePlain, ModeJSON, ModeQuiet:
+	default:
+		return nil, errors.Errorf("invalid progress mode %q, must be one of auto, tty, plain and json", mode)
+	}
+	interval := plainInterval
+	if mode == ModeTTY {
+		interval = ttyInterval
+	}
+	return &Reporter{out: out, mode: mode, interval: interval}, nil
+}
+
+type reporterKey struct{}
+
+// WithReporter returns ctx carrying r
+func WithReporter(ctx context.Context, r *Reporter) context.Context {
+	return context.WithValue(ctx, reporterKey{}, r)
+}
+
+// FromContext returns reporter carried by ctx, which reports nothing if none
+func FromContext(ctx context.Context) *Reporter {
+	if r, ok := ctx.Value(reporterKey{}).(*Reporter); ok {
+		return r
+	}
+	return &Reporter{mode: ModeQuiet}
+}
+
+// Tracker tracks bytes processed by a phase, reported periodically until Done
+type Tracker struct {
+	reporter *Reporter
+	phase    string
+	name     string
+	total    int64
+	current  atomic.Int64
+	start    time.Time
+	stop     chan struct{}
+	done     sync.Once
+	wg       sync.WaitGroup
+}
+
+// Start starts tracking phase of name, total is the expected number of bytes
+// or 0 if unknown
+func (r *Reporter) Start(phase string, name string, total int64) *Tracker {
+	t := &Tracker{reporter: r, phase: phase, name: name, total: total, start: time.Now(), stop: make(chan struct{})}
+	if r.mode == ModeQuiet {
+		return t
+	}
+	if r.mode == ModeTTY {
+		r.mu.Lock()
+		r.active = append(r.active, t)
+		r.mu.Unlock()
+	}
+	t.wg.Add(1)
+	go func() {
+		defer t.wg.Done()
+		ticker := time.NewTicker(r.interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				r.report(t, false)
+			case <-t.stop:
+				return
+			}
+		}
+	}()
+	return t
+}
+
+// Add counts n more bytes processed
+func (t *Tracker) Add(n int64) {
+	t.current.Add(n)
+}
+
+// Reader returns a reader counting bytes read from r
+func (t *Tracker) Reader(r io.Reader) io.Reader {
+	return &countingReader{Reader: r, tracker: t}
+}
+
+// Done stops tracking and reports the final state
+func (t *Tracker) Done() {
+	t.done.Do(func() {
+		close(t.stop)
+		t.wg.Wait()
+		if t.reporter.mode != ModeQuiet {
+			t.reporter.report(t, true)
+		}
+	})
+}
+
+type countingReader struct {
+	io.Reader
+	tracker *Tracker
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.tracker.Add(int64(n))
+	return n, err
+}
+
+type event struct {
+	Phase   string  `json:"phase"`
+	Name    string  `json:"name"`
+	Current int64   `json:"current"`
+	Total   int64   `json:"total,omitempty"`
+	Rate    int64   `json:"rate"`
+	Elapsed float64 `json:"elapsed"`
+	Done    bool    `json:"done"`
+}
+
+func (t *Tracker) event(done bool) event {
+	elapsed := time.Since(t.start)
+	e := event{Phase: t.phase, Name: t.name, Current: t.current.Load(), Total: t.total, Elapsed: elapsed.Seconds(), Done: done}
+	if elapsed > 0 {
+		e.Rate = int64(float64(e.Current) / elapsed.Seconds())
+	}
+	return e
+}
+
+func (r *Reporter) report(t *Tracker, done bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch r.mode {
+	case ModeJSON:
+		content, _ := json.Marshal(t.event(done))
+		fmt.Fprintf(r.out, "%s\n", content)
+	case ModeTTY:
+		r.draw(t, done)
+	default:
+		fmt.Fprintln(r.out, formatEvent(t.event(done), false))
+	}
+}
+
+// draw redraws bars of all active trackers below lines printed before, so
+// concurrent trackers don't overwrite each other, a done tracker is printed
+// once above them and no longer redrawn
+func (r *Reporter) draw(t *Tracker, done bool) {
+	if r.lines > 0 {
+		fmt.Fprintf(r.out, "\x1b[%dA\x1b[J", r.lines)
+	}
+	if done {
+		fmt.Fprintln(r.out, formatEvent(t.event(true), true))
+		if i := slices.Index(r.active, t); i >= 0 {
+			r.active = slices.Delete(r.active, i, i+1)
+		}
+	}
+	for _, active := range r.active {
+		fmt.Fprintln(r.out, formatEvent(active.event(false), true))
+	}
+	r.lines = len(r.active)
+}
+
+func formatEvent(e event, bar bool) string {
+	size := func(n int64) string {
+		return units.HumanSizeWithPrecision(float64(n), 3)
+	}
+	line := fmt.Sprintf("%s %s:", e.Phase, e.Name)
+	if e.Total > 0 {
+		percent := min(100, e.Current*100/e.Total)
+		if bar {
+			filled := int(percent) * barWidth / 100
+			line += fmt.Sprintf(" [%s%s]", strings.Repeat("=", filled), strings.Repeat(" ", barWidth-filled))
+		}
+		line += fmt.Sprintf(" %s/%s (%d%%)", size(e.Current), size(e.Total), percent)
+	} else {
+		line += " " + size(e.Current)
+	}
+	line += fmt.Sprintf(", %s/s", size(e.Rate))
+	if e.Done {
+		line += fmt.Sprintf(", done in %s", time.Duration(e.Elapsed*float64(time.Second)).Round(time.Millisecond))
+	}
+	return line
+}
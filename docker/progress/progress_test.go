@@ -0,0 +1,41 @@
+package progress
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTTYConcurrentTrackers(t *testing.T) {
+	out := &bytes.Buffer{}
+	r, err := New(out, ModeTTY, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// bars are drawn by the test only
+	r.interval = time.Hour
+	first := r.Start("export", "app:1.0", 10)
+	second := r.Start("export", "web:2.0", 10)
+	first.Add(10)
+	second.Add(5)
+	r.report(second, false)
+	if got := strings.Count(out.String(), "\n"); got != 2 {
+		t.Fatalf("%d lines drawn for 2 trackers: %q", got, out.String())
+	}
+
+	first.Done()
+	if !strings.Contains(out.String(), "\x1b[2A\x1b[J") {
+		t.Errorf("bars of 2 trackers not redrawn: %q", out.String())
+	}
+	second.Add(5)
+	second.Done()
+	for _, name := range []string{"app:1.0", "web:2.0"} {
+		if !strings.Contains(out.String(), "export "+name+": [") || !strings.Contains(out.String(), "done in") {
+			t.Errorf("final line of %s missing: %q", name, out.String())
+		}
+	}
+	if r.lines != 0 || len(r.active) != 0 {
+		t.Errorf("%d lines of %d trackers left drawn", r.lines, len(r.active))
+	}
+}
@@ -0,0 +1,239 @@
+package registry
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/pkg/errors"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+)
+
+const (
+	dockerHubHost    = "docker.io"
+	dockerHubAPIHost = "registry-1.docker.io"
+
+	// insecureRegistriesEnv lists comma separated registry hosts accessed via plain http
+	insecureRegistriesEnv = "DOCKER_SAVE_INSECURE_REGISTRIES"
+)
+
+// Credentials used to authenticate against a registry
+type Credentials struct {
+	Username      string
+	Password      string
+	IdentityToken string
+}
+
+// Client talks to a single registry host through the distribution HTTP API
+type Client struct {
+	host        string
+	baseURL     string
+	credentials Credentials
+	client      *http.Client
+
+	mu     sync.Mutex
+	tokens map[string]string
+}
+
+// NewClient creates a registry client for host, localhost registries and
+// hosts listed in DOCKER_SAVE_INSECURE_REGISTRIES are accessed via http
+func NewClient(host string, credentials Credentials) *Client {
+	apiHost := host
+	if host == dockerHubHost {
+		apiHost = dockerHubAPIHost
+	}
+	scheme := "https"
+	if isInsecureHost(host) {
+		scheme = "http"
+	}
+	return &Client{
+		host:        host,
+		baseURL:     scheme + "://" + apiHost,
+		credentials: credentials,
+		client:      &http.Client{Transport: http.DefaultTransport},
+		tokens:      map[string]string{},
+	}
+}
+
+// Host returns the registry host this client talks to
+func (c *Client) Host() string {
+	return c.host
+}
+
+func isInsecureHost(host string) bool {
+	for _, insecure := range strings.Split(os.Getenv(insecureRegistriesEnv), ",") {
+		if strings.TrimSpace(insecure) == host {
+			return true
+		}
+	}
+	hostname := host
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		hostname = h
+	}
+	if hostname == "localhost" {
+		return true
+	}
+	ip := net.ParseIP(hostname)
+	return ip != nil && ip.IsLoopback()
+}
+
+func pullScope(repo string) string {
+	return fmt.Sprintf("repository:%s:pull", repo)
+}
+
+func pushScope(repo string) string {
+	return fmt.Sprintf("repository:%s:pull,push", repo)
+}
+
+func (c *Client) url(format string, args ...interface{}) string {
+	return c.baseURL + fmt.Sprintf(format, args...)
+}
+
+// do sends request with authorization for scope, answering one auth challenge
+func (c *Client) do(ctx context.Context, req *http.Request, scope string) (*http.Response, error) {
+	req = req.WithContext(ctx)
+	c.authorize(req, scope)
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusUnauthorized {
+		return resp, nil
+	}
+
+	challenge := resp.Header.Get("WWW-Authenticate")
+	resp.Body.Close()
+	if err := c.authenticate(ctx, challenge, scope); err != nil {
+		return nil, err
+	}
+
+	retry := req.Clone(ctx)
+	if req.Body != nil && req.Body != http.NoBody {
+		if req.GetBody == nil {
+			return nil, errors.Errorf("%s %s: unauthorized", req.Method, req.URL.Redacted())
+		}
+		if retry.Body, err = req.GetBody(); err != nil {
+			return nil, err
+		}
+	}
+	c.authorize(retry, scope)
+	return c.client.Do(retry)
+}
+
+func (c *Client) authorize(req *http.Request, scope string) {
+	c.mu.Lock()
+	token, ok := c.tokens[scope]
+	c.mu.Unlock()
+	if ok {
+		req.Header.Set("Authorization", token)
+	}
+}
+
+// authenticate answers a Basic or Bearer challenge and caches the authorization for scope
+func (c *Client) authenticate(ctx context.Context, challenge string, scope string) error {
+	authType, params := parseChallenge(challenge)
+	switch strings.ToLower(authType) {
+	case "basic":
+		if c.credentials.Username == "" {
+			return errors.Errorf("registry %s requires credentials, run docker login first", c.host)
+		}
+		req, _ := http.NewRequest(http.MethodGet, "", nil)
+		req.SetBasicAuth(c.credentials.Username, c.credentials.Password)
+		c.setToken(scope, req.Header.Get("Authorization"))
+		return nil
+	case "bearer":
+		token, err := c.fetchToken(ctx, params, scope)
+		if err != nil {
+			return err
+		}
+		c.setToken(scope, "Bearer "+token)
+		return nil
+	default:
+		return errors.Errorf("registry %s: unsupported auth challenge %q", c.host, challenge)
+	}
+}
+
+func (c *Client) setToken(scope string, token string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.tokens[scope] = token
+}
+
+func (c *Client) fetchToken(ctx context.Context, params map[string]string, scope string) (string, error) {
+	realm, err := url.Parse(params["realm"])
+	if err != nil || params["realm"] == "" {
+		return "", errors.Errorf("registry %s: invalid token realm %q", c.host, params["realm"])
+	}
+	query := realm.Query()
+	if service, ok := params["service"]; ok {
+		query.Set("service", service)
+	}
+	for _, s := range strings.Fields(scope) {
+		query.Add("scope", s)
+	}
+	realm.RawQuery = query.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, realm.String(), nil)
+	if err != nil {
+		return "", err
+	}
+	if c.credentials.IdentityToken != "" {
+		req.Header.Set("Authorization", "Bearer "+c.credentials.IdentityToken)
+	} else if c.credentials.Username != "" {
+		req.SetBasicAuth(c.credentials.Username, c.credentials.Password)
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return "", newStatusError(resp, "fetch token")
+	}
+
+	var tokenResponse struct {
+		Token       string `json:"token"`
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResponse); err != nil {
+		return "", errors.Wrap(err, "decode token response")
+	}
+	if tokenResponse.Token != "" {
+		return tokenResponse.Token, nil
+	}
+	return tokenResponse.AccessToken, nil
+}
+
+// parseChallenge parses a WWW-Authenticate header like
+// Bearer realm="https://auth.docker.io/token",service="registry.docker.io"
+func parseChallenge(challenge string) (string, map[string]string) {
+	params := map[string]string{}
+	authType, rest, _ := strings.Cut(strings.TrimSpace(challenge), " ")
+	for rest != "" {
+		var key, value string
+		key, rest, _ = strings.Cut(strings.TrimLeft(rest, " ,"), "=")
+		if strings.HasPrefix(rest, `"`) {
+			value, rest, _ = strings.Cut(rest[1:], `"`)
+		} else {
+			value, rest, _ = strings.Cut(rest, ",")
+		}
+		if key = strings.TrimSpace(key); key != "" {
+			params[strings.ToLower(key)] = value
+		}
+	}
+	return authType, params
+}
+
+func newStatusError(resp *http.Response, action string) error {
+	body, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+	msg := strings.TrimSpace(string(body))
+	if msg == "" {
+		msg = http.StatusText(resp.StatusCode)
+	}
+	return errors.Errorf("%s %s: %s (%d)", action, resp.Request.URL.Redacted(), msg, resp.StatusCode)
+}
@@ -0,0 +1,115 @@
+package registry_test
+
+import (
+	"bytes"
+	"context"
+	"docker-save/docker/image"
+	"docker-save/docker/registry"
+	"docker-save/docker/registry/registrytest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"testing"
+)
+
+var (
+	amd64 = ocispec.Platform{OS: "linux", Architecture: "amd64"}
+	arm64 = ocispec.Platform{OS: "linux", Architecture: "arm64", Variant: "v8"}
+)
+
+func TestResolveImageSelectsPlatformOfIndex(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	amd := r.AddImage("app", "", amd64, []byte("amd64 layer"))
+	arm := r.AddImage("app", "", arm64, []byte("arm64 base"), []byte("arm64 app"))
+	r.AddIndex("app", "1.0", amd, arm)
+
+	ref, err := registry.ParseReference(r.Host() + "/app:1.0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := registry.NewClient(r.Host(), registry.Credentials{})
+	tests := []struct {
+		platform ocispec.Platform
+		want     registrytest.Image
+	}{
+		{amd64, amd},
+		{ocispec.Platform{OS: "linux", Architecture: "arm64"}, arm},
+	}
+	for _, tt := range tests {
+		t.Run(image.FormatPlatform(tt.platform), func(t *testing.T) {
+			img, err := client.ResolveImage(context.Background(), ref, tt.platform)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if img.Descriptor.Digest != tt.want.Descriptor.Digest {
+				t.Errorf("manifest %s, want %s", img.Descriptor.Digest, tt.want.Descriptor.Digest)
+			}
+			config, err := image.NewFromJSON(img.Config)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(config.RootFS.DiffIDs) != len(tt.want.DiffIDs) || config.RootFS.DiffIDs[0] != tt.want.DiffIDs[0] {
+				t.Errorf("diff IDs %v, want %v", config.RootFS.DiffIDs, tt.want.DiffIDs)
+			}
+		})
+	}
+
+	if _, err := client.ResolveImage(context.Background(), ref, ocispec.Platform{OS: "windows", Architecture: "amd64"}); err == nil {
+		t.Error("resolved an image for a platform not in index")
+	}
+}
+
+func TestResolveImageOfSingleManifest(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	want := r.AddImage("team/app", "1.0", amd64, []byte("layer"))
+
+	ref, _ := registry.ParseReference(r.Host() + "/team/app@" + want.Descriptor.Digest.String())
+	img, err := registry.NewClient(r.Host(), registry.Credentials{}).ResolveImage(context.Background(), ref, amd64)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if img.Manifest.Layers[0].Digest != want.Manifest.Layers[0].Digest {
+		t.Errorf("layer %s, want %s", img.Manifest.Layers[0].Digest, want.Manifest.Layers[0].Digest)
+	}
+	if img.Size() != want.Manifest.Config.Size+want.Manifest.Layers[0].Size {
+		t.Errorf("size %d, want config and layer sizes", img.Size())
+	}
+}
+
+func TestGetBlob(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	dgst := r.AddBlob("app", []byte("content"))
+	client := registry.NewClient(r.Host(), registry.Credentials{})
+
+	blob, size, err := client.GetBlob(context.Background(), "app", dgst)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer blob.Close()
+	content, _ := io.ReadAll(blob)
+	if !bytes.Equal(content, []byte("content")) || size != int64(len(content)) {
+		t.Errorf("blob %q of size %d", content, size)
+	}
+	if _, _, err := client.GetBlob(context.Background(), "other", dgst); err == nil {
+		t.Error("read a blob of another repository")
+	}
+}
+
+func TestTokenFetchedOncePerScope(t *testing.T) {
+	r := registrytest.New()
+	defer r.Close()
+	r.RequireToken = true
+	dgst := r.AddBlob("app", []byte("config"))
+	client := registry.NewClient(r.Host(), registry.Credentials{})
+
+	for i := 0; i < 3; i++ {
+		if _, err := client.ReadBlob(context.Background(), "app", dgst); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if r.Tokens() != 1 {
+		t.Errorf("fetched %d tokens, want 1", r.Tokens())
+	}
+}
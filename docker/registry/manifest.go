@@ -0,0 +1,181 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"docker-save/docker/image"
+	"encoding/json"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"runtime"
+	"strconv"
+)
+
+// Media types of docker distribution manifests, OCI ones are in ocispec
+const (
+	MediaTypeDockerManifest     = "application/vnd.docker.distribution.manifest.v2+json"
+	MediaTypeDockerManifestList = "application/vnd.docker.distribution.manifest.list.v2+json"
+	MediaTypeDockerConfig       = "application/vnd.docker.container.image.v1+json"
+	MediaTypeDockerLayer        = "application/vnd.docker.image.rootfs.diff.tar.gzip"
+)
+
+var manifestMediaTypes = []string{
+	ocispec.MediaTypeImageManifest,
+	ocispec.MediaTypeImageIndex,
+	MediaTypeDockerManifest,
+	MediaTypeDockerManifestList,
+}
+
+// Image is a single platform image resolved from a registry
+type Image struct {
+	Reference Reference
+	// Descriptor of the platform specific manifest
+	Descriptor ocispec.Descriptor
+	Manifest   ocispec.Manifest
+	// Config is the raw image configuration blob
+	Config []byte
+}
+
+// Size returns the sum of config and compressed layer sizes
+func (img *Image) Size() int64 {
+	size := img.Manifest.Config.Size
+	for _, layer := range img.Manifest.Layers {
+		size += layer.Size
+	}
+	return size
+}
+
+// GetManifest fetches a manifest by tag or digest
+func (c *Client) GetManifest(ctx context.Context, repo string, reference string) (ocispec.Descriptor, []byte, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url("/v2/%s/manifests/%s", repo, reference), nil)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	for _, mediaType := range manifestMediaTypes {
+		req.Header.Add("Accept", mediaType)
+	}
+	resp, err := c.do(ctx, req, pullScope(repo))
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return ocispec.Descriptor{}, nil, newStatusError(resp, "get manifest")
+	}
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return ocispec.Descriptor{}, nil, err
+	}
+	desc := ocispec.Descriptor{
+		MediaType: resp.Header.Get("Content-Type"),
+		Digest:    digest.FromBytes(body),
+		Size:      int64(len(body)),
+	}
+	if expected, err := digest.Parse(reference); err == nil && expected != desc.Digest {
+		return ocispec.Descriptor{}, nil, errors.Errorf("manifest digest mismatch, expected %s, got %s", expected, desc.Digest)
+	}
+	if desc.MediaType == "" || desc.MediaType == "application/json" {
+		var versioned struct {
+			MediaType string `json:"mediaType"`
+		}
+		if err := json.Unmarshal(body, &versioned); err == nil {
+			desc.MediaType = versioned.MediaType
+		}
+	}
+	return desc, body, nil
+}
+
+// GetBlob opens a blob for reading, returns its content and size
+func (c *Client) GetBlob(ctx context.Context, repo string, dgst digest.Digest) (io.ReadCloser, int64, error) {
+	req, err := http.NewRequest(http.MethodGet, c.url("/v2/%s/blobs/%s", repo, dgst), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := c.do(ctx, req, pullScope(repo))
+	if err != nil {
+		return nil, 0, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		defer resp.Body.Close()
+		return nil, 0, newStatusError(resp, "get blob")
+	}
+	size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+	return resp.Body, size, nil
+}
+
+// ReadBlob reads a small blob like an image config and verifies its digest
+func (c *Client) ReadBlob(ctx context.Context, repo string, dgst digest.Digest) ([]byte, error) {
+	body, _, err := c.GetBlob(ctx, repo, dgst)
+	if err != nil {
+		return nil, err
+	}
+	defer body.Close()
+
+	verifier := dgst.Verifier()
+	var buf bytes.Buffer
+	if _, err := io.Copy(io.MultiWriter(&buf, verifier), body); err != nil {
+		return nil, err
+	}
+	if !verifier.Verified() {
+		return nil, errors.Errorf("blob %s failed digest verification", dgst)
+	}
+	return buf.Bytes(), nil
+}
+
+// DefaultPlatform is the platform selected from multi-platform images by default
+func DefaultPlatform() ocispec.Platform {
+	return ocispec.Platform{OS: "linux", Architecture: runtime.GOARCH}
+}
+
+// ResolveImage fetches manifest and config of ref, selecting platform from
+// manifest lists and OCI indexes
+func (c *Client) ResolveImage(ctx context.Context, ref Reference, platform ocispec.Platform) (*Image, error) {
+	desc, body, err := c.GetManifest(ctx, ref.Repository, ref.Reference())
+	if err != nil {
+		return nil, err
+	}
+
+	if isIndex(desc.MediaType) {
+		var index ocispec.Index
+		if err := json.Unmarshal(body, &index); err != nil {
+			return nil, errors.Wrapf(err, "decode manifest list of %s", ref)
+		}
+		matched, ok := matchPlatform(index.Manifests, platform)
+		if !ok {
+			return nil, errors.Errorf("no manifest of %s matches platform %s", ref, image.FormatPlatform(platform))
+		}
+		if desc, body, err = c.GetManifest(ctx, ref.Repository, matched.Digest.String()); err != nil {
+			return nil, err
+		}
+		desc.Platform = matched.Platform
+	}
+
+	if desc.MediaType != ocispec.MediaTypeImageManifest && desc.MediaType != MediaTypeDockerManifest {
+		return nil, errors.Errorf("unsupported manifest media type %q of %s", desc.MediaType, ref)
+	}
+	img := &Image{Reference: ref, Descriptor: desc}
+	if err := json.Unmarshal(body, &img.Manifest); err != nil {
+		return nil, errors.Wrapf(err, "decode manifest of %s", ref)
+	}
+	if img.Config, err = c.ReadBlob(ctx, ref.Repository, img.Manifest.Config.Digest); err != nil {
+		return nil, err
+	}
+	return img, nil
+}
+
+func isIndex(mediaType string) bool {
+	return mediaType == ocispec.MediaTypeImageIndex || mediaType == MediaTypeDockerManifestList
+}
+
+func matchPlatform(manifests []ocispec.Descriptor, platform ocispec.Platform) (ocispec.Descriptor, bool) {
+	for _, m := range manifests {
+		if m.Platform != nil && image.MatchPlatform(platform, *m.Platform) {
+			return m, true
+		}
+	}
+	return ocispec.Descriptor{}, false
+}
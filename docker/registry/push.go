@@ -0,0 +1,149 @@
+package registry
+
+import (
+	"bytes"
+	"context"
+	"github.com/opencontainers/go-digest"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"github.com/pkg/errors"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+)
+
+// BlobOpener opens blob content for upload, it may be called again on retry
+type BlobOpener func() (io.ReadCloser, error)
+
+// BytesOpener returns a BlobOpener of in memory content
+func BytesOpener(content []byte) BlobOpener {
+	return func() (io.ReadCloser, error) {
+		return io.NopCloser(bytes.NewReader(content)), nil
+	}
+}
+
+// HeadBlob checks whether repo has blob dgst, returns its size if so
+func (c *Client) HeadBlob(ctx context.Context, repo string, dgst digest.Digest) (int64, bool, error) {
+	req, err := http.NewRequest(http.MethodHead, c.url("/v2/%s/blobs/%s", repo, dgst), nil)
+	if err != nil {
+		return 0, false, err
+	}
+	resp, err := c.do(ctx, req, pushScope(repo))
+	if err != nil {
+		return 0, false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		size, _ := strconv.ParseInt(resp.Header.Get("Content-Length"), 10, 64)
+		return size, true, nil
+	case http.StatusNotFound:
+		return 0, false, nil
+	default:
+		return 0, false, newStatusError(resp, "head blob")
+	}
+}
+
+// MountBlob tries a cross repository mount of blob dgst from repository from,
+// returns false if the registry refused and the blob must be uploaded
+func (c *Client) MountBlob(ctx context.Context, repo string, from string, dgst digest.Digest) (bool, error) {
+	query := url.Values{}
+	query.Set("mount", dgst.String())
+	query.Set("from", from)
+	req, err := http.NewRequest(http.MethodPost, c.url("/v2/%s/blobs/uploads/?%s", repo, query.Encode()), nil)
+	if err != nil {
+		return false, err
+	}
+	resp, err := c.do(ctx, req, pushScope(repo)+" "+pullScope(from))
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusCreated:
+		return true, nil
+	case http.StatusAccepted:
+		// registry started a regular upload session instead, abandon it
+		c.cancelUpload(ctx, repo, resp)
+		return false, nil
+	default:
+		return false, newStatusError(resp, "mount blob")
+	}
+}
+
+func (c *Client) cancelUpload(ctx context.Context, repo string, resp *http.Response) {
+	location, err := resp.Location()
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequest(http.MethodDelete, location.String(), nil)
+	if err != nil {
+		return
+	}
+	if resp, err := c.do(ctx, req, pushScope(repo)); err == nil {
+		resp.Body.Close()
+	}
+}
+
+// UploadBlob uploads blob desc to repo in a single monolithic request
+func (c *Client) UploadBlob(ctx context.Context, repo string, desc ocispec.Descriptor, open BlobOpener) error {
+	req, err := http.NewRequest(http.MethodPost, c.url("/v2/%s/blobs/uploads/", repo), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := c.do(ctx, req, pushScope(repo))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusAccepted {
+		return newStatusError(resp, "start upload")
+	}
+	location, err := resp.Location()
+	if err != nil {
+		return errors.Wrap(err, "start upload")
+	}
+	query := location.Query()
+	query.Set("digest", desc.Digest.String())
+	location.RawQuery = query.Encode()
+
+	body, err := open()
+	if err != nil {
+		return err
+	}
+	req, err = http.NewRequest(http.MethodPut, location.String(), body)
+	if err != nil {
+		body.Close()
+		return err
+	}
+	req.ContentLength = desc.Size
+	req.GetBody = open
+	req.Header.Set("Content-Type", "application/octet-stream")
+	resp, err = c.do(ctx, req, pushScope(repo))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return newStatusError(resp, "upload blob")
+	}
+	return nil
+}
+
+// PutManifest writes manifest content of mediaType under reference, a tag or digest
+func (c *Client) PutManifest(ctx context.Context, repo string, reference string, mediaType string, manifest []byte) (digest.Digest, error) {
+	req, err := http.NewRequest(http.MethodPut, c.url("/v2/%s/manifests/%s", repo, reference), bytes.NewReader(manifest))
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Content-Type", mediaType)
+	resp, err := c.do(ctx, req, pushScope(repo))
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		return "", newStatusError(resp, "put manifest")
+	}
+	return digest.FromBytes(manifest), nil
+}
@@ -0,0 +1,83 @@
+package registry
+
+import (
+	"github.com/distribution/reference"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"strings"
+)
+
+// Scheme prefixes image arguments which are read from a registry instead of
+// the docker daemon, e.g. registry://localhost:5000/app:1.0
+const Scheme = "registry://"
+
+// Reference points to an image in a registry
+type Reference struct {
+	Host       string
+	Repository string
+	Tag        string
+	Digest     digest.Digest
+
+	named reference.Named
+}
+
+// IsReference reports whether image should be read from a registry
+func IsReference(image string) bool {
+	return strings.HasPrefix(image, Scheme)
+}
+
+// TrimScheme returns image without the registry scheme prefix
+func TrimScheme(image string) string {
+	return strings.TrimPrefix(image, Scheme)
+}
+
+// ParseReference parses an image reference with or without registry scheme,
+// tag defaults to latest if neither tag nor digest is specified
+func ParseReference(image string) (Reference, error) {
+	named, err := reference.ParseNormalizedNamed(TrimScheme(image))
+	if err != nil {
+		return Reference{}, errors.Wrapf(err, "invalid registry reference %q", image)
+	}
+	if _, ok := named.(reference.Digested); !ok {
+		named = reference.TagNameOnly(named)
+	}
+
+	ref := Reference{
+		Host:       reference.Domain(named),
+		Repository: reference.Path(named),
+		named:      named,
+	}
+	if tagged, ok := named.(reference.Tagged); ok {
+		ref.Tag = tagged.Tag()
+	}
+	if digested, ok := named.(reference.Digested); ok {
+		ref.Digest = digested.Digest()
+	}
+	return ref, nil
+}
+
+// Reference returns the tag or digest used to fetch the manifest, digest wins
+func (r Reference) Reference() string {
+	if r.Digest != "" {
+		return r.Digest.String()
+	}
+	return r.Tag
+}
+
+// Name returns the familiar repository name, e.g. alpine or localhost:5000/app
+func (r Reference) Name() string {
+	return reference.FamiliarName(r.named)
+}
+
+// String returns the familiar form of the reference, as used in RepoTags
+func (r Reference) String() string {
+	return reference.FamiliarString(r.named)
+}
+
+// RepoTag returns the familiar name:tag form, or empty for digest only references
+func (r Reference) RepoTag() string {
+	if r.Tag == "" {
+		return ""
+	}
+	return r.Name() + ":" + r.Tag
+}
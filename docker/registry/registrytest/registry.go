@@ -0,0 +1,320 @@
+// Package registrytest provides an in-process registry for tests, speaking the
+// subset of the distribution API the registry client uses
+package registrytest
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"github.com/opencontainers/go-digest"
+	"github.com/opencontainers/image-spec/specs-go"
+	ocispec "github.com/opencontainers/image-spec/specs-go/v1"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+)
+
+// Registry stores blobs and manifests in memory, blobs belong to repositories
+// so cross repository mounts can be told from uploads
+type Registry struct {
+	// RequireToken makes the registry answer a Bearer challenge, tokens are
+	// issued by the registry itself
+	RequireToken bool
+
+	mu        sync.Mutex
+	server    *httptest.Server
+	blobs     map[digest.Digest][]byte
+	repos     map[string]map[digest.Digest]bool
+	manifests map[string]map[string]manifest
+	uploads   int
+	downloads int
+	mounts    int
+	tokens    int
+}
+
+type manifest struct {
+	mediaType string
+	content   []byte
+}
+
+// New starts a registry, close it with Close
+func New() *Registry {
+	r := &Registry{
+		blobs:     map[digest.Digest][]byte{},
+		repos:     map[string]map[digest.Digest]bool{},
+		manifests: map[string]map[string]manifest{},
+	}
+	r.server = httptest.NewServer(http.HandlerFunc(r.serve))
+	return r
+}
+
+// Close shuts the registry down
+func (r *Registry) Close() {
+	r.server.Close()
+}
+
+// Host returns host:port of the registry, a loopback address accessed via http
+func (r *Registry) Host() string {
+	return strings.TrimPrefix(r.server.URL, "http://")
+}
+
+// AddBlob stores content as a blob of repo, returns its digest
+func (r *Registry) AddBlob(repo string, content []byte) digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	dgst := digest.FromBytes(content)
+	r.addBlob(repo, dgst, content)
+	return dgst
+}
+
+// AddManifest stores content of mediaType as a manifest of repo under tag, if
+// not empty, and under its digest, which is returned
+func (r *Registry) AddManifest(repo string, tag string, mediaType string, content []byte) digest.Digest {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.addManifest(repo, tag, mediaType, content)
+}
+
+// Image is an image stored in the registry
+type Image struct {
+	Descriptor ocispec.Descriptor
+	Manifest   ocispec.Manifest
+	DiffIDs    []digest.Digest
+}
+
+// AddImage stores an image of platform with layers, uncompressed tar streams
+// stored gzipped as by docker push, under tag of repo
+func (r *Registry) AddImage(repo string, tag string, platform ocispec.Platform, layers ...[]byte) Image {
+	img := Image{Manifest: ocispec.Manifest{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageManifest,
+	}}
+	history := []ocispec.History{}
+	for i, layer := range layers {
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		_, _ = zw.Write(layer)
+		_ = zw.Close()
+		img.DiffIDs = append(img.DiffIDs, digest.FromBytes(layer))
+		img.Manifest.Layers = append(img.Manifest.Layers, ocispec.Descriptor{
+			MediaType: ocispec.MediaTypeImageLayerGzip,
+			Digest:    r.AddBlob(repo, buf.Bytes()),
+			Size:      int64(buf.Len()),
+		})
+		history = append(history, ocispec.History{CreatedBy: fmt.Sprintf("layer %d", i+1)})
+	}
+	config, _ := json.Marshal(ocispec.Image{
+		Platform: platform,
+		RootFS:   ocispec.RootFS{Type: "layers", DiffIDs: img.DiffIDs},
+		History:  history,
+	})
+	img.Manifest.Config = ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageConfig,
+		Digest:    r.AddBlob(repo, config),
+		Size:      int64(len(config)),
+	}
+	content, _ := json.Marshal(img.Manifest)
+	img.Descriptor = ocispec.Descriptor{
+		MediaType: ocispec.MediaTypeImageManifest,
+		Digest:    r.AddManifest(repo, tag, ocispec.MediaTypeImageManifest, content),
+		Size:      int64(len(content)),
+		Platform:  &platform,
+	}
+	return img
+}
+
+// AddIndex stores an OCI index of images under tag of repo
+func (r *Registry) AddIndex(repo string, tag string, images ...Image) digest.Digest {
+	index := ocispec.Index{
+		Versioned: specs.Versioned{SchemaVersion: 2},
+		MediaType: ocispec.MediaTypeImageIndex,
+	}
+	for _, img := range images {
+		index.Manifests = append(index.Manifests, img.Descriptor)
+	}
+	content, _ := json.Marshal(index)
+	return r.AddManifest(repo, tag, ocispec.MediaTypeImageIndex, content)
+}
+
+// HasBlob tells whether repo has blob dgst
+func (r *Registry) HasBlob(repo string, dgst digest.Digest) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.repos[repo][dgst]
+}
+
+// Blob returns content of blob dgst of any repository
+func (r *Registry) Blob(dgst digest.Digest) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	content, ok := r.blobs[dgst]
+	return content, ok
+}
+
+// Manifest returns content of manifest of repo by tag or digest
+func (r *Registry) Manifest(repo string, reference string) ([]byte, bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	m, ok := r.manifests[repo][reference]
+	return m.content, ok
+}
+
+// Uploads returns the number of blobs uploaded
+func (r *Registry) Uploads() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.uploads
+}
+
+// Downloads returns the number of blobs read, configs included
+func (r *Registry) Downloads() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.downloads
+}
+
+// Mounts returns the number of blobs mounted across repositories
+func (r *Registry) Mounts() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.mounts
+}
+
+// Tokens returns the number of tokens issued
+func (r *Registry) Tokens() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.tokens
+}
+
+func (r *Registry) addBlob(repo string, dgst digest.Digest, content []byte) {
+	r.blobs[dgst] = content
+	if r.repos[repo] == nil {
+		r.repos[repo] = map[digest.Digest]bool{}
+	}
+	r.repos[repo][dgst] = true
+}
+
+func (r *Registry) addManifest(repo string, tag string, mediaType string, content []byte) digest.Digest {
+	dgst := digest.FromBytes(content)
+	if r.manifests[repo] == nil {
+		r.manifests[repo] = map[string]manifest{}
+	}
+	m := manifest{mediaType: mediaType, content: content}
+	r.manifests[repo][dgst.String()] = m
+	if tag != "" {
+		r.manifests[repo][tag] = m
+	}
+	return dgst
+}
+
+func (r *Registry) serve(w http.ResponseWriter, req *http.Request) {
+	if req.URL.Path == "/token" {
+		r.mu.Lock()
+		r.tokens++
+		r.mu.Unlock()
+		_ = json.NewEncoder(w).Encode(map[string]string{"token": "test-token"})
+		return
+	}
+	if r.RequireToken && req.Header.Get("Authorization") != "Bearer test-token" {
+		w.Header().Set("WWW-Authenticate", fmt.Sprintf(`Bearer realm="%s/token",service="registrytest"`, r.server.URL))
+		w.WriteHeader(http.StatusUnauthorized)
+		return
+	}
+
+	path := strings.TrimPrefix(req.URL.Path, "/v2/")
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	switch {
+	case strings.Contains(path, "/blobs/uploads/"):
+		i := strings.LastIndex(path, "/blobs/uploads/")
+		r.serveUpload(w, req, path[:i], path[i+len("/blobs/uploads/"):])
+	case strings.Contains(path, "/blobs/"):
+		i := strings.LastIndex(path, "/blobs/")
+		r.serveBlob(w, req, path[:i], digest.Digest(path[i+len("/blobs/"):]))
+	case strings.Contains(path, "/manifests/"):
+		i := strings.LastIndex(path, "/manifests/")
+		r.serveManifest(w, req, path[:i], path[i+len("/manifests/"):])
+	default:
+		http.NotFound(w, req)
+	}
+}
+
+func (r *Registry) serveBlob(w http.ResponseWriter, req *http.Request, repo string, dgst digest.Digest) {
+	if !r.repos[repo][dgst] {
+		http.NotFound(w, req)
+		return
+	}
+	content := r.blobs[dgst]
+	w.Header().Set("Content-Length", fmt.Sprint(len(content)))
+	w.Header().Set("Docker-Content-Digest", dgst.String())
+	if req.Method == http.MethodGet {
+		r.downloads++
+		_, _ = w.Write(content)
+	}
+}
+
+func (r *Registry) serveUpload(w http.ResponseWriter, req *http.Request, repo string, id string) {
+	switch req.Method {
+	case http.MethodPost:
+		query := req.URL.Query()
+		if mount, from := digest.Digest(query.Get("mount")), query.Get("from"); mount != "" && r.repos[from][mount] {
+			r.addBlob(repo, mount, r.blobs[mount])
+			r.mounts++
+			w.WriteHeader(http.StatusCreated)
+			return
+		}
+		w.Header().Set("Location", fmt.Sprintf("/v2/%s/blobs/uploads/session", repo))
+		w.WriteHeader(http.StatusAccepted)
+	case http.MethodPut:
+		content, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		dgst := digest.Digest(req.URL.Query().Get("digest"))
+		if dgst != digest.FromBytes(content) {
+			http.Error(w, "digest invalid", http.StatusBadRequest)
+			return
+		}
+		r.addBlob(repo, dgst, content)
+		r.uploads++
+		w.WriteHeader(http.StatusCreated)
+	case http.MethodDelete:
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
+
+func (r *Registry) serveManifest(w http.ResponseWriter, req *http.Request, repo string, reference string) {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead:
+		m, ok := r.manifests[repo][reference]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		w.Header().Set("Content-Type", m.mediaType)
+		if req.Method == http.MethodGet {
+			_, _ = w.Write(m.content)
+		}
+	case http.MethodPut:
+		content, err := io.ReadAll(req.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		tag := reference
+		if _, err := digest.Parse(reference); err == nil {
+			tag = ""
+		}
+		r.addManifest(repo, tag, req.Header.Get("Content-Type"), content)
+		w.WriteHeader(http.StatusCreated)
+	default:
+		w.WriteHeader(http.StatusMethodNotAllowed)
+	}
+}
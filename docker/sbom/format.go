@@ -0,0 +1,215 @@
+package sbom
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"strconv"
+	"time"
+)
+
+// formats of SBOM documents
+const (
+	FormatSPDXJSON  = "spdx-json"
+	FormatCycloneDX = "cyclonedx"
+)
+
+const (
+	toolName            = "docker-save"
+	layerProperty       = "docker-save:layer"
+	diffIDProperty      = "docker-save:layer:diffID"
+	absentBelowProperty = "docker-save:layer:absentBelow"
+	locationProperty    = "docker-save:location"
+)
+
+// Formats lists supported formats of SBOM documents
+var Formats = []string{FormatSPDXJSON, FormatCycloneDX}
+
+// Subject is the image an SBOM document describes
+type Subject struct {
+	Name string
+	ID   digest.Digest
+}
+
+// Encode encodes inventory of subject as an SBOM document of format
+func Encode(format string, subject Subject, inv *Inventory, created time.Time) ([]byte, error) {
+	var document interface{}
+	switch format {
+	case FormatSPDXJSON:
+		document = spdxDocument(subject, inv, created)
+	case FormatCycloneDX:
+		document = cycloneDXDocument(subject, inv, created)
+	default:
+		return nil, errors.Errorf("unknown SBOM format %q", format)
+	}
+	// package URLs keep their ampersands
+	var buf bytes.Buffer
+	encoder := json.NewEncoder(&buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "  ")
+	err := encoder.Encode(document)
+	return buf.Bytes(), err
+}
+
+// origin describes where package is found, for free text fields
+func (p Package) origin() string {
+	origin := fmt.Sprintf("%s, introduced by layer %d %s", p.Location, p.Layer, p.DiffID)
+	if p.AbsentBelow {
+		origin += " or a layer below absent from the archive"
+	}
+	return origin
+}
+
+type spdxPackage struct {
+	SPDXID                string            `json:"SPDXID"`
+	Name                  string            `json:"name"`
+	VersionInfo           string            `json:"versionInfo,omitempty"`
+	DownloadLocation      string            `json:"downloadLocation"`
+	FilesAnalyzed         bool              `json:"filesAnalyzed"`
+	LicenseConcluded      string            `json:"licenseConcluded"`
+	LicenseDeclared       string            `json:"licenseDeclared"`
+	CopyrightText         string            `json:"copyrightText"`
+	SourceInfo            string            `json:"sourceInfo,omitempty"`
+	PrimaryPackagePurpose string            `json:"primaryPackagePurpose,omitempty"`
+	ExternalRefs          []spdxExternalRef `json:"externalRefs,omitempty"`
+}
+
+type spdxExternalRef struct {
+	ReferenceCategory string `json:"referenceCategory"`
+	ReferenceType     string `json:"referenceType"`
+	ReferenceLocator  string `json:"referenceLocator"`
+}
+
+type spdxRelationship struct {
+	SPDXElementID      string `json:"spdxElementId"`
+	RelationshipType   string `json:"relationshipType"`
+	RelatedSPDXElement string `json:"relatedSpdxElement"`
+}
+
+// spdxDocument builds an SPDX 2.3 document, licenses are left unasserted as
+// package databases do not record valid license expressions
+func spdxDocument(subject Subject, inv *Inventory, created time.Time) interface{} {
+	packages := []spdxPackage{{
+		SPDXID:                "SPDXRef-Image",
+		Name:                  subject.Name,
+		VersionInfo:           subject.ID.String(),
+		DownloadLocation:      "NOASSERTION",
+		LicenseConcluded:      "NOASSERTION",
+		LicenseDeclared:       "NOASSERTION",
+		CopyrightText:         "NOASSERTION",
+		PrimaryPackagePurpose: "CONTAINER",
+	}}
+	relationships := []spdxRelationship{{
+		SPDXElementID:      "SPDXRef-DOCUMENT",
+		RelationshipType:   "DESCRIBES",
+		RelatedSPDXElement: "SPDXRef-Image",
+	}}
+	for i, p := range inv.Packages {
+		id := "SPDXRef-Package-" + strconv.Itoa(i+1)
+		packages = append(packages, spdxPackage{
+			SPDXID:           id,
+			Name:             p.Name,
+			VersionInfo:      p.Version,
+			DownloadLocation: "NOASSERTION",
+			LicenseConcluded: "NOASSERTION",
+			LicenseDeclared:  "NOASSERTION",
+			CopyrightText:    "NOASSERTION",
+			SourceInfo:       "found in " + p.origin(),
+			ExternalRefs: []spdxExternalRef{{
+				ReferenceCategory: "PACKAGE-MANAGER",
+				ReferenceType:     "purl",
+				ReferenceLocator:  p.PURL(inv.Distro()),
+			}},
+		})
+		relationships = append(relationships, spdxRelationship{
+			SPDXElementID:      "SPDXRef-Image",
+			RelationshipType:   "CONTAINS",
+			RelatedSPDXElement: id,
+		})
+	}
+
+	return map[string]interface{}{
+		"spdxVersion":       "SPDX-2.3",
+		"dataLicense":       "CC0-1.0",
+		"SPDXID":            "SPDXRef-DOCUMENT",
+		"name":              subject.Name,
+		"documentNamespace": fmt.Sprintf("https://spdx.org/spdxdocs/%s/%s-%d", toolName, subject.ID.Encoded(), created.Unix()),
+		"creationInfo": map[string]interface{}{
+			"created":  created.UTC().Format(time.RFC3339),
+			"creators": []string{"Tool: " + toolName},
+		},
+		"packages":      packages,
+		"relationships": relationships,
+	}
+}
+
+type cycloneDXComponent struct {
+	BOMRef     string              `json:"bom-ref,omitempty"`
+	Type       string              `json:"type"`
+	Name       string              `json:"name"`
+	Version    string              `json:"version,omitempty"`
+	PURL       string              `json:"purl,omitempty"`
+	Licenses   []cycloneDXLicense  `json:"licenses,omitempty"`
+	Properties []cycloneDXProperty `json:"properties,omitempty"`
+}
+
+type cycloneDXLicense struct {
+	License struct {
+		Name string `json:"name"`
+	} `json:"license"`
+}
+
+type cycloneDXProperty struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// cycloneDXDocument builds a CycloneDX 1.5 document, layers of packages are
+// given as properties
+func cycloneDXDocument(subject Subject, inv *Inventory, created time.Time) interface{} {
+	components := []cycloneDXComponent{}
+	for i, p := range inv.Packages {
+		component := cycloneDXComponent{
+			BOMRef:  "package-" + strconv.Itoa(i+1),
+			Type:    "library",
+			Name:    p.Name,
+			Version: p.Version,
+			PURL:    p.PURL(inv.Distro()),
+		}
+		if p.License != "" {
+			license := cycloneDXLicense{}
+			license.License.Name = p.License
+			component.Licenses = []cycloneDXLicense{license}
+		}
+		component.Properties = []cycloneDXProperty{
+			{Name: layerProperty, Value: strconv.Itoa(p.Layer)},
+			{Name: diffIDProperty, Value: p.DiffID.String()},
+			{Name: locationProperty, Value: p.Location},
+		}
+		if p.AbsentBelow {
+			component.Properties = append(component.Properties, cycloneDXProperty{Name: absentBelowProperty, Value: "true"})
+		}
+		components = append(components, component)
+	}
+
+	return map[string]interface{}{
+		"bomFormat":   "CycloneDX",
+		"specVersion": "1.5",
+		"version":     1,
+		"metadata": map[string]interface{}{
+			"timestamp": created.UTC().Format(time.RFC3339),
+			"tools": map[string]interface{}{
+				"components": []cycloneDXComponent{{Type: "application", Name: toolName}},
+			},
+			"component": cycloneDXComponent{
+				BOMRef:  subject.ID.String(),
+				Type:    "container",
+				Name:    subject.Name,
+				Version: subject.ID.String(),
+			},
+		},
+		"components": components,
+	}
+}
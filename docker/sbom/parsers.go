@@ -0,0 +1,349 @@
+package sbom
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"github.com/pkg/errors"
+	"path"
+	"regexp"
+	"strings"
+)
+
+type parseFunc func(content []byte) ([]Package, error)
+
+var lockfileParsers = map[string]parseFunc{
+	"package-lock.json": parseNpmLock,
+	"composer.lock":     parseComposerLock,
+	"Cargo.lock":        tomlPackagesParser("cargo"),
+	"poetry.lock":       tomlPackagesParser("pypi"),
+	"Pipfile.lock":      parsePipfileLock,
+	"Gemfile.lock":      parseGemfileLock,
+	"go.mod":            parseGoMod,
+}
+
+// dependencyDirs hold lockfiles of dependencies, which are recorded by
+// lockfiles of the projects depending on them
+var dependencyDirs = []string{"node_modules", "vendor", "pkg/mod", ".cargo/registry"}
+
+// findParser returns the parser of package database or lockfile at name, nil
+// if name records no packages
+func findParser(name string) parseFunc {
+	dir, base := path.Split(name)
+	switch {
+	case name == "var/lib/dpkg/status":
+		return parseDpkgStatus
+	case dir == "var/lib/dpkg/status.d/" && !strings.Contains(base, "."):
+		// distroless images record each package in a file of its own
+		return parseDpkgStatus
+	case name == "lib/apk/db/installed":
+		return parseApkInstalled
+	case name == "var/lib/rpm/rpmdb.sqlite" || name == "var/lib/rpm/Packages" || name == "var/lib/rpm/Packages.db":
+		// recorded to be reported as not supported
+		return func([]byte) ([]Package, error) { return nil, nil }
+	}
+	parse, ok := lockfileParsers[base]
+	if !ok {
+		return nil
+	}
+	for _, dependencyDir := range dependencyDirs {
+		if strings.HasPrefix(name, dependencyDir+"/") || strings.Contains(name, "/"+dependencyDir+"/") {
+			return nil
+		}
+	}
+	return parse
+}
+
+// parseStanzas parses blank line separated stanzas of key value lines, lines
+// indented continue the value of the line before
+func parseStanzas(content []byte, sep string) []map[string]string {
+	stanzas := []map[string]string{}
+	stanza := map[string]string{}
+	last := ""
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, maxRecordSize)
+	for scanner.Scan() {
+		line := scanner.Text()
+		switch {
+		case strings.TrimSpace(line) == "":
+			if len(stanza) > 0 {
+				stanzas = append(stanzas, stanza)
+				stanza = map[string]string{}
+			}
+		case line[0] == ' ' || line[0] == '\t':
+			if last != "" {
+				stanza[last] += "\n" + strings.TrimSpace(line)
+			}
+		default:
+			key, value, ok := strings.Cut(line, sep)
+			if ok {
+				last = key
+				stanza[key] = strings.TrimSpace(value)
+			}
+		}
+	}
+	if len(stanza) > 0 {
+		stanzas = append(stanzas, stanza)
+	}
+	return stanzas
+}
+
+func parseDpkgStatus(content []byte) ([]Package, error) {
+	packages := []Package{}
+	for _, stanza := range parseStanzas(content, ":") {
+		status := stanza["Status"]
+		if stanza["Package"] == "" || (status != "" && !strings.HasSuffix(status, " installed")) {
+			continue
+		}
+		packages = append(packages, Package{
+			Type:    "deb",
+			Name:    stanza["Package"],
+			Version: stanza["Version"],
+			Arch:    stanza["Architecture"],
+		})
+	}
+	return packages, nil
+}
+
+func parseApkInstalled(content []byte) ([]Package, error) {
+	packages := []Package{}
+	for _, stanza := range parseStanzas(content, ":") {
+		if stanza["P"] == "" {
+			continue
+		}
+		packages = append(packages, Package{
+			Type:    "apk",
+			Name:    stanza["P"],
+			Version: stanza["V"],
+			Arch:    stanza["A"],
+			License: stanza["L"],
+		})
+	}
+	return packages, nil
+}
+
+type npmDependency struct {
+	Version      string                   `json:"version"`
+	Dependencies map[string]npmDependency `json:"dependencies"`
+}
+
+// parseNpmLock parses lockfile version 1 dependencies tree, or packages of
+// version 2 and 3
+func parseNpmLock(content []byte) ([]Package, error) {
+	var lock struct {
+		Packages map[string]struct {
+			Name    string `json:"name"`
+			Version string `json:"version"`
+			Link    bool   `json:"link"`
+		} `json:"packages"`
+		Dependencies map[string]npmDependency `json:"dependencies"`
+	}
+	if err := json.Unmarshal(content, &lock); err != nil {
+		return nil, err
+	}
+
+	packages := newPackageSet()
+	for key, p := range lock.Packages {
+		if key == "" || p.Link || p.Version == "" {
+			continue
+		}
+		name := p.Name
+		if name == "" {
+			name = key[strings.LastIndex(key, "node_modules/")+len("node_modules/"):]
+		}
+		packages.add(npmPackage(name, p.Version))
+	}
+	if len(lock.Packages) == 0 {
+		var walk func(dependencies map[string]npmDependency)
+		walk = func(dependencies map[string]npmDependency) {
+			for name, dependency := range dependencies {
+				packages.add(npmPackage(name, dependency.Version))
+				walk(dependency.Dependencies)
+			}
+		}
+		walk(lock.Dependencies)
+	}
+	return packages.list, nil
+}
+
+func npmPackage(name string, version string) Package {
+	p := Package{Type: "npm", Name: name, Version: version}
+	if strings.HasPrefix(name, "@") {
+		p.Namespace, p.Name, _ = strings.Cut(name, "/")
+	}
+	return p
+}
+
+func parseComposerLock(content []byte) ([]Package, error) {
+	type composerPackage struct {
+		Name    string `json:"name"`
+		Version string `json:"version"`
+	}
+	var lock struct {
+		Packages    []composerPackage `json:"packages"`
+		PackagesDev []composerPackage `json:"packages-dev"`
+	}
+	if err := json.Unmarshal(content, &lock); err != nil {
+		return nil, err
+	}
+	packages := newPackageSet()
+	for _, p := range append(lock.Packages, lock.PackagesDev...) {
+		vendor, name, _ := strings.Cut(p.Name, "/")
+		packages.add(Package{Type: "composer", Namespace: vendor, Name: name, Version: p.Version})
+	}
+	return packages.list, nil
+}
+
+var tomlString = regexp.MustCompile(`^(name|version)\s*=\s*"([^"]*)"`)
+
+// tomlPackagesParser parses name and version of [[package]] tables, as in
+// Cargo.lock and poetry.lock
+func tomlPackagesParser(purlType string) parseFunc {
+	return func(content []byte) ([]Package, error) {
+		packages := newPackageSet()
+		var current *Package
+		flush := func() {
+			if current != nil && current.Name != "" {
+				packages.add(*current)
+			}
+			current = nil
+		}
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+		scanner.Buffer(nil, maxRecordSize)
+		for scanner.Scan() {
+			line := strings.TrimSpace(scanner.Text())
+			switch {
+			case line == "[[package]]":
+				flush()
+				current = &Package{Type: purlType}
+			case strings.HasPrefix(line, "["):
+				// sub tables of package have names and versions of their own
+				flush()
+			case current != nil:
+				if match := tomlString.FindStringSubmatch(line); match != nil {
+					if match[1] == "name" {
+						current.Name = normalizeName(purlType, match[2])
+					} else {
+						current.Version = match[2]
+					}
+				}
+			}
+		}
+		flush()
+		return packages.list, scanner.Err()
+	}
+}
+
+func parsePipfileLock(content []byte) ([]Package, error) {
+	var lock map[string]json.RawMessage
+	if err := json.Unmarshal(content, &lock); err != nil {
+		return nil, err
+	}
+	packages := newPackageSet()
+	for _, section := range []string{"default", "develop"} {
+		if lock[section] == nil {
+			continue
+		}
+		var dependencies map[string]struct {
+			Version string `json:"version"`
+		}
+		if err := json.Unmarshal(lock[section], &dependencies); err != nil {
+			return nil, errors.Wrapf(err, "invalid %s section", section)
+		}
+		for name, dependency := range dependencies {
+			version := strings.TrimPrefix(dependency.Version, "==")
+			packages.add(Package{Type: "pypi", Name: normalizeName("pypi", name), Version: version})
+		}
+	}
+	return packages.list, nil
+}
+
+var gemSpec = regexp.MustCompile(`^    ([^ ]+) \(([^)]+)\)$`)
+
+// parseGemfileLock parses specs of GEM section, which are indented by four spaces
+func parseGemfileLock(content []byte) ([]Package, error) {
+	packages := newPackageSet()
+	inGems := false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line := scanner.Text()
+		if line != "" && line[0] != ' ' {
+			inGems = line == "GEM"
+			continue
+		}
+		if match := gemSpec.FindStringSubmatch(line); inGems && match != nil {
+			packages.add(Package{Type: "gem", Name: match[1], Version: match[2]})
+		}
+	}
+	return packages.list, scanner.Err()
+}
+
+// parseGoMod parses required modules, which are the minimal versions selected
+func parseGoMod(content []byte) ([]Package, error) {
+	packages := newPackageSet()
+	inRequire := false
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "//")
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+			continue
+		case inRequire:
+			if fields[0] == ")" {
+				inRequire = false
+				continue
+			}
+		case fields[0] == "require" && len(fields) == 2 && fields[1] == "(":
+			inRequire = true
+			continue
+		case fields[0] == "require":
+			fields = fields[1:]
+		default:
+			continue
+		}
+		if len(fields) >= 2 {
+			packages.add(Package{Type: "golang", Namespace: path.Dir(fields[0]), Name: path.Base(fields[0]), Version: fields[1]})
+		}
+	}
+	return packages.list, scanner.Err()
+}
+
+// normalizeName normalizes package names as package URL types require
+func normalizeName(purlType string, name string) string {
+	if purlType == "pypi" {
+		return strings.ReplaceAll(strings.ToLower(name), "_", "-")
+	}
+	return name
+}
+
+// parseOSRelease returns ID and VERSION_ID of os-release
+func parseOSRelease(content []byte) (string, string) {
+	values := map[string]string{}
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	for scanner.Scan() {
+		key, value, ok := strings.Cut(strings.TrimSpace(scanner.Text()), "=")
+		if ok {
+			values[key] = strings.Trim(value, `"'`)
+		}
+	}
+	return values["ID"], values["VERSION_ID"]
+}
+
+// packageSet lists packages once each in order added
+type packageSet struct {
+	list []Package
+	seen map[string]bool
+}
+
+func newPackageSet() *packageSet {
+	return &packageSet{list: []Package{}, seen: map[string]bool{}}
+}
+
+func (s *packageSet) add(p Package) {
+	key := packageKey(p)
+	if !s.seen[key] {
+		s.seen[key] = true
+		s.list = append(s.list, p)
+	}
+}
@@ -0,0 +1,249 @@
+package sbom
+
+import (
+	"archive/tar"
+	"docker-save/docker/layer"
+	"fmt"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/opencontainers/go-digest"
+	"github.com/pkg/errors"
+	"io"
+	"net/url"
+	"path"
+	"sort"
+	"strings"
+)
+
+// maxRecordSize limits package databases and lockfiles read into memory
+const maxRecordSize = 64 << 20
+
+// Package is a software package recorded in the filesystem of image layers
+type Package struct {
+	// Type is the package URL type, e.g. deb, apk, npm
+	Type      string
+	Namespace string
+	Name      string
+	Version   string
+	Arch      string
+	License   string
+	// Location is the file the package is recorded in
+	Location string
+	// Layer is the 1-based index of the layer which introduced the package
+	Layer  int
+	DiffID digest.Digest
+	// AbsentBelow tells a layer absent from a partial archive below Layer may
+	// have introduced the package
+	AbsentBelow bool
+}
+
+// PURL returns the package URL of package
+func (p Package) PURL(distro string) string {
+	purl := "pkg:" + p.Type + "/"
+	if p.Namespace != "" {
+		for _, segment := range strings.Split(p.Namespace, "/") {
+			purl += escapeSegment(segment) + "/"
+		}
+	}
+	purl += escapeSegment(p.Name) + "@" + url.PathEscape(p.Version)
+	qualifiers := []string{}
+	if p.Arch != "" {
+		qualifiers = append(qualifiers, "arch="+url.QueryEscape(p.Arch))
+	}
+	if distro != "" && isOSPackage(p.Type) {
+		qualifiers = append(qualifiers, "distro="+url.QueryEscape(distro))
+	}
+	if len(qualifiers) > 0 {
+		purl += "?" + strings.Join(qualifiers, "&")
+	}
+	return purl
+}
+
+// escapeSegment escapes a segment of package URL path, including the scope
+// prefix of npm packages
+func escapeSegment(segment string) string {
+	return strings.ReplaceAll(url.PathEscape(segment), "@", "%40")
+}
+
+func isOSPackage(purlType string) bool {
+	return purlType == "deb" || purlType == "apk" || purlType == "rpm"
+}
+
+// Layer is a layer of image, File is empty for layers absent from a partial archive
+type Layer struct {
+	File   string
+	DiffID digest.Digest
+}
+
+// Inventory is the packages of image with the operating system they are built for
+type Inventory struct {
+	OSID        string
+	OSVersionID string
+	Packages    []Package
+	// Skipped lists files recording packages which are not cataloged, with reasons
+	Skipped []string
+}
+
+// Distro returns the distro qualifier of OS package URLs, e.g. debian-12
+func (inv *Inventory) Distro() string {
+	if inv.OSID == "" || inv.OSVersionID == "" {
+		return inv.OSID
+	}
+	return inv.OSID + "-" + inv.OSVersionID
+}
+
+// record is a package database, lockfile or os-release in the merged filesystem
+type record struct {
+	layer    int
+	packages []Package
+	content  []byte
+}
+
+// Catalog walks layers from the lowest, replaying package databases and
+// lockfiles as they are added, replaced and removed, packages are attributed to
+// the layer which first recorded them in the file they are found at last
+func Catalog(layers []Layer) (*Inventory, error) {
+	inv := &Inventory{}
+	records := map[string]*record{}
+	absent := 0
+	for i, l := range layers {
+		number := i + 1
+		if l.File == "" {
+			absent = number
+			continue
+		}
+		err := walkLayer(l.File, func(hdr *tar.Header, r io.Reader) error {
+			name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+			dir, base := path.Split(name)
+			switch {
+			case base == archive.WhiteoutOpaqueDir:
+				removeRecords(records, strings.TrimSuffix(dir, "/"), number)
+				return nil
+			case strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+				return nil
+			case strings.HasPrefix(base, archive.WhiteoutPrefix):
+				removeRecords(records, path.Join(dir, strings.TrimPrefix(base, archive.WhiteoutPrefix)), number+1)
+				return nil
+			}
+
+			if hdr.Typeflag != tar.TypeReg {
+				delete(records, name)
+				return nil
+			}
+			if name == "etc/os-release" || name == "usr/lib/os-release" {
+				content, err := io.ReadAll(io.LimitReader(r, maxRecordSize))
+				records[name] = &record{layer: number, content: content}
+				return err
+			}
+			parse := findParser(name)
+			if parse == nil {
+				return nil
+			}
+			if hdr.Size > maxRecordSize {
+				inv.Skipped = append(inv.Skipped, fmt.Sprintf("/%s: larger than %d bytes", name, maxRecordSize))
+				delete(records, name)
+				return nil
+			}
+			content, err := io.ReadAll(r)
+			if err != nil {
+				return err
+			}
+			packages, err := parse(content)
+			if err != nil {
+				inv.Skipped = append(inv.Skipped, fmt.Sprintf("/%s: %v", name, err))
+				delete(records, name)
+				return nil
+			}
+
+			// packages recorded by the file before are introduced by earlier
+			// layers, others by this layer unless a layer absent since may
+			// have added them
+			introduced := map[string]Package{}
+			since := 0
+			if previous, ok := records[name]; ok {
+				since = previous.layer
+				for _, p := range previous.packages {
+					introduced[packageKey(p)] = p
+				}
+			}
+			for j := range packages {
+				packages[j].Location = "/" + name
+				packages[j].Layer, packages[j].DiffID = number, l.DiffID
+				packages[j].AbsentBelow = absent > since
+				if p, ok := introduced[packageKey(packages[j])]; ok {
+					packages[j] = p
+				}
+			}
+			records[name] = &record{layer: number, packages: packages}
+			return nil
+		})
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to read layer %d", number)
+		}
+	}
+
+	for _, name := range []string{"etc/os-release", "usr/lib/os-release"} {
+		if r, ok := records[name]; ok {
+			inv.OSID, inv.OSVersionID = parseOSRelease(r.content)
+			break
+		}
+	}
+	for name, r := range records {
+		if strings.HasPrefix(name, "var/lib/rpm/") {
+			inv.Skipped = append(inv.Skipped, "/"+name+": rpm databases are not supported")
+			continue
+		}
+		for _, p := range r.packages {
+			if isOSPackage(p.Type) {
+				p.Namespace = inv.OSID
+			}
+			inv.Packages = append(inv.Packages, p)
+		}
+	}
+	sort.Slice(inv.Packages, func(i, j int) bool {
+		a, b := inv.Packages[i], inv.Packages[j]
+		if a.Layer != b.Layer {
+			return a.Layer < b.Layer
+		}
+		if a.Location != b.Location {
+			return a.Location < b.Location
+		}
+		return packageKey(a) < packageKey(b)
+	})
+	sort.Strings(inv.Skipped)
+	return inv, nil
+}
+
+func packageKey(p Package) string {
+	return p.Type + "/" + p.Namespace + "/" + p.Name + "@" + p.Version
+}
+
+// removeRecords removes files at and under p recorded by layers before the
+// 1-based index before
+func removeRecords(records map[string]*record, p string, before int) {
+	for name, r := range records {
+		if (p == "" || name == p || strings.HasPrefix(name, p+"/")) && r.layer < before {
+			delete(records, name)
+		}
+	}
+}
+
+func walkLayer(layerFile string, fn func(hdr *tar.Header, r io.Reader) error) error {
+	reader, err := layer.Open(layerFile)
+	if err != nil {
+		return err
+	}
+	defer reader.Close()
+	tr := tar.NewReader(reader)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if err := fn(hdr, tr); err != nil {
+			return err
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package sbom_test
+
+import (
+	"archive/tar"
+	"docker-save/docker/sbom"
+	"fmt"
+	"github.com/opencontainers/go-digest"
+	"os"
+	"reflect"
+	"testing"
+)
+
+const (
+	osRelease = "ID=debian\nVERSION_ID=\"12\"\n"
+	dpkgA     = "Package: a\nStatus: install ok installed\nVersion: 1.0\nArchitecture: amd64\n"
+	dpkgB     = "Package: b\nStatus: install ok installed\nVersion: 2.0\nArchitecture: amd64\n"
+	npmLock   = `{"packages": {"": {"name": "app"}, "node_modules/@scope/left-pad": {"version": "1.3.0"}}}`
+)
+
+// writeLayer writes a layer of files by name, in order of names given
+func writeLayer(t *testing.T, dir string, files ...string) string {
+	t.Helper()
+	file, err := os.CreateTemp(dir, "layer-*.tar")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	tw := tar.NewWriter(file)
+	for i := 0; i < len(files); i += 2 {
+		name, content := files[i], files[i+1]
+		if err := tw.WriteHeader(&tar.Header{Name: name, Mode: 0644, Size: int64(len(content)), Typeflag: tar.TypeReg}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(content)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return file.Name()
+}
+
+func TestCatalog(t *testing.T) {
+	tests := []struct {
+		name string
+		// layers are name, content pairs of files, nil for absent layers
+		layers   [][]string
+		packages []string
+		skipped  int
+	}{
+		{
+			name: "packages attributed to layer introducing them",
+			layers: [][]string{
+				{"etc/os-release", osRelease, "var/lib/dpkg/status", dpkgA},
+				{"var/lib/dpkg/status", dpkgA + "\n" + dpkgB},
+			},
+			packages: []string{
+				"1 pkg:deb/debian/a@1.0?arch=amd64&distro=debian-12",
+				"2 pkg:deb/debian/b@2.0?arch=amd64&distro=debian-12",
+			},
+		},
+		{
+			name: "lockfile",
+			layers: [][]string{
+				{"app/package-lock.json", npmLock},
+			},
+			packages: []string{"1 pkg:npm/%40scope/left-pad@1.3.0"},
+		},
+		{
+			name: "lockfile removed by whiteout",
+			layers: [][]string{
+				{"app/package-lock.json", npmLock},
+				{"app/.wh.package-lock.json", ""},
+			},
+			packages: []string{},
+		},
+		{
+			name: "lockfile hidden by opaque directory",
+			layers: [][]string{
+				{"app/package-lock.json", npmLock},
+				{"app/.wh..wh..opq", ""},
+			},
+			packages: []string{},
+		},
+		{
+			name: "lockfile of dependency",
+			layers: [][]string{
+				{"app/node_modules/left-pad/package-lock.json", npmLock},
+			},
+			packages: []string{},
+		},
+		{
+			name: "layer absent below",
+			layers: [][]string{
+				nil,
+				{"var/lib/dpkg/status", dpkgA},
+			},
+			packages: []string{"2 absent pkg:deb/a@1.0?arch=amd64"},
+		},
+		{
+			name: "invalid lockfile and rpm database skipped",
+			layers: [][]string{
+				{"app/package-lock.json", "{", "var/lib/rpm/rpmdb.sqlite", "sqlite"},
+			},
+			packages: []string{},
+			skipped:  2,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			layers := []sbom.Layer{}
+			for i, files := range tt.layers {
+				l := sbom.Layer{DiffID: digest.FromString(fmt.Sprint(i))}
+				if files != nil {
+					l.File = writeLayer(t, dir, files...)
+				}
+				layers = append(layers, l)
+			}
+			inv, err := sbom.Catalog(layers)
+			if err != nil {
+				t.Fatal(err)
+			}
+			packages := []string{}
+			for _, p := range inv.Packages {
+				if p.DiffID != layers[p.Layer-1].DiffID {
+					t.Errorf("%s of layer %d has diff ID %s", p.Name, p.Layer, p.DiffID)
+				}
+				layer := fmt.Sprint(p.Layer)
+				if p.AbsentBelow {
+					layer += " absent"
+				}
+				packages = append(packages, layer+" "+p.PURL(inv.Distro()))
+			}
+			if !reflect.DeepEqual(packages, tt.packages) {
+				t.Errorf("packages %q, want %q", packages, tt.packages)
+			}
+			if len(inv.Skipped) != tt.skipped {
+				t.Errorf("skipped %q, want %d", inv.Skipped, tt.skipped)
+			}
+		})
+	}
+}
@@ -0,0 +1,118 @@
+package scan
+
+import (
+	"math"
+	"path"
+	"regexp"
+	"strings"
+)
+
+// fileRule flags sensitive files by path, whatever their content
+type fileRule struct {
+	name  string
+	match func(p string) bool
+}
+
+// contentRule flags secrets in content of files, of files at paths matching
+// paths only if set, the secret is the submatch named secret if any
+type contentRule struct {
+	name    string
+	pattern *regexp.Regexp
+	paths   func(p string) bool
+	// entropy is the minimum Shannon entropy in bits per character of the
+	// secret, for generic assignments of random looking values
+	entropy float64
+}
+
+var privateKeyFiles = []string{"id_rsa", "id_dsa", "id_ecdsa", "id_ed25519"}
+
+var envFileExamples = []string{".example", ".sample", ".template", ".dist"}
+
+var fileRules = []fileRule{
+	{"ssh private key file", func(p string) bool {
+		base := path.Base(p)
+		for _, name := range privateKeyFiles {
+			if base == name {
+				return true
+			}
+		}
+		return false
+	}},
+	{"dotenv file", func(p string) bool {
+		base := path.Base(p)
+		if base != ".env" && !strings.HasPrefix(base, ".env.") {
+			return false
+		}
+		for _, suffix := range envFileExamples {
+			if strings.HasSuffix(base, suffix) {
+				return false
+			}
+		}
+		return true
+	}},
+	{"aws credentials file", hasSuffix(".aws/credentials")},
+	{"git credentials file", hasSuffix(".git-credentials")},
+	{"keystore file", func(p string) bool {
+		switch path.Ext(p) {
+		case ".p12", ".pfx", ".jks", ".keystore":
+			return true
+		}
+		return false
+	}},
+}
+
+// contentRules are tried in order, generic rules last
+var contentRules = []contentRule{
+	{name: "private key", pattern: regexp.MustCompile(`-----BEGIN ((RSA|DSA|EC|OPENSSH|ENCRYPTED|PGP) )?PRIVATE KEY( BLOCK)?-----`)},
+	{name: "aws access key id", pattern: regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)},
+	{name: "aws secret access key", pattern: regexp.MustCompile(`(?i)aws_secret_access_key\s*[=:]\s*["']?(?P<secret>[A-Za-z0-9/+=]{40})`)},
+	{name: "gcp service account key", pattern: regexp.MustCompile(`"type"\s*:\s*"service_account"`)},
+	{name: "github token", pattern: regexp.MustCompile(`\b(gh[pousr]_[A-Za-z0-9]{36,}|github_pat_[A-Za-z0-9_]{60,})\b`)},
+	{name: "gitlab token", pattern: regexp.MustCompile(`\bglpat-[A-Za-z0-9_\-]{20,}\b`)},
+	{name: "slack token", pattern: regexp.MustCompile(`\bxox[abprs]-[A-Za-z0-9\-]{10,}`)},
+	{name: "google api key", pattern: regexp.MustCompile(`\bAIza[0-9A-Za-z_\-]{35}\b`)},
+	{name: "stripe live key", pattern: regexp.MustCompile(`\b[rs]k_live_[0-9A-Za-z]{24,}\b`)},
+	{name: "docker registry auth", pattern: regexp.MustCompile(`"auth"\s*:\s*"(?P<secret>[^"]+)"`), paths: hasSuffix(".docker/config.json")},
+	{name: "npm auth token", pattern: regexp.MustCompile(`_auth(Token)?\s*=\s*(?P<secret>\S+)`), paths: hasSuffix(".npmrc")},
+	{name: "netrc password", pattern: regexp.MustCompile(`\bpassword\s+(?P<secret>\S+)`), paths: hasSuffix(".netrc")},
+	{name: "pypi password", pattern: regexp.MustCompile(`^\s*password\s*[=:]\s*(?P<secret>\S+)`), paths: hasSuffix(".pypirc")},
+	{name: "kubeconfig credentials", pattern: regexp.MustCompile(`(client-key-data|token)\s*:\s*(?P<secret>\S+)`), paths: hasSuffix(".kube/config")},
+	{
+		name:    "high-entropy token",
+		pattern: regexp.MustCompile(`(?i)(secret|token|passw(or)?d|api[_\-]?key|access[_\-]?key|auth)[\w.\-]*["']?\s*[=:]\s*["']?(?P<secret>[A-Za-z0-9+/_\-=.]{20,})`),
+		entropy: 4.0,
+	},
+}
+
+func hasSuffix(suffix string) func(string) bool {
+	return func(p string) bool {
+		return p == suffix || strings.HasSuffix(p, "/"+suffix)
+	}
+}
+
+// shannonEntropy returns entropy of str in bits per character
+func shannonEntropy(str string) float64 {
+	counts := map[rune]int{}
+	for _, c := range str {
+		counts[c]++
+	}
+	entropy := 0.0
+	for _, count := range counts {
+		p := float64(count) / float64(len(str))
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
+
+// mask keeps the first characters of secret for telling findings apart
+func mask(secret string) string {
+	const shown, maxMasked = 4, 12
+	if len(secret) <= shown {
+		return strings.Repeat("*", len(secret))
+	}
+	masked := len(secret) - shown
+	if masked > maxMasked {
+		masked = maxMasked
+	}
+	return secret[:shown] + strings.Repeat("*", masked)
+}
@@ -0,0 +1,178 @@
+package scan
+
+import (
+	"archive/tar"
+	"bufio"
+	"bytes"
+	"github.com/docker/docker/pkg/archive"
+	"github.com/pkg/errors"
+	"io"
+	"path"
+	"strings"
+)
+
+// maxScanSize limits files whose content is scanned, larger files are checked
+// by path only
+const maxScanSize = 4 << 20
+
+// Finding is a secret or sensitive file found in a layer
+type Finding struct {
+	// Layer is the 1-based index of the layer the file is in
+	Layer int
+	Path  string
+	// Line is the 1-based line of the secret in file, 0 for sensitive files
+	Line   int
+	Rule   string
+	Masked string
+	// RemovedBy is the 1-based index of the layer removing or overwriting the
+	// file, 0 if the file is in the image filesystem, the secret stays in the
+	// layer either way
+	RemovedBy int
+}
+
+// Scanner scans layers of an image in order, from the lowest
+type Scanner struct {
+	excludes []string
+	layers   int
+	findings []Finding
+}
+
+// NewScanner creates a scanner skipping paths matching exclude patterns, which
+// are path prefixes or globs
+func NewScanner(excludes []string) *Scanner {
+	return &Scanner{excludes: excludes}
+}
+
+// SkipLayer accounts for a layer not scanned, e.g. absent from a partial archive
+func (s *Scanner) SkipLayer() {
+	s.layers++
+}
+
+// ScanLayer scans uncompressed tar stream of the next layer
+func (s *Scanner) ScanLayer(r io.Reader) error {
+	s.layers++
+	tr := tar.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return errors.Wrapf(err, "failed to read layer %d", s.layers)
+		}
+		name := strings.TrimPrefix(path.Clean("/"+hdr.Name), "/")
+		dir, base := path.Split(name)
+		switch {
+		case base == archive.WhiteoutOpaqueDir:
+			s.remove(strings.TrimSuffix(dir, "/"), false)
+			continue
+		case strings.HasPrefix(base, archive.WhiteoutMetaPrefix):
+			continue
+		case strings.HasPrefix(base, archive.WhiteoutPrefix):
+			s.remove(path.Join(dir, strings.TrimPrefix(base, archive.WhiteoutPrefix)), true)
+			continue
+		}
+		// replaced by an entry of any type
+		s.removeFile(name)
+		if hdr.Typeflag != tar.TypeReg || s.excluded(name) {
+			continue
+		}
+		if err := s.scanFile(name, hdr.Size, tr); err != nil {
+			return errors.Wrapf(err, "failed to scan %s of layer %d", name, s.layers)
+		}
+	}
+}
+
+// Findings returns findings of layers scanned
+func (s *Scanner) Findings() []Finding {
+	return s.findings
+}
+
+func (s *Scanner) excluded(name string) bool {
+	for _, pattern := range s.excludes {
+		pattern = strings.Trim(pattern, "/")
+		if matched, _ := path.Match(pattern, name); matched || strings.HasPrefix(name, pattern+"/") {
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Scanner) scanFile(name string, size int64, r io.Reader) error {
+	for _, rule := range fileRules {
+		if rule.match(name) {
+			s.add(Finding{Path: "/" + name, Rule: rule.name})
+		}
+	}
+	if size > maxScanSize {
+		return nil
+	}
+	content, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	// binaries only have secrets compiled in, not worth false positives
+	head := content
+	if len(head) > 8000 {
+		head = head[:8000]
+	}
+	if bytes.IndexByte(head, 0) >= 0 {
+		return nil
+	}
+
+	scanner := bufio.NewScanner(bytes.NewReader(content))
+	scanner.Buffer(nil, maxScanSize)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		matched := false
+		for _, rule := range contentRules {
+			if rule.paths != nil && !rule.paths(name) {
+				continue
+			}
+			// generic rules only catch what specific ones miss
+			if rule.entropy > 0 && matched {
+				continue
+			}
+			match := rule.pattern.FindStringSubmatch(text)
+			if match == nil {
+				continue
+			}
+			secret := match[0]
+			if i := rule.pattern.SubexpIndex("secret"); i > 0 {
+				secret = match[i]
+			}
+			if rule.entropy > 0 && shannonEntropy(secret) < rule.entropy {
+				continue
+			}
+			matched = true
+			s.add(Finding{Path: "/" + name, Line: line, Rule: rule.name, Masked: mask(secret)})
+		}
+	}
+	return scanner.Err()
+}
+
+func (s *Scanner) add(finding Finding) {
+	finding.Layer = s.layers
+	s.findings = append(s.findings, finding)
+}
+
+// remove marks findings of lower layers at and under p removed by the current
+// layer, only under p for opaque directories
+func (s *Scanner) remove(p string, self bool) {
+	for i, finding := range s.findings {
+		name := strings.TrimPrefix(finding.Path, "/")
+		under := p == "" || strings.HasPrefix(name, p+"/")
+		if finding.Layer < s.layers && finding.RemovedBy == 0 && (under || (self && name == p)) {
+			s.findings[i].RemovedBy = s.layers
+		}
+	}
+}
+
+// removeFile marks findings of lower layers at name overwritten by the current layer
+func (s *Scanner) removeFile(name string) {
+	for i, finding := range s.findings {
+		if finding.Layer < s.layers && finding.RemovedBy == 0 && finding.Path == "/"+name {
+			s.findings[i].RemovedBy = s.layers
+		}
+	}
+}
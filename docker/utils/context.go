@@ -0,0 +1,34 @@
+package utils
+
+import (
+	"context"
+	"io"
+)
+
+// ContextReader returns a reader which fails with the error of ctx once ctx is done,
+// so that copying local files stops on cancellation
+func ContextReader(ctx context.Context, r io.Reader) io.Reader {
+	return &contextReader{ctx: ctx, Reader: r}
+}
+
+// ContextReadCloser is ContextReader of an io.ReadCloser
+func ContextReadCloser(ctx context.Context, rc io.ReadCloser) io.ReadCloser {
+	return &contextReadCloser{Reader: ContextReader(ctx, rc), Closer: rc}
+}
+
+type contextReader struct {
+	ctx context.Context
+	io.Reader
+}
+
+func (r *contextReader) Read(p []byte) (int, error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, err
+	}
+	return r.Reader.Read(p)
+}
+
+type contextReadCloser struct {
+	io.Reader
+	io.Closer
+}
@@ -4,16 +4,29 @@ Copyright © William Wang <williamw0825@gmail.com>
 package main
 
 import (
+	"context"
 	"docker-save/command/commands"
 	"docker-save/command/image"
 	"docker-save/docker"
+	"docker-save/docker/progress"
 	"fmt"
+	"github.com/docker/cli/cli/streams"
+	"github.com/pkg/errors"
 	"github.com/sirupsen/logrus"
 	"github.com/spf13/cobra"
 	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
-func newDockerSaveCommand(dockerCli *docker.DockerCli) *cobra.Command {
+type globalOptions struct {
+	timeout  time.Duration
+	progress string
+	quiet    bool
+}
+
+func newDockerSaveCommand(dockerCli *docker.DockerCli, opts *globalOptions) *cobra.Command {
 
 	rootCmd := image.NewSaveCommand(dockerCli)
 
@@ -25,21 +38,66 @@ func newDockerSaveCommand(dockerCli *docker.DockerCli) *cobra.Command {
 	rootCmd.SetOut(dockerCli.Out())
 	rootCmd.SetErr(dockerCli.Err())
 
+	flags := rootCmd.PersistentFlags()
+	flags.DurationVar(&opts.timeout, "timeout", 0, "Cancel the command and clean up after the duration, e.g. 30m, no timeout by default")
+	flags.StringVar(&opts.progress, "progress", progress.ModeAuto, "Progress output on STDERR, auto (bars on a terminal, log lines otherwise), tty, plain or json")
+	flags.BoolVarP(&opts.quiet, "quiet", "q", false, "Report no progress")
+
 	commands.AddCommands(rootCmd, dockerCli)
 
 	return rootCmd
 }
 
-func runDockerSave(dockerCli *docker.DockerCli) error {
-	rootCmd := newDockerSaveCommand(dockerCli)
-	return rootCmd.Execute()
+func runDockerSave(ctx context.Context, dockerCli *docker.DockerCli) error {
+	var opts globalOptions
+	rootCmd := newDockerSaveCommand(dockerCli, &opts)
+
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	rootCmd.PersistentPreRunE = func(cmd *cobra.Command, args []string) error {
+		mode := opts.progress
+		if opts.quiet {
+			mode = progress.ModeQuiet
+		}
+		reporter, err := progress.New(dockerCli.Err(), mode, streams.NewOut(dockerCli.Err()).IsTerminal())
+		if err != nil {
+			return err
+		}
+		cmd.SetContext(progress.WithReporter(cmd.Context(), reporter))
+
+		if opts.timeout > 0 {
+			time.AfterFunc(opts.timeout, func() {
+				cancel(errors.Errorf("timed out after %s", opts.timeout))
+			})
+		}
+		return nil
+	}
+
+	err := rootCmd.ExecuteContext(ctx)
+	if err != nil && ctx.Err() != nil {
+		if cause := context.Cause(ctx); cause != context.Canceled {
+			return cause
+		}
+		return errors.New("interrupted")
+	}
+	return err
 }
 
 func main() {
 	dockerCli := docker.NewDockerCli()
 	logrus.SetOutput(dockerCli.Err())
 
-	if err := runDockerSave(dockerCli); err != nil {
+	// cancel on the first signal so temp dirs and partial output are cleaned
+	// up, a second signal terminates immediately
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	go func() {
+		<-ctx.Done()
+		stop()
+	}()
+
+	err := runDockerSave(ctx, dockerCli)
+	stop()
+	if err != nil {
 		fmt.Fprintln(dockerCli.Err(), err)
 		os.Exit(1)
 	}